@@ -0,0 +1,388 @@
+// Package apcupsdtest provides an in-process apcupsd Network Information
+// Server (NIS) for tests and demos. It serves scripted "status" and "events"
+// responses and can inject the faults seen from real daemons on flaky links:
+//
+//	srv := apcupsdtest.NewServer(apcupsdtest.DefaultStatus()...)
+//	defer srv.Close()
+//
+//	srv.SetFault(apcupsdtest.TruncatedRecord)
+//	data, err := retrieveData(ctx, srv.Addr)
+package apcupsdtest
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf16"
+)
+
+// Record is a single status field, e.g. {"BCHARGE", "100.0 Percent"}.
+type Record struct {
+	Key   string
+	Value string
+}
+
+// String formats the record the way apcupsd does on the wire.
+func (r Record) String() string {
+	return fmt.Sprintf("%-9s: %s\n", r.Key, r.Value)
+}
+
+// Fault selects a misbehaviour of the server.
+type Fault int
+
+const (
+	// NoFault serves well formed responses.
+	NoFault Fault = iota
+
+	// SlowResponse waits for the configured delay before every record.
+	SlowResponse
+
+	// DropConnection closes the connection as soon as a command arrives.
+	DropConnection
+
+	// MalformedLength announces a record longer than the one sent and then
+	// closes the connection.
+	MalformedLength
+
+	// NegativeLength sends the first record and then announces the second
+	// with a length of 0x8000 or more, which is negative when read as the
+	// signed 16 bit integer of the protocol, and closes the connection.
+	NegativeLength
+
+	// TruncatedRecord sends only half of the first record and then closes
+	// the connection.
+	TruncatedRecord
+
+	// WrongEncoding sends every record as UTF-16 rather than ASCII.
+	WrongEncoding
+)
+
+var faultNames = map[Fault]string{
+	NoFault:         "none",
+	SlowResponse:    "slow",
+	DropConnection:  "drop",
+	MalformedLength: "malformed-length",
+	NegativeLength:  "negative-length",
+	TruncatedRecord: "truncated",
+	WrongEncoding:   "wrong-encoding",
+}
+
+func (f Fault) String() string {
+	if name, ok := faultNames[f]; ok {
+		return name
+	}
+	return fmt.Sprintf("Fault(%d)", int(f))
+}
+
+// ParseFault returns the Fault with the given name, as printed by String.
+func ParseFault(name string) (Fault, error) {
+	for f, n := range faultNames {
+		if n == name {
+			return f, nil
+		}
+	}
+	return NoFault, fmt.Errorf("unknown fault %q", name)
+}
+
+// DefaultStatus returns the status of an idle, fully charged Back-UPS.
+func DefaultStatus() []Record {
+	return []Record{
+		{"APC", "001,036,0923"},
+		{"DATE", "2016-08-30 17:03:00 +1000"},
+		{"HOSTNAME", "beaker.murf.org"},
+		{"VERSION", "3.14.10 (13 September 2011) debian"},
+		{"UPSNAME", "backups-950"},
+		{"CABLE", "USB Cable"},
+		{"DRIVER", "USB UPS Driver"},
+		{"UPSMODE", "Stand Alone"},
+		{"STARTTIME", "2016-08-30 16:51:00 +1000"},
+		{"MODEL", "Back-UPS XS 950U"},
+		{"STATUS", "ONLINE"},
+		{"LINEV", "242.0 Volts"},
+		{"LOADPCT", "5.0 Percent"},
+		{"BCHARGE", "100.0 Percent"},
+		{"TIMELEFT", "104.6 Minutes"},
+		{"MBATTCHG", "5 Percent"},
+		{"MINTIMEL", "3 Minutes"},
+		{"MAXTIME", "0 Seconds"},
+		{"SENSE", "Medium"},
+		{"LOTRANS", "155.0 Volts"},
+		{"HITRANS", "280.0 Volts"},
+		{"ALARMDEL", "30 Seconds"},
+		{"BATTV", "13.5 Volts"},
+		{"LASTXFER", "Unacceptable line voltage changes"},
+		{"NUMXFERS", "0"},
+		{"TONBATT", "0 Seconds"},
+		{"CUMONBATT", "0 Seconds"},
+		{"XOFFBATT", "N/A"},
+		{"SELFTEST", "NO"},
+		{"STATFLAG", "0x07000008"},
+		{"SERIALNO", "3B1443X05291"},
+		{"BATTDATE", "2014-10-21"},
+		{"NOMINV", "230 Volts"},
+		{"NOMBATTV", "12.0 Volts"},
+		{"NOMPOWER", "480 Watts"},
+		{"FIRMWARE", "925.T1 .I USB FW:T1"},
+		{"END APC", "2016-08-30 17:03:01 +1000"},
+	}
+}
+
+// Server is an apcupsd NIS listening on a local address.
+type Server struct {
+	// Addr is the host:port the server listens on, set by Start.
+	Addr string
+
+	// Listener may be replaced between NewUnstartedServer and Start, for
+	// example to listen on a fixed address.
+	Listener net.Listener
+
+	mtx        sync.Mutex
+	status     []Record
+	statusFunc func() []Record
+	events     []string
+	fault      Fault
+	delay      time.Duration
+	requests   int
+	conns      map[net.Conn]struct{}
+	closed     bool
+
+	wg sync.WaitGroup
+}
+
+// NewServer starts a server on a loopback port serving the given status.
+func NewServer(status ...Record) *Server {
+	s := NewUnstartedServer(status...)
+	s.Start()
+	return s
+}
+
+// NewUnstartedServer returns a server listening on a loopback port that does
+// not accept connections until Start is called.
+func NewUnstartedServer(status ...Record) *Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("apcupsdtest: failed to listen on a port: %v", err))
+	}
+
+	return &Server{
+		Listener: l,
+		status:   status,
+		conns:    map[net.Conn]struct{}{},
+	}
+}
+
+// Start begins accepting connections.
+func (s *Server) Start() {
+	s.Addr = s.Listener.Addr().String()
+
+	s.wg.Add(1)
+	go s.serve()
+}
+
+// Close stops the server and closes all open connections.
+func (s *Server) Close() error {
+	s.mtx.Lock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mtx.Unlock()
+
+	err := s.Listener.Close()
+	s.wg.Wait()
+	return err
+}
+
+// SetStatus replaces the records served for the "status" command.
+func (s *Server) SetStatus(status ...Record) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.status = status
+	s.statusFunc = nil
+}
+
+// SetStatusFunc makes the server call f for the records of every "status"
+// command, for responses that change over time. f must not call back into
+// the Server.
+func (s *Server) SetStatusFunc(f func() []Record) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.statusFunc = f
+}
+
+// SetEvents replaces the lines served for the "events" command.
+func (s *Server) SetEvents(events ...string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.events = events
+}
+
+// SetFault makes all following responses misbehave as described by f.
+func (s *Server) SetFault(f Fault) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.fault = f
+}
+
+// SetDelay sets the per record delay used by the SlowResponse fault.
+func (s *Server) SetDelay(d time.Duration) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.delay = d
+}
+
+// Requests returns the number of commands received so far.
+func (s *Server) Requests() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.requests
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.Listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mtx.Lock()
+		if s.closed {
+			s.mtx.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.mtx.Unlock()
+
+		s.wg.Add(1)
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mtx.Lock()
+		delete(s.conns, conn)
+		s.mtx.Unlock()
+		conn.Close()
+	}()
+
+	// apcupsd keeps the connection open for further commands until the
+	// client hangs up.
+	for {
+		cmd, err := readFrame(conn)
+		if err != nil {
+			return
+		}
+
+		s.mtx.Lock()
+		s.requests++
+		fault, delay := s.fault, s.delay
+		var lines []string
+		switch cmd {
+		case "status":
+			status := s.status
+			if s.statusFunc != nil {
+				status = s.statusFunc()
+			}
+			for _, r := range status {
+				lines = append(lines, r.String())
+			}
+		case "events":
+			for _, e := range s.events {
+				lines = append(lines, e+"\n")
+			}
+		default:
+			lines = []string{"Invalid command\n"}
+		}
+		s.mtx.Unlock()
+
+		if err := respond(conn, lines, fault, delay); err != nil {
+			return
+		}
+	}
+}
+
+func respond(conn net.Conn, lines []string, fault Fault, delay time.Duration) error {
+
+	switch fault {
+	case DropConnection:
+		return io.EOF
+
+	case MalformedLength:
+		if len(lines) > 0 {
+			writeLength(conn, len(lines[0])+512)
+			conn.Write([]byte(lines[0]))
+		}
+		return io.EOF
+
+	case NegativeLength:
+		if len(lines) > 1 {
+			writeLength(conn, len(lines[0]))
+			conn.Write([]byte(lines[0]))
+			writeLength(conn, 0x8000+len(lines[1]))
+			conn.Write([]byte(lines[1]))
+		}
+		return io.EOF
+
+	case TruncatedRecord:
+		if len(lines) > 0 {
+			writeLength(conn, len(lines[0]))
+			conn.Write([]byte(lines[0][:len(lines[0])/2]))
+		}
+		return io.EOF
+	}
+
+	for _, line := range lines {
+		if fault == SlowResponse {
+			time.Sleep(delay)
+		}
+
+		data := []byte(line)
+		if fault == WrongEncoding {
+			data = encodeUTF16(line)
+		}
+
+		if err := writeLength(conn, len(data)); err != nil {
+			return err
+		}
+		if _, err := conn.Write(data); err != nil {
+			return err
+		}
+	}
+
+	return writeLength(conn, 0)
+}
+
+func readFrame(r io.Reader) (string, error) {
+	var size uint16
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return "", err
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+func writeLength(w io.Writer, n int) error {
+	return binary.Write(w, binary.BigEndian, uint16(n))
+}
+
+func encodeUTF16(s string) []byte {
+	units := utf16.Encode([]rune(s))
+	data := make([]byte, 0, len(units)*2)
+	for _, u := range units {
+		data = append(data, byte(u), byte(u>>8))
+	}
+	return data
+}
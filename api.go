@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// upsJSON is the JSON representation of a decoded upsInfo.
+type upsJSON struct {
+	Hostname     string `json:"hostname"`
+	UPSName      string `json:"upsname"`
+	Model        string `json:"model,omitempty"`
+	SerialNumber string `json:"serial_number,omitempty"`
+	Firmware     string `json:"firmware,omitempty"`
+
+	Status      string   `json:"status"`
+	StatusFlags []string `json:"status_flags"`
+
+	BatteryChargePercent float64 `json:"battery_charge_percent"`
+	LoadPercent          float64 `json:"load_percent"`
+
+	TimeLeftSeconds         float64 `json:"time_left_seconds"`
+	TimeOnBatterySeconds    float64 `json:"time_on_battery_seconds"`
+	CumTimeOnBatterySeconds float64 `json:"cum_time_on_battery_seconds"`
+
+	NominalPowerWatts      float64         `json:"nominal_power_watts"`
+	BatteryVolts           float64         `json:"battery_volts"`
+	LineVolts              float64         `json:"line_volts"`
+	OutputVolts            float64         `json:"output_volts"`
+	NominalBatteryVolts    float64         `json:"nominal_battery_volts"`
+	NominalInputVolts      float64         `json:"nominal_input_volts"`
+	LowTransferVolts       float64         `json:"low_transfer_volts"`
+	HighTransferVolts      float64         `json:"high_transfer_volts"`
+	InternalTempCelsius    float64         `json:"internal_temperature_celsius"`
+	OutletGroupsSwitchedOn map[string]bool `json:"outlet_groups,omitempty"`
+
+	NumTransfers       float64    `json:"num_transfers"`
+	LastTransferReason string     `json:"last_transfer_reason,omitempty"`
+	LastOnBattery      *time.Time `json:"last_on_battery,omitempty"`
+	LastOffBattery     *time.Time `json:"last_off_battery,omitempty"`
+	SelfTestResult     string     `json:"self_test_result,omitempty"`
+	LastSelfTest       *time.Time `json:"last_self_test,omitempty"`
+	Date               *time.Time `json:"date,omitempty"`
+}
+
+func newUPSJSON(info *upsInfo) *upsJSON {
+	return &upsJSON{
+		Hostname:     info.hostname,
+		UPSName:      info.upsName,
+		Model:        info.model,
+		SerialNumber: info.serialNumber,
+		Firmware:     info.firmware,
+
+		Status:      info.status,
+		StatusFlags: statusFlags(info.status),
+
+		BatteryChargePercent: info.batteryChargePercent,
+		LoadPercent:          info.loadPercent,
+
+		TimeLeftSeconds:         info.timeLeft.Seconds(),
+		TimeOnBatterySeconds:    info.timeOnBattery.Seconds(),
+		CumTimeOnBatterySeconds: info.cumTimeOnBattery.Seconds(),
+
+		NominalPowerWatts:      info.nomPower,
+		BatteryVolts:           info.batteryVoltage,
+		LineVolts:              info.lineVoltage,
+		OutputVolts:            info.outputVoltage,
+		NominalBatteryVolts:    info.nomBatteryVoltage,
+		NominalInputVolts:      info.nomInputVoltage,
+		LowTransferVolts:       info.lowTransfer,
+		HighTransferVolts:      info.highTransfer,
+		InternalTempCelsius:    info.internalTemp,
+		OutletGroupsSwitchedOn: info.outletGroups,
+
+		NumTransfers:       info.numTransfers,
+		LastTransferReason: info.lastTransferReason,
+		LastOnBattery:      optionalTime(info.lastOnBattery),
+		LastOffBattery:     optionalTime(info.lastOffBattery),
+		SelfTestResult:     info.selfTestResult,
+		LastSelfTest:       optionalTime(info.lastSelfTest),
+		Date:               optionalTime(info.date),
+	}
+}
+
+// numericField is a numeric value of a snapshot, named as in the JSON API,
+// for the outputs that take flat name and value pairs.
+type numericField struct {
+	name  string
+	value float64
+}
+
+// numericFields returns the numeric values of info. status_numeric is left
+// out for a status not in statusList, as for apcups_status_numeric.
+func numericFields(info *upsInfo) []numericField {
+
+	var fields []numericField
+	for i, stat := range statusList {
+		if stat == info.status {
+			fields = append(fields, numericField{"status_numeric", float64(i)})
+		}
+	}
+
+	return append(fields, []numericField{
+		{"battery_charge_percent", info.batteryChargePercent},
+		{"load_percent", info.loadPercent},
+		{"time_left_seconds", info.timeLeft.Seconds()},
+		{"time_on_battery_seconds", info.timeOnBattery.Seconds()},
+		{"cum_time_on_battery_seconds", info.cumTimeOnBattery.Seconds()},
+		{"nominal_power_watts", info.nomPower},
+		{"battery_volts", info.batteryVoltage},
+		{"line_volts", info.lineVoltage},
+		{"output_volts", info.outputVoltage},
+		{"nominal_battery_volts", info.nomBatteryVoltage},
+		{"nominal_input_volts", info.nomInputVoltage},
+		{"low_transfer_volts", info.lowTransfer},
+		{"high_transfer_volts", info.highTransfer},
+		{"internal_temperature_celsius", info.internalTemp},
+		{"num_transfers", info.numTransfers},
+	}...)
+}
+
+// optionalTime returns nil for the zero time so that it is omitted from JSON.
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// targetJSON is the state of a single target as returned by the API.
+type targetJSON struct {
+	ID     string `json:"id"`
+	Target string `json:"target"`
+	URL    string `json:"url"`
+
+	Up        bool       `json:"up"`
+	LastPoll  *time.Time `json:"last_poll,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+
+	// SnapshotTime is when the UPS data was retrieved, which lags LastPoll
+	// while polls are failing.
+	SnapshotTime *time.Time        `json:"snapshot_time,omitempty"`
+	UPS          *upsJSON          `json:"ups,omitempty"`
+	Raw          map[string]string `json:"raw,omitempty"`
+}
+
+func newTargetJSON(t *target, withRaw bool) *targetJSON {
+
+	snapshot, lastPoll, lastErr := t.state()
+
+	v := &targetJSON{
+		ID:     t.slug(),
+		Target: t.name,
+		URL:    "/api/v1/ups/" + t.slug(),
+		Up:     !lastPoll.IsZero() && lastErr == nil,
+	}
+
+	if !lastPoll.IsZero() {
+		v.LastPoll = &lastPoll
+	}
+	if lastErr != nil {
+		v.LastError = lastErr.Error()
+	}
+	if snapshot != nil {
+		v.SnapshotTime = &snapshot.Time
+		v.UPS = newUPSJSON(snapshot.Info)
+		if withRaw {
+			v.Raw = snapshot.Raw
+		}
+	}
+
+	return v
+}
+
+// apiHandler serves the decoded state of all targets:
+//
+//	/api/v1/ups         list of all targets
+//	/api/v1/ups/{id}    a single target including its raw fields
+//
+// where id is the target's slug or its UPS name.
+type apiHandler struct {
+	targets func() []*target
+}
+
+func (h *apiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/ups"), "/")
+
+	if id == "" {
+		list := []*targetJSON{}
+		for _, t := range h.targets() {
+			list = append(list, newTargetJSON(t, false))
+		}
+		writeJSON(w, http.StatusOK, list)
+		return
+	}
+
+	if t := findTarget(h.targets(), id); t != nil {
+		writeJSON(w, http.StatusOK, newTargetJSON(t, true))
+		return
+	}
+
+	writeJSONError(w, http.StatusNotFound, "unknown target "+id)
+}
+
+// findTarget looks up a target by slug, falling back to the UPS name of its
+// last snapshot.
+func findTarget(targets []*target, id string) *target {
+
+	for _, t := range targets {
+		if t.slug() == id {
+			return t
+		}
+	}
+
+	for _, t := range targets {
+		if snapshot, _, _ := t.state(); snapshot != nil && snapshot.Info.upsName == id {
+			return t
+		}
+	}
+
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"error": msg})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAPIHandler(t *testing.T) {
+
+	rack1 := newTestTarget("ups-host:3551", nil, &upsInfo{status: "onbatt lowbatt", upsName: "rack1", batteryChargePercent: 12})
+	rack1.last.Raw = map[string]string{"STATUS": "ONBATT LOWBATT"}
+	rack2 := newTestTarget("nis://other:3551", nil, &upsInfo{status: "online", upsName: "rack2"})
+	rack2.lastErr = errors.New("connection refused")
+	pending := &target{name: "pending:3551"}
+
+	h := &apiHandler{targets: func() []*target { return []*target{rack1, rack2, pending} }}
+
+	tests := []struct {
+		method, path string
+		code         int
+		want         []string
+	}{
+		{method: "GET", path: "/api/v1/ups", code: http.StatusOK, want: []string{"ups-host_3551", "nis_other_3551", "pending_3551"}},
+		{method: "GET", path: "/api/v1/ups/", code: http.StatusOK, want: []string{"ups-host_3551", "nis_other_3551", "pending_3551"}},
+		{method: "GET", path: "/api/v1/ups/ups-host_3551", code: http.StatusOK, want: []string{"ups-host_3551"}},
+		{method: "GET", path: "/api/v1/ups/rack2", code: http.StatusOK, want: []string{"nis_other_3551"}},
+		{method: "HEAD", path: "/api/v1/ups/pending_3551", code: http.StatusOK},
+		{method: "GET", path: "/api/v1/ups/rack3", code: http.StatusNotFound},
+		{method: "POST", path: "/api/v1/ups", code: http.StatusMethodNotAllowed},
+	}
+
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(test.method, test.path, nil))
+
+		if rec.Code != test.code || rec.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%s %s = %d %s, want %d", test.method, test.path, rec.Code, rec.Header().Get("Content-Type"), test.code)
+			continue
+		}
+		if test.want == nil {
+			continue
+		}
+
+		var got []targetJSON
+		if len(test.want) == 1 {
+			var one targetJSON
+			if err := json.Unmarshal(rec.Body.Bytes(), &one); err != nil {
+				t.Fatalf("%s: invalid JSON %q: %+v", test.path, rec.Body, err)
+			}
+			got = append(got, one)
+		} else if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatalf("%s: invalid JSON %q: %+v", test.path, rec.Body, err)
+		}
+
+		if len(got) != len(test.want) {
+			t.Errorf("%s returned %d targets, want %d", test.path, len(got), len(test.want))
+			continue
+		}
+		for i, id := range test.want {
+			if got[i].ID != id || got[i].URL != "/api/v1/ups/"+id {
+				t.Errorf("%s: target %d is %s at %s, want %s", test.path, i, got[i].ID, got[i].URL, id)
+			}
+			// Raw fields are only returned for a single target.
+			if (got[i].Raw != nil) != (len(test.want) == 1 && id == "ups-host_3551") {
+				t.Errorf("%s: target %s has raw fields %v", test.path, id, got[i].Raw)
+			}
+		}
+	}
+}
+
+func TestNewTargetJSON(t *testing.T) {
+
+	polled := time.Unix(1700000000, 0)
+
+	up := newTestTarget("up", nil, &upsInfo{status: "onbatt lowbatt"})
+	up.lastPoll = polled
+
+	down := newTestTarget("down", nil, &upsInfo{status: "online"})
+	down.lastPoll, down.lastErr = polled, errors.New("connection refused")
+
+	tests := []struct {
+		name      string
+		ups       *target
+		up        bool
+		lastError string
+		flags     int
+	}{
+		{name: "up", ups: up, up: true, flags: 2},
+		{name: "down", ups: down, lastError: "connection refused", flags: 1},
+		{name: "never polled", ups: &target{name: "pending"}},
+	}
+
+	for _, test := range tests {
+		v := newTargetJSON(test.ups, false)
+
+		if v.Up != test.up || v.LastError != test.lastError {
+			t.Errorf("%s: up %v with error %q, want %v and %q", test.name, v.Up, v.LastError, test.up, test.lastError)
+		}
+		if (v.LastPoll != nil) != (test.ups.last != nil) || (v.UPS != nil) != (test.ups.last != nil) {
+			t.Errorf("%s: last poll %v and UPS %v", test.name, v.LastPoll, v.UPS)
+		}
+		if v.UPS != nil && len(v.UPS.StatusFlags) != test.flags {
+			t.Errorf("%s: status flags %q, want %d", test.name, v.UPS.StatusFlags, test.flags)
+		}
+	}
+}
+
+func TestNumericFieldsMatchJSON(t *testing.T) {
+
+	info := &upsInfo{
+		status: "online", batteryChargePercent: 1, loadPercent: 2, timeLeft: 3 * time.Second,
+		timeOnBattery: 4 * time.Second, cumTimeOnBattery: 5 * time.Second, nomPower: 6,
+		batteryVoltage: 7, lineVoltage: 8, outputVoltage: 9, nomBatteryVoltage: 10,
+		nomInputVoltage: 11, lowTransfer: 12, highTransfer: 13, internalTemp: 14, numTransfers: 15,
+	}
+
+	encoded, _ := json.Marshal(newUPSJSON(info))
+	var fields map[string]interface{}
+	json.Unmarshal(encoded, &fields)
+
+	for _, f := range numericFields(info) {
+		if f.name == "status_numeric" {
+			continue
+		}
+		if got, ok := fields[f.name].(float64); !ok || got != f.value {
+			t.Errorf("Field %s = %v in JSON, want %v", f.name, fields[f.name], f.value)
+		}
+	}
+}
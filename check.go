@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	subcommands["check"] = runCheck
+}
+
+// Nagios plugin return codes.
+const (
+	checkOK = iota
+	checkWarning
+	checkCritical
+	checkUnknown
+)
+
+var checkStateNames = []string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+// checkStatusFlags gives the state each apcupsd status flag raises and how
+// to describe it. Flags not listed, such as trim and boost, are normal
+// operation.
+var checkStatusFlags = map[string]struct {
+	state       int
+	description string
+}{
+	"onbatt":        {checkWarning, "on battery"},
+	"lowbatt":       {checkCritical, "battery low"},
+	"replacebatt":   {checkWarning, "battery needs replacing"},
+	"nobatt":        {checkCritical, "no battery"},
+	"overload":      {checkCritical, "overloaded"},
+	"bypass":        {checkWarning, "on bypass"},
+	"off":           {checkCritical, "output off"},
+	"slavedown":     {checkWarning, "slave not responding"},
+	"commlost":      {checkCritical, "communication with UPS lost"},
+	"shutting down": {checkCritical, "shutting down"},
+}
+
+// checkThresholds holds the limits of a check; zero disables a limit.
+type checkThresholds struct {
+	warnCharge, critCharge     float64
+	warnTimeLeft, critTimeLeft time.Duration
+	warnLoad, critLoad         float64
+}
+
+// checkResult is the state of a check and the problems that caused it.
+type checkResult struct {
+	state    int
+	problems []string
+}
+
+func (r *checkResult) raise(state int, problem string) {
+	if state > r.state {
+		r.state = state
+	}
+	r.problems = append(r.problems, problem)
+}
+
+// runCheck queries a UPS once and reports its state as a Nagios or Icinga
+// check plugin: a single status line with performance data, and an exit
+// code of 0 (OK), 1 (WARNING), 2 (CRITICAL) or 3 (UNKNOWN).
+func runCheck(args []string) int {
+
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	upsAddr := flags.String("ups", "localhost:3551", "The UPS to query: hostname:port or a URL such as nis://host:3551 or modbus://host:502")
+	timeout := flags.Duration("timeout", 10*time.Second, "How long to wait for the UPS before reporting UNKNOWN")
+
+	var th checkThresholds
+	flags.Float64Var(&th.warnCharge, "warn-charge", 0, "WARNING when the battery charge is below this percentage")
+	flags.Float64Var(&th.critCharge, "crit-charge", 0, "CRITICAL when the battery charge is below this percentage")
+	flags.DurationVar(&th.warnTimeLeft, "warn-timeleft", 0, "WARNING when the estimated runtime left is below this, e.g. 10m")
+	flags.DurationVar(&th.critTimeLeft, "crit-timeleft", 0, "CRITICAL when the estimated runtime left is below this, e.g. 5m")
+	flags.Float64Var(&th.warnLoad, "warn-load", 0, "WARNING when the load is above this percentage")
+	flags.Float64Var(&th.critLoad, "crit-load", 0, "CRITICAL when the load is above this percentage")
+
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			flags.SetOutput(os.Stdout)
+			flags.PrintDefaults()
+		} else {
+			fmt.Printf("APCUPSD UNKNOWN - %+v\n", err)
+		}
+		return checkUnknown
+	}
+
+	t, err := newTarget(*upsAddr, "nis")
+	if err != nil {
+		fmt.Printf("APCUPSD UNKNOWN - %+v\n", err)
+		return checkUnknown
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	snapshot, err := t.fetch(ctx)
+	if err != nil {
+		fmt.Printf("APCUPSD UNKNOWN - Unable to query UPS at %s: %+v\n", *upsAddr, err)
+		return checkUnknown
+	}
+
+	return writeCheck(os.Stdout, snapshot.Info, th)
+}
+
+// writeCheck prints the status line of info and returns its state.
+func writeCheck(w io.Writer, info *upsInfo, th checkThresholds) int {
+
+	result := evaluateCheck(info, th)
+
+	name := info.upsName
+	if name == "" {
+		name = info.hostname
+	}
+
+	summary := strings.Join(result.problems, ", ")
+	if result.state == checkOK {
+		summary = fmt.Sprintf("%s, charge %.0f%%, load %.0f%%, time left %s",
+			info.status, info.batteryChargePercent, info.loadPercent, formatDuration(info.timeLeft))
+	}
+
+	fmt.Fprintf(w, "APCUPSD %s - %s: %s | %s\n", checkStateNames[result.state], name, summary, checkPerfdata(info, th))
+
+	return result.state
+}
+
+// evaluateCheck combines the states raised by every status flag and every
+// threshold crossed; the worst one wins.
+func evaluateCheck(info *upsInfo, th checkThresholds) *checkResult {
+
+	result := &checkResult{}
+
+	for _, flag := range statusFlags(info.status) {
+		if s, ok := checkStatusFlags[flag]; ok {
+			result.raise(s.state, s.description)
+		}
+	}
+
+	// With communication lost the values are stale, don't judge them.
+	if strings.Contains(info.status, "commlost") {
+		return result
+	}
+
+	switch {
+	case th.critCharge > 0 && info.batteryChargePercent < th.critCharge:
+		result.raise(checkCritical, fmt.Sprintf("charge %.0f%% < %.0f%%", info.batteryChargePercent, th.critCharge))
+	case th.warnCharge > 0 && info.batteryChargePercent < th.warnCharge:
+		result.raise(checkWarning, fmt.Sprintf("charge %.0f%% < %.0f%%", info.batteryChargePercent, th.warnCharge))
+	}
+
+	switch {
+	case th.critTimeLeft > 0 && info.timeLeft < th.critTimeLeft:
+		result.raise(checkCritical, fmt.Sprintf("time left %s < %s", formatDuration(info.timeLeft), formatDuration(th.critTimeLeft)))
+	case th.warnTimeLeft > 0 && info.timeLeft < th.warnTimeLeft:
+		result.raise(checkWarning, fmt.Sprintf("time left %s < %s", formatDuration(info.timeLeft), formatDuration(th.warnTimeLeft)))
+	}
+
+	switch {
+	case th.critLoad > 0 && info.loadPercent > th.critLoad:
+		result.raise(checkCritical, fmt.Sprintf("load %.0f%% > %.0f%%", info.loadPercent, th.critLoad))
+	case th.warnLoad > 0 && info.loadPercent > th.warnLoad:
+		result.raise(checkWarning, fmt.Sprintf("load %.0f%% > %.0f%%", info.loadPercent, th.warnLoad))
+	}
+
+	return result
+}
+
+// checkPerfdata formats the performance data of info. Lower limits are
+// given as ranges ending in a colon, alerting below the value.
+func checkPerfdata(info *upsInfo, th checkThresholds) string {
+
+	threshold := func(value float64, lower bool) string {
+		if value <= 0 {
+			return ""
+		}
+		if lower {
+			return fmt.Sprintf("%g:", value)
+		}
+		return fmt.Sprintf("%g", value)
+	}
+
+	// Values are parsed as 32 bit floats, don't report the noise beyond.
+	format := func(value float64) string {
+		return strconv.FormatFloat(value, 'f', -1, 32)
+	}
+
+	perfdata := []string{
+		fmt.Sprintf("charge=%s%%;%s;%s;0;100", format(info.batteryChargePercent),
+			threshold(th.warnCharge, true), threshold(th.critCharge, true)),
+		fmt.Sprintf("load=%s%%;%s;%s;0;100", format(info.loadPercent),
+			threshold(th.warnLoad, false), threshold(th.critLoad, false)),
+		fmt.Sprintf("timeleft=%gs;%s;%s;0;", info.timeLeft.Seconds(),
+			threshold(th.warnTimeLeft.Seconds(), true), threshold(th.critTimeLeft.Seconds(), true)),
+		fmt.Sprintf("battery_voltage=%s", format(info.batteryVoltage)),
+		fmt.Sprintf("line_voltage=%s", format(info.lineVoltage)),
+		fmt.Sprintf("output_voltage=%s", format(info.outputVoltage)),
+	}
+
+	return strings.Join(perfdata, " ")
+}
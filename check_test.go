@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvaluateCheck(t *testing.T) {
+
+	th := checkThresholds{
+		warnCharge: 50, critCharge: 20,
+		warnTimeLeft: 10 * time.Minute, critTimeLeft: 5 * time.Minute,
+		warnLoad: 80, critLoad: 95,
+	}
+	healthy := upsInfo{status: "online", batteryChargePercent: 100, timeLeft: time.Hour, loadPercent: 30}
+
+	tests := []struct {
+		name     string
+		modify   func(info *upsInfo)
+		th       checkThresholds
+		state    int
+		problems []string
+	}{
+		{name: "healthy", modify: func(*upsInfo) {}, th: th, state: checkOK},
+		{name: "trim is normal", modify: func(i *upsInfo) { i.status = "online trim" }, th: th, state: checkOK},
+		{name: "on battery", modify: func(i *upsInfo) { i.status = "onbatt" }, th: th, state: checkWarning, problems: []string{"on battery"}},
+		{name: "on battery and low", modify: func(i *upsInfo) { i.status = "onbatt lowbatt" }, th: th, state: checkCritical, problems: []string{"on battery", "battery low"}},
+		{name: "shutting down", modify: func(i *upsInfo) { i.status = "onbatt shutting down" }, th: th, state: checkCritical, problems: []string{"on battery", "shutting down"}},
+		{name: "bypass", modify: func(i *upsInfo) { i.status = "online bypass" }, th: th, state: checkWarning, problems: []string{"on bypass"}},
+		{name: "output off", modify: func(i *upsInfo) { i.status = "online off" }, th: th, state: checkCritical, problems: []string{"output off"}},
+		{name: "charge warning", modify: func(i *upsInfo) { i.batteryChargePercent = 40 }, th: th, state: checkWarning, problems: []string{"charge 40% < 50%"}},
+		{name: "charge critical", modify: func(i *upsInfo) { i.batteryChargePercent = 10 }, th: th, state: checkCritical, problems: []string{"charge 10% < 20%"}},
+		{name: "time left warning", modify: func(i *upsInfo) { i.timeLeft = 8 * time.Minute }, th: th, state: checkWarning, problems: []string{"time left 8m00s < 10m00s"}},
+		{name: "time left critical", modify: func(i *upsInfo) { i.timeLeft = time.Minute }, th: th, state: checkCritical, problems: []string{"time left 1m00s < 5m00s"}},
+		{name: "load warning", modify: func(i *upsInfo) { i.loadPercent = 85 }, th: th, state: checkWarning, problems: []string{"load 85% > 80%"}},
+		{name: "load critical", modify: func(i *upsInfo) { i.loadPercent = 99 }, th: th, state: checkCritical, problems: []string{"load 99% > 95%"}},
+		{name: "thresholds disabled", modify: func(i *upsInfo) { i.batteryChargePercent, i.timeLeft, i.loadPercent = 1, 0, 100 }, state: checkOK},
+		{name: "worst state wins", modify: func(i *upsInfo) { i.batteryChargePercent, i.loadPercent = 40, 99 }, th: th, state: checkCritical, problems: []string{"charge 40% < 50%", "load 99% > 95%"}},
+		{name: "stale values ignored", modify: func(i *upsInfo) { i.status, i.batteryChargePercent = "commlost", 0 }, th: th, state: checkCritical, problems: []string{"communication with UPS lost"}},
+	}
+
+	for _, test := range tests {
+		info := healthy
+		test.modify(&info)
+
+		result := evaluateCheck(&info, test.th)
+		if result.state != test.state || strings.Join(result.problems, "; ") != strings.Join(test.problems, "; ") {
+			t.Errorf("%s: evaluateCheck() = %s %q, want %s %q", test.name, checkStateNames[result.state], result.problems, checkStateNames[test.state], test.problems)
+		}
+	}
+}
+
+func TestWriteCheck(t *testing.T) {
+
+	th := checkThresholds{warnCharge: 50, critCharge: 20, critTimeLeft: 5 * time.Minute, warnLoad: 80}
+
+	tests := []struct {
+		name  string
+		info  upsInfo
+		state int
+		want  string
+	}{
+		{
+			name:  "ok",
+			info:  upsInfo{status: "online", upsName: "rack1", batteryChargePercent: 100, loadPercent: 22.1, timeLeft: 75 * time.Minute, batteryVoltage: 27.3, lineVoltage: 230, outputVoltage: 230},
+			state: checkOK,
+			want:  "APCUPSD OK - rack1: online, charge 100%, load 22%, time left 1h15m00s | charge=100%;50:;20:;0;100 load=22.1%;80;;0;100 timeleft=4500s;;300:;0; battery_voltage=27.3 line_voltage=230 output_voltage=230\n",
+		},
+		{
+			name:  "problems, named by host",
+			info:  upsInfo{status: "onbatt", hostname: "beaker", batteryChargePercent: 15, loadPercent: 30, timeLeft: 4 * time.Minute},
+			state: checkCritical,
+			want:  "APCUPSD CRITICAL - beaker: on battery, charge 15% < 20%, time left 4m00s < 5m00s | charge=15%;50:;20:;0;100 load=30%;80;;0;100 timeleft=240s;;300:;0; battery_voltage=0 line_voltage=0 output_voltage=0\n",
+		},
+	}
+
+	for _, test := range tests {
+		var out bytes.Buffer
+		if state := writeCheck(&out, &test.info, th); state != test.state {
+			t.Errorf("%s: writeCheck() = %d, want %d", test.name, state, test.state)
+		}
+		if out.String() != test.want {
+			t.Errorf("%s: wrote\n%q, want\n%q", test.name, out.String(), test.want)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+// config is the contents of the file given with --config.file, e.g.
+//
+//	global:
+//	  interval: 10s
+//	  backend: nis
+//	targets:
+//	  - address: ups-rack1:3551
+//	    labels:
+//	      rack: a1
+//	  - name: rack2
+//	    address: exec:///usr/bin/ssh?arg=ups-rack2&arg=apcaccess
+//	    interval: 30s
+//	    timeout: 20s
+//	    username: monitor
+//	    password_file: /etc/ups-exporter/rack2.password
+type config struct {
+	Global  globalConfig   `yaml:"global"`
+	Targets []targetConfig `yaml:"targets"`
+}
+
+// globalConfig holds the defaults for every target.
+type globalConfig struct {
+	Interval time.Duration     `yaml:"interval"`
+	Timeout  time.Duration     `yaml:"timeout"`
+	Backend  string            `yaml:"backend"`
+	Labels   map[string]string `yaml:"labels"`
+}
+
+// targetConfig is a single UPS to poll. Zero values are taken from the
+// global section.
+type targetConfig struct {
+	Name     string            `yaml:"name"`
+	Address  string            `yaml:"address"`
+	Backend  string            `yaml:"backend"`
+	Interval time.Duration     `yaml:"interval"`
+	Timeout  time.Duration     `yaml:"timeout"`
+	Labels   map[string]string `yaml:"labels"`
+
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password"`
+	PasswordFile string `yaml:"password_file"`
+}
+
+// reservedLabels are set by the exporter itself and may not be used as
+// target labels.
+var reservedLabels = map[string]bool{
+	"hostname": true,
+	"upsname":  true,
+	"status":   true,
+	"group":    true,
+	"target":   true,
+}
+
+// loadConfig reads and validates a configuration file. Either the whole file
+// is valid or an error is returned, so that a bad edit never leaves the
+// exporter half reconfigured.
+func loadConfig(path string) (*config, error) {
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read configuration file: %+v", err)
+	}
+
+	cfg := &config{}
+	if err := yaml.UnmarshalStrict(content, cfg); err != nil {
+		return nil, fmt.Errorf("Unable to parse configuration file %s: %+v", path, err)
+	}
+
+	if err := cfg.resolve(); err != nil {
+		return nil, fmt.Errorf("Invalid configuration file %s: %+v", path, err)
+	}
+
+	return cfg, nil
+}
+
+// resolve fills in defaults, reads password files and checks that every
+// target can be built.
+func (c *config) resolve() error {
+
+	if c.Global.Interval == 0 {
+		c.Global.Interval = 10 * time.Second
+	}
+	if c.Global.Backend == "" {
+		c.Global.Backend = "nis"
+	}
+	if c.Global.Interval < 0 || c.Global.Timeout < 0 {
+		return fmt.Errorf("global interval and timeout must not be negative")
+	}
+	if err := checkLabels(c.Global.Labels); err != nil {
+		return fmt.Errorf("global: %+v", err)
+	}
+
+	if len(c.Targets) == 0 {
+		return fmt.Errorf("no targets configured")
+	}
+
+	names := map[string]bool{}
+	for i := range c.Targets {
+		tc := &c.Targets[i]
+
+		if tc.Address == "" {
+			return fmt.Errorf("target %d: missing address", i+1)
+		}
+		if tc.Name == "" {
+			tc.Name = tc.Address
+		}
+		if names[tc.Name] {
+			return fmt.Errorf("target %q configured twice", tc.Name)
+		}
+		names[tc.Name] = true
+
+		if tc.Backend == "" {
+			tc.Backend = c.Global.Backend
+		}
+		if tc.Interval == 0 {
+			tc.Interval = c.Global.Interval
+		}
+		if tc.Timeout == 0 {
+			tc.Timeout = c.Global.Timeout
+		}
+		if tc.Timeout == 0 || tc.Timeout > tc.Interval {
+			tc.Timeout = tc.Interval
+		}
+		if tc.Interval < 0 || tc.Timeout < 0 {
+			return fmt.Errorf("target %q: interval and timeout must not be negative", tc.Name)
+		}
+
+		if err := checkLabels(tc.Labels); err != nil {
+			return fmt.Errorf("target %q: %+v", tc.Name, err)
+		}
+		labels := map[string]string{}
+		for name, value := range c.Global.Labels {
+			labels[name] = value
+		}
+		for name, value := range tc.Labels {
+			labels[name] = value
+		}
+		tc.Labels = labels
+
+		if tc.Password != "" && tc.PasswordFile != "" {
+			return fmt.Errorf("target %q: at most one of password and password_file may be set", tc.Name)
+		}
+		if tc.PasswordFile != "" {
+			password, err := ioutil.ReadFile(tc.PasswordFile)
+			if err != nil {
+				return fmt.Errorf("target %q: unable to read password file: %+v", tc.Name, err)
+			}
+			tc.Password = strings.TrimRight(string(password), "\r\n")
+		}
+
+		if _, err := newSource(tc.sourceURL(), tc.Backend); err != nil {
+			return fmt.Errorf("target %q: %+v", tc.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// labelNames returns the sorted names of the labels set on any target.
+func (c *config) labelNames() []string {
+	labels := map[string]string{}
+	for _, tc := range c.Targets {
+		for name := range tc.Labels {
+			labels[name] = ""
+		}
+	}
+	return sortedLabelNames(labels)
+}
+
+// sourceURL returns the target address with its credentials, if any, as URL
+// user information.
+func (tc *targetConfig) sourceURL() string {
+
+	if tc.Username == "" && tc.Password == "" {
+		return tc.Address
+	}
+
+	address := tc.Address
+	if !strings.Contains(address, "://") {
+		address = tc.Backend + "://" + address
+	}
+
+	u, err := url.Parse(address)
+	if err != nil {
+		return tc.Address
+	}
+	u.User = url.UserPassword(tc.Username, tc.Password)
+
+	return u.String()
+}
+
+func checkLabels(labels map[string]string) error {
+	for name := range labels {
+		if !model.LabelName(name).IsValid() || strings.HasPrefix(name, model.ReservedLabelPrefix) {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+		if reservedLabels[name] {
+			return fmt.Errorf("label name %q is used by the exporter", name)
+		}
+	}
+	return nil
+}
+
+var (
+	configLastReloadSuccessful = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "apcups_exporter_config_last_reload_successful",
+		Help: "Whether the last configuration reload attempt was successful",
+	})
+
+	configLastReloadSuccessTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "apcups_exporter_config_last_reload_success_timestamp_seconds",
+		Help: "Timestamp of the last successful configuration reload",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(configLastReloadSuccessful)
+	prometheus.MustRegister(configLastReloadSuccessTimestamp)
+}
+
+// configReloader applies the configuration file to a targetManager on start
+// up, on SIGHUP and on POST /-/reload.
+type configReloader struct {
+	path    string
+	manager *targetManager
+
+	mtx sync.Mutex
+}
+
+// reload loads the configuration file and applies it. The running
+// configuration is kept if the file is invalid.
+func (r *configReloader) reload() error {
+
+	if r.path == "" {
+		return fmt.Errorf("No configuration file given with --config.file")
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	cfg, err := loadConfig(r.path)
+	if err == nil {
+		err = r.manager.apply(cfg)
+	}
+	if err != nil {
+		configLastReloadSuccessful.Set(0)
+		return err
+	}
+
+	configLastReloadSuccessful.Set(1)
+	configLastReloadSuccessTimestamp.Set(float64(time.Now().Unix()))
+	log.Printf("Loaded configuration file %s with %d targets", r.path, len(cfg.Targets))
+
+	return nil
+}
+
+// watchSignals reloads the configuration whenever SIGHUP is received.
+func (r *configReloader) watchSignals() {
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for range hup {
+		if err := r.reload(); err != nil {
+			log.Printf("Error reloading configuration: %+v", err)
+		}
+	}
+}
+
+// ServeHTTP reloads the configuration on POST /-/reload.
+func (r *configReloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+
+	if req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.reload(); err != nil {
+		log.Printf("Error reloading configuration: %+v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintln(w, "Reloaded")
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxStderrLogLength caps the stderr line logged for a failing command.
+const maxStderrLogLength = 200
+
+var (
+	execExitCode = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "apcups_exec_exit_code",
+		Help: "Exit code of the last run of an exec target command, -1 if it could not be run or was killed",
+	},
+		[]string{"target"},
+	)
+
+	execStderrBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "apcups_exec_stderr_bytes",
+		Help: "Size of the standard error output of the last run of an exec target command",
+	},
+		[]string{"target"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(execExitCode)
+	prometheus.MustRegister(execStderrBytes)
+
+	registerSource("exec", func(u *url.URL) (Source, error) {
+		if u.Path == "" {
+			return nil, fmt.Errorf("Missing command path in exec target %q", u)
+		}
+
+		query := u.Query()
+
+		// Credentials from the configuration file are handed to the command
+		// in its environment and kept out of the target name.
+		var env []string
+		if u.User != nil {
+			password, _ := u.User.Password()
+			env = append(env, "UPS_USERNAME="+u.User.Username(), "UPS_PASSWORD="+password)
+
+			redacted := *u
+			redacted.User = nil
+			u = &redacted
+		}
+
+		// The metrics are labelled with the target's name once it is
+		// known, see setTargetName.
+		s := &execSource{
+			name:    u.String(),
+			command: u.Path,
+			args:    query["arg"],
+			env:     env,
+		}
+
+		if timeout := query.Get("timeout"); timeout != "" {
+			var err error
+			if s.timeout, err = time.ParseDuration(timeout); err != nil {
+				return nil, fmt.Errorf("Invalid timeout %q in exec target %q", timeout, u)
+			}
+		}
+
+		for _, env := range query["env"] {
+			if !strings.Contains(env, "=") {
+				return nil, fmt.Errorf("Invalid env %q in exec target %q, expected NAME=value", env, u)
+			}
+			s.env = append(s.env, env)
+		}
+
+		return s, nil
+	})
+}
+
+// execSource runs a command printing apcaccess style "KEY : value" lines, for
+// example apcaccess itself run over ssh:
+//
+//	exec:///usr/bin/ssh?arg=ups-host&arg=apcaccess&arg=status&timeout=15s&env=LANG=C
+type execSource struct {
+	name    string
+	command string
+	args    []string
+	env     []string
+	timeout time.Duration
+
+	mtx        sync.Mutex
+	lastStderr string
+}
+
+// setTargetName labels the command's metrics with the name of the target,
+// as apcups_up is.
+func (s *execSource) setTargetName(name string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.name = name
+}
+
+func (s *execSource) Fetch(ctx context.Context) (*Snapshot, error) {
+
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.Command(s.command, s.args...)
+	cmd.Env = append(os.Environ(), s.env...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	setProcessGroup(cmd)
+
+	err := cmd.Start()
+	if err == nil {
+		// Wait also waits for stdout and stderr to be closed, which
+		// children the command left running may hold open past its exit.
+		// Killing the whole process group on cancellation closes them.
+		done := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				killProcessGroup(cmd)
+			case <-done:
+			}
+		}()
+		err = cmd.Wait()
+		close(done)
+
+		if err == nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+	}
+
+	s.record(exitCode(cmd, err), stderr.String())
+
+	if err != nil {
+		if msg := firstLine(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("Error running %s: %+v: %s", s.command, err, msg)
+		}
+		return nil, fmt.Errorf("Error running %s: %+v", s.command, err)
+	}
+
+	data := map[string]string{}
+
+	scanner := bufio.NewScanner(&stdout)
+	for scanner.Scan() {
+		if key, value, ok := parseRecord(scanner.Text()); ok {
+			data[key] = value
+		}
+	}
+
+	if len(data) == 0 {
+		return nil, fmt.Errorf("No status fields in output of %s", s.command)
+	}
+
+	return newSnapshot(data)
+}
+
+// record updates the scrape health metrics for the last command run.
+func (s *execSource) record(code int, stderr string) {
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	// Stderr is free text, so it is logged rather than exported as a label
+	// value, and only when it changes to keep a failing command from
+	// flooding the log.
+	line := truncateUTF8(firstLine(stderr), maxStderrLogLength)
+	if line != s.lastStderr {
+		if line != "" {
+			log.Printf("Command of %s wrote to stderr: %s", s.name, line)
+		}
+		s.lastStderr = line
+	}
+
+	execExitCode.WithLabelValues(s.name).Set(float64(code))
+	execStderrBytes.WithLabelValues(s.name).Set(float64(len(stderr)))
+}
+
+// Close removes the target's series once it is no longer polled.
+func (s *execSource) Close() error {
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	execExitCode.DeleteLabelValues(s.name)
+	execStderrBytes.DeleteLabelValues(s.name)
+
+	return nil
+}
+
+// exitCode returns the exit status of a finished command, or -1 if it could
+// not be started or was terminated by a signal.
+func exitCode(cmd *exec.Cmd, err error) int {
+
+	if cmd.ProcessState == nil {
+		return -1
+	}
+
+	if ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok {
+		if ws.Signaled() {
+			return -1
+		}
+		return ws.ExitStatus()
+	}
+
+	if err != nil {
+		return -1
+	}
+	return 0
+}
+
+// truncateUTF8 cuts s to at most max bytes at a rune boundary. Invalid
+// UTF-8 is replaced, so the result is always valid UTF-8.
+func truncateUTF8(s string, max int) string {
+	var buf bytes.Buffer
+	for _, r := range s {
+		if buf.Len()+utf8.RuneLen(r) > max {
+			break
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
+
+func firstLine(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
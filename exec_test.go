@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestTruncateUTF8(t *testing.T) {
+
+	tests := []struct {
+		in   string
+		max  int
+		want string
+	}{
+		{"short", 10, "short"},
+		{"exactly10!", 10, "exactly10!"},
+		{"truncated here", 9, "truncated"},
+		{"ééé", 5, "éé"}, // é is 2 bytes, the third would not fit
+		{"ab€", 4, "ab"}, // € is 3 bytes
+		{"a\xffb", 10, "a�b"},
+		{"", 5, ""},
+	}
+
+	for _, test := range tests {
+		got := truncateUTF8(test.in, test.max)
+		if got != test.want {
+			t.Errorf("truncateUTF8(%q, %d) = %q, want %q", test.in, test.max, got, test.want)
+		}
+		if !utf8.ValidString(got) || len(got) > test.max {
+			t.Errorf("truncateUTF8(%q, %d) = %q is not valid UTF-8 of at most %d bytes", test.in, test.max, got, test.max)
+		}
+	}
+}
+
+func TestExecSourceMetricsUseTargetName(t *testing.T) {
+
+	tc := targetConfig{
+		Name:    "rack1",
+		Address: "exec:///bin/sh?" + url.Values{"arg": {"-c", "echo 'STATUS : ONLINE'; printf 'x" + strings.Repeat("é", 150) + "' >&2"}}.Encode(),
+		Backend: "nis",
+	}
+	target, err := newConfiguredTarget(tc)
+	if err != nil {
+		t.Fatalf("Error creating target: %+v", err)
+	}
+	defer target.source.(*execSource).Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	snapshot, err := target.fetch(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if snapshot.Info.status != "online" {
+		t.Errorf("status = %q, want online", snapshot.Info.status)
+	}
+
+	families, err := gatherMetricFamilies()
+	if err != nil {
+		t.Fatalf("Error gathering metrics: %+v", err)
+	}
+
+	found := map[string]bool{}
+	for _, mf := range families {
+		if !strings.HasPrefix(mf.GetName(), "apcups_exec_") {
+			continue
+		}
+		for _, m := range mf.Metric {
+			for _, l := range m.Label {
+				if l.GetName() == "target" && l.GetValue() == "rack1" {
+					found[mf.GetName()] = true
+				}
+				if l.GetName() == "stderr" {
+					t.Errorf("Stderr %q exported as a label", l.GetValue())
+				}
+			}
+		}
+	}
+
+	for _, name := range []string{"apcups_exec_exit_code", "apcups_exec_stderr_bytes"} {
+		if !found[name] {
+			t.Errorf("No %s series labelled target=rack1", name)
+		}
+	}
+}
+
+func TestExecSourceKillsProcessGroup(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		script string
+	}{
+		{name: "slow command", script: "sleep 30"},
+		{name: "child holding stdout", script: "echo 'STATUS : ONLINE'; sleep 30 &"},
+		{name: "child holding stderr", script: "echo 'STATUS : ONLINE'; sleep 30 >/dev/null &"},
+	}
+
+	for _, test := range tests {
+		u := "exec:///bin/sh?" + url.Values{"arg": {"-c", test.script}, "timeout": {"200ms"}}.Encode()
+		source, err := newSource(u, "nis")
+		if err != nil {
+			t.Fatalf("%s: error creating source: %+v", test.name, err)
+		}
+
+		start := time.Now()
+		_, err = source.Fetch(context.Background())
+		source.(*execSource).Close()
+
+		if err == nil {
+			t.Errorf("%s: no error past the timeout", test.name)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("%s: Fetch() returned after %s, want soon after the 200ms timeout", test.name, elapsed)
+		}
+	}
+}
+
+func TestExecSourceMalformedTime(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		output string
+	}{
+		{name: "no unit", output: "STATUS : ONLINE\nTONBATT : 30\n"},
+		{name: "trailing space", output: "STATUS : ONLINE\nTIMELEFT : 30 \n"},
+		{name: "no number", output: "STATUS : ONLINE\nCUMONBATT : seconds\n"},
+	}
+
+	for _, test := range tests {
+		u := "exec:///bin/sh?" + url.Values{"arg": {"-c", "printf '" + test.output + "'"}}.Encode()
+		source, err := newSource(u, "nis")
+		if err != nil {
+			t.Fatalf("%s: error creating source: %+v", test.name, err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err = source.Fetch(ctx)
+		cancel()
+		source.(*execSource).Close()
+
+		if err == nil {
+			t.Errorf("%s: no error for output %q", test.name, test.output)
+		}
+	}
+}
@@ -0,0 +1,13 @@
+package main
+
+import "os/exec"
+
+// setProcessGroup does nothing on Windows, which has no process groups to
+// kill a command's children with.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills a started command. Children it started keep
+// running.
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
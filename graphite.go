@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	lineWriterTimeout = 10 * time.Second
+
+	// Lines sent over UDP are packed into datagrams of at most this size,
+	// which fits the usual path MTU.
+	maxDatagramSize = 1432
+)
+
+var (
+	templatePlaceholder = regexp.MustCompile(`\{([^{}]*)\}`)
+	unsafePathChars     = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+)
+
+// pathTemplate names the metrics of a target for Graphite and StatsD, e.g.
+// ups.{site}.{upsname}.{metric}. {hostname}, {upsname}, {model}, {serial},
+// {target} and {metric} are filled in from the snapshot, any other
+// placeholder from the target's configured labels.
+type pathTemplate string
+
+func newPathTemplate(template string) (pathTemplate, error) {
+
+	if strings.Count(template, "{") != strings.Count(template, "}") ||
+		len(templatePlaceholder.FindAllString(template, -1)) != strings.Count(template, "{") {
+		return "", fmt.Errorf("Invalid path template %q: unbalanced braces", template)
+	}
+	for _, m := range templatePlaceholder.FindAllStringSubmatch(template, -1) {
+		if m[1] == "" {
+			return "", fmt.Errorf("Invalid path template %q: empty placeholder", template)
+		}
+	}
+
+	if !strings.Contains(template, "{metric}") {
+		template += ".{metric}"
+	}
+
+	return pathTemplate(template), nil
+}
+
+// path renders the template for one metric. Each value is made safe to use
+// as a single path node; values that are unknown become "unknown".
+func (p pathTemplate) path(t *target, info *upsInfo, metric string) string {
+
+	return templatePlaceholder.ReplaceAllStringFunc(string(p), func(placeholder string) string {
+
+		var value string
+		switch name := placeholder[1 : len(placeholder)-1]; name {
+		case "metric":
+			return metric
+		case "hostname":
+			value = info.hostname
+		case "upsname":
+			value = info.upsName
+		case "model":
+			value = info.model
+		case "serial":
+			value = info.serialNumber
+		case "target":
+			value = t.name
+		default:
+			value = t.labels[name]
+		}
+
+		value = strings.Trim(unsafePathChars.ReplaceAllString(value, "_"), "_")
+		if value == "" {
+			return "unknown"
+		}
+		return value
+	})
+}
+
+// lineWriter sends lines of text over TCP or UDP, connecting again on the
+// next write after the connection fails.
+type lineWriter struct {
+	network string
+	address string
+
+	mtx  sync.Mutex
+	conn net.Conn
+}
+
+// newLineWriter parses an address such as tcp://carbon:2003 or
+// udp://statsd:8125; a plain host:port uses defaultNetwork.
+func newLineWriter(address, defaultNetwork string) (*lineWriter, error) {
+
+	network := defaultNetwork
+	if i := strings.Index(address, "://"); i >= 0 {
+		network, address = address[:i], address[i+3:]
+	}
+	if network != "tcp" && network != "udp" {
+		return nil, fmt.Errorf("Unsupported network %q in %s, expected tcp or udp", network, address)
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return nil, fmt.Errorf("Invalid address %q: %+v", address, err)
+	}
+
+	return &lineWriter{network: network, address: address}, nil
+}
+
+func (w *lineWriter) String() string {
+	return w.network + "://" + w.address
+}
+
+// write sends lines, each ending in a newline. Over TCP a failed write is
+// retried once on a new connection, as the server may have closed an idle
+// one.
+func (w *lineWriter) write(lines []string) error {
+
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if w.conn == nil {
+			w.conn, err = net.DialTimeout(w.network, w.address, lineWriterTimeout)
+			if err != nil {
+				w.conn = nil
+				return err
+			}
+		}
+
+		if err = w.send(lines); err == nil {
+			return nil
+		}
+
+		w.conn.Close()
+		w.conn = nil
+		if w.network == "udp" {
+			break
+		}
+	}
+
+	return err
+}
+
+func (w *lineWriter) send(lines []string) error {
+
+	w.conn.SetWriteDeadline(time.Now().Add(lineWriterTimeout))
+
+	if w.network == "tcp" {
+		_, err := w.conn.Write([]byte(strings.Join(lines, "")))
+		return err
+	}
+
+	var datagram bytes.Buffer
+	for _, line := range lines {
+		if datagram.Len() > 0 && datagram.Len()+len(line) > maxDatagramSize {
+			if _, err := w.conn.Write(datagram.Bytes()); err != nil {
+				return err
+			}
+			datagram.Reset()
+		}
+		datagram.WriteString(line)
+	}
+	if datagram.Len() > 0 {
+		_, err := w.conn.Write(datagram.Bytes())
+		return err
+	}
+
+	return nil
+}
+
+func (w *lineWriter) Close() error {
+
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if w.conn == nil {
+		return nil
+	}
+	err := w.conn.Close()
+	w.conn = nil
+
+	return err
+}
+
+// graphiteSink sends the values of every poll to Carbon in the plaintext
+// protocol, one path per field of the snapshot and an up path that is 0
+// while polls fail.
+type graphiteSink struct {
+	writer   *lineWriter
+	template pathTemplate
+}
+
+func (s *graphiteSink) polled(ctx context.Context, t *target) {
+
+	snapshot, lastPoll, lastErr := t.state()
+	if snapshot == nil {
+		return
+	}
+
+	timestamp := strconv.FormatInt(lastPoll.Unix(), 10)
+	line := func(metric string, value float64) string {
+		return s.template.path(t, snapshot.Info, metric) + " " + strconv.FormatFloat(value, 'f', -1, 64) + " " + timestamp + "\n"
+	}
+
+	var lines []string
+	if lastErr != nil {
+		lines = append(lines, line("up", 0))
+	} else {
+		lines = append(lines, line("up", 1))
+		for _, f := range numericFields(snapshot.Info) {
+			lines = append(lines, line(f.name, f.value))
+		}
+	}
+
+	if err := s.writer.write(lines); err != nil {
+		log.Printf("Error sending %s to Graphite at %s: %+v", t.name, s.writer, err)
+	}
+}
+
+func (s *graphiteSink) Close() error {
+	return s.writer.Close()
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewPathTemplate(t *testing.T) {
+
+	tests := []struct {
+		in   string
+		want pathTemplate
+		err  bool
+	}{
+		{in: "ups.{site}.{upsname}.{metric}", want: "ups.{site}.{upsname}.{metric}"},
+		{in: "ups.{upsname}", want: "ups.{upsname}.{metric}"},
+		{in: "ups.{upsname", err: true},
+		{in: "ups.}upsname{", err: true},
+		{in: "ups.{{upsname}}", err: true},
+		{in: "ups.{}", err: true},
+	}
+
+	for _, test := range tests {
+		got, err := newPathTemplate(test.in)
+		if (err != nil) != test.err || got != test.want {
+			t.Errorf("newPathTemplate(%q) = %q, %v, want %q and error %v", test.in, got, err, test.want, test.err)
+		}
+	}
+}
+
+func TestPathTemplatePath(t *testing.T) {
+
+	ups := newTestTarget("ups-host:3551", map[string]string{"site": "Sydney DC1"}, nil)
+	info := &upsInfo{hostname: "beaker.example.com", upsName: "rack 1", model: "Smart-UPS 1500", serialNumber: "AS123"}
+
+	tests := []struct {
+		template pathTemplate
+		want     string
+	}{
+		{"ups.{site}.{upsname}.{metric}", "ups.Sydney_DC1.rack_1.load_percent"},
+		{"{hostname}.{target}.{metric}", "beaker_example_com.ups-host_3551.load_percent"},
+		{"{model}.{serial}.{metric}", "Smart-UPS_1500.AS123.load_percent"},
+		{"ups.{rack}.{metric}", "ups.unknown.load_percent"},
+	}
+
+	for _, test := range tests {
+		if got := test.template.path(ups, info, "load_percent"); got != test.want {
+			t.Errorf("%q.path() = %q, want %q", test.template, got, test.want)
+		}
+	}
+}
+
+func TestNewLineWriter(t *testing.T) {
+
+	tests := []struct {
+		address string
+		want    string
+		err     bool
+	}{
+		{address: "carbon:2003", want: "tcp://carbon:2003"},
+		{address: "udp://statsd:8125", want: "udp://statsd:8125"},
+		{address: "tcp://[::1]:2003", want: "tcp://[::1]:2003"},
+		{address: "http://carbon:2003", err: true},
+		{address: "carbon", err: true},
+	}
+
+	for _, test := range tests {
+		w, err := newLineWriter(test.address, "tcp")
+		if (err != nil) != test.err {
+			t.Errorf("newLineWriter(%q) = %v, want error %v", test.address, err, test.err)
+			continue
+		}
+		if err == nil && w.String() != test.want {
+			t.Errorf("newLineWriter(%q) = %s, want %s", test.address, w, test.want)
+		}
+	}
+}
+
+// tcpLines accepts connections on l and sends every line received on them.
+func tcpLines(l net.Listener) <-chan string {
+
+	lines := make(chan string, 100)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					lines <- scanner.Text()
+				}
+			}()
+		}
+	}()
+
+	return lines
+}
+
+// receive returns the next n lines, failing the test after 5 seconds.
+func receive(t *testing.T, lines <-chan string, n int) []string {
+
+	var got []string
+	timeout := time.After(5 * time.Second)
+	for len(got) < n {
+		select {
+		case line := <-lines:
+			got = append(got, line)
+		case <-timeout:
+			t.Fatalf("Received %q, want %d lines", got, n)
+		}
+	}
+
+	return got
+}
+
+func TestLineWriterReconnectsOverTCP(t *testing.T) {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %+v", err)
+	}
+	defer l.Close()
+	lines := tcpLines(l)
+
+	w, err := newLineWriter(l.Addr().String(), "tcp")
+	if err != nil {
+		t.Fatalf("Error creating writer: %+v", err)
+	}
+	defer w.Close()
+
+	if err := w.write([]string{"a 1 1\n", "b 2 1\n"}); err != nil {
+		t.Fatalf("Error writing: %+v", err)
+	}
+	if got := receive(t, lines, 2); got[0] != "a 1 1" || got[1] != "b 2 1" {
+		t.Errorf("Received %q", got)
+	}
+
+	// A connection the server has closed is replaced on the next write.
+	w.conn.Close()
+	if err := w.write([]string{"c 3 1\n"}); err != nil {
+		t.Fatalf("Error writing after the connection closed: %+v", err)
+	}
+	if got := receive(t, lines, 1); got[0] != "c 3 1" {
+		t.Errorf("Received %q after reconnecting", got)
+	}
+}
+
+func TestLineWriterPacksDatagrams(t *testing.T) {
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %+v", err)
+	}
+	defer conn.Close()
+
+	w, err := newLineWriter("udp://"+conn.LocalAddr().String(), "tcp")
+	if err != nil {
+		t.Fatalf("Error creating writer: %+v", err)
+	}
+	defer w.Close()
+
+	line := strings.Repeat("x", 99) + "\n"
+	var lines []string
+	for i := 0; i < 20; i++ {
+		lines = append(lines, line)
+	}
+	if err := w.write(lines); err != nil {
+		t.Fatalf("Error writing: %+v", err)
+	}
+
+	// 14 lines of 100 bytes fit into a datagram, the other 6 into a second.
+	buf := make([]byte, 65536)
+	for _, want := range []int{14, 6} {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("Error reading datagram: %+v", err)
+		}
+		if n > maxDatagramSize || n != want*len(line) {
+			t.Errorf("Datagram of %d bytes, want %d lines of %d", n, want, len(line))
+		}
+	}
+}
+
+func TestGraphiteSinkPolled(t *testing.T) {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %+v", err)
+	}
+	defer l.Close()
+	lines := tcpLines(l)
+
+	w, err := newLineWriter(l.Addr().String(), "tcp")
+	if err != nil {
+		t.Fatalf("Error creating writer: %+v", err)
+	}
+	s := &graphiteSink{writer: w, template: "ups.{site}.{upsname}.{metric}"}
+	defer s.Close()
+
+	ups := newTestTarget("ups", map[string]string{"site": "syd"}, &upsInfo{status: "online", upsName: "rack1", loadPercent: 12.5})
+	ups.lastPoll = time.Unix(1700000000, 0)
+	fields := len(numericFields(ups.last.Info))
+
+	tests := []struct {
+		name    string
+		lastErr error
+		want    []string
+	}{
+		{
+			name: "poll succeeded",
+			want: []string{"ups.syd.rack1.up 1 1700000000", "ups.syd.rack1.load_percent 12.5 1700000000"},
+		},
+		{
+			name:    "poll failed",
+			lastErr: errors.New("connection refused"),
+			want:    []string{"ups.syd.rack1.up 0 1700000000"},
+		},
+	}
+
+	for _, test := range tests {
+		ups.lastErr = test.lastErr
+		s.polled(context.Background(), ups)
+
+		n := 1
+		if test.lastErr == nil {
+			n += fields
+		}
+		got := strings.Join(receive(t, lines, n), "\n")
+		for _, want := range test.want {
+			if !strings.Contains(got, want) {
+				t.Errorf("%s: sent %q, want a line %q", test.name, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// pollerStallFactor is how many poll intervals may pass without a poll
+// attempt on a target before the exporter reports itself unhealthy.
+const pollerStallFactor = 3
+
+// healthHandler serves liveness and readiness probes.
+type healthHandler struct {
+	targets func() []*target
+	quorum  int
+}
+
+func newHealthHandler(targets func() []*target, quorum int) *healthHandler {
+	return &healthHandler{
+		targets: targets,
+		quorum:  quorum,
+	}
+}
+
+// healthy succeeds while the HTTP server is serving and every target is
+// still being polled. A poll loop that has stopped or hangs shows up as a
+// target without a poll attempt for several intervals.
+func (h *healthHandler) healthy(w http.ResponseWriter, r *http.Request) {
+
+	now := time.Now()
+
+	var reasons []string
+	for _, t := range h.targets() {
+		_, lastPoll, _ := t.state()
+		stall := pollerStallFactor * t.interval
+
+		// A target that was never polled is measured from when its
+		// poller started, so targets added by a reload get their grace
+		// period too.
+		since := lastPoll
+		if since.IsZero() {
+			since = t.pollingStarted()
+			if since.IsZero() {
+				continue
+			}
+		}
+
+		if now.Sub(since) > stall {
+			if lastPoll.IsZero() {
+				reasons = append(reasons, fmt.Sprintf("%s: never polled", t.name))
+			} else {
+				reasons = append(reasons, fmt.Sprintf("%s: not polled since %s", t.name, lastPoll.Format(time.RFC3339)))
+			}
+		}
+	}
+
+	writeProbe(w, reasons, "Healthy")
+}
+
+// ready succeeds once enough targets have been polled successfully at least
+// once: all of them, or the configured quorum.
+func (h *healthHandler) ready(w http.ResponseWriter, r *http.Request) {
+
+	targets := h.targets()
+
+	quorum := h.quorum
+	if quorum <= 0 || quorum > len(targets) {
+		quorum = len(targets)
+	}
+
+	ready := 0
+	var pending []string
+	for _, t := range targets {
+		snapshot, _, err := t.state()
+		if snapshot != nil {
+			ready++
+			continue
+		}
+		if err != nil {
+			pending = append(pending, fmt.Sprintf("%s: no successful poll yet: %v", t.name, err))
+		} else {
+			pending = append(pending, fmt.Sprintf("%s: no successful poll yet", t.name))
+		}
+	}
+
+	var reasons []string
+	if ready < quorum {
+		reasons = append([]string{fmt.Sprintf("%d of %d targets polled successfully, %d required", ready, len(targets), quorum)}, pending...)
+	}
+
+	writeProbe(w, reasons, "Ready")
+}
+
+func writeProbe(w http.ResponseWriter, reasons []string, ok string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	if len(reasons) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, strings.Join(reasons, "\n"))
+		return
+	}
+
+	fmt.Fprintln(w, ok)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealthy(t *testing.T) {
+
+	now := time.Now()
+
+	tests := []struct {
+		name     string
+		started  time.Time
+		lastPoll time.Time
+		healthy  bool
+		reason   string
+	}{
+		{name: "polled recently", started: now.Add(-time.Hour), lastPoll: now.Add(-time.Second), healthy: true},
+		{name: "stalled", started: now.Add(-time.Hour), lastPoll: now.Add(-time.Minute), reason: "not polled since"},
+		{name: "added by a reload", started: now.Add(-time.Second), healthy: true},
+		{name: "never polled", started: now.Add(-time.Minute), reason: "never polled"},
+		{name: "not started yet", healthy: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			ups := &target{name: "ups", interval: 10 * time.Second, lastPoll: test.lastPoll}
+			if !test.started.IsZero() {
+				ups.startPolling(test.started)
+			}
+
+			h := newHealthHandler(func() []*target { return []*target{ups} }, 0)
+			rec := httptest.NewRecorder()
+			h.healthy(rec, httptest.NewRequest("GET", "/-/healthy", nil))
+
+			if healthy := rec.Code == http.StatusOK; healthy != test.healthy {
+				t.Errorf("Status %d, want healthy %v: %s", rec.Code, test.healthy, rec.Body)
+			}
+			if !strings.Contains(rec.Body.String(), test.reason) {
+				t.Errorf("Body %q does not contain %q", rec.Body, test.reason)
+			}
+		})
+	}
+}
+
+func TestReady(t *testing.T) {
+
+	polled := newTestTarget("a", nil, &upsInfo{status: "online"})
+	failed := &target{name: "b", lastPoll: time.Now(), lastErr: errors.New("connection refused")}
+	pending := &target{name: "c"}
+
+	tests := []struct {
+		quorum int
+		ready  bool
+		reason string
+	}{
+		{quorum: 0, reason: "1 of 3 targets polled successfully, 3 required"},
+		{quorum: 1, ready: true},
+		{quorum: 2, reason: "b: no successful poll yet: connection refused"},
+		{quorum: 5, reason: "c: no successful poll yet"},
+	}
+
+	for _, test := range tests {
+		h := newHealthHandler(func() []*target { return []*target{polled, failed, pending} }, test.quorum)
+		rec := httptest.NewRecorder()
+		h.ready(rec, httptest.NewRequest("GET", "/-/ready", nil))
+
+		if ready := rec.Code == http.StatusOK; ready != test.ready {
+			t.Errorf("Quorum %d: status %d, want ready %v: %s", test.quorum, rec.Code, test.ready, rec.Body)
+		}
+		if !strings.Contains(rec.Body.String(), test.reason) {
+			t.Errorf("Quorum %d: body %q does not contain %q", test.quorum, rec.Body, test.reason)
+		}
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	influxMeasurement = "apcupsd"
+	influxTimeout     = 30 * time.Second
+
+	// influxMaxPendingBatches bounds the points kept while the server cannot be
+	// reached, in batches.
+	influxMaxPendingBatches = 100
+)
+
+var influxPointsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "apcups_influx_points_dropped_total",
+	Help: "Points dropped without being written, because InfluxDB rejected them or the write buffer was full",
+},
+	[]string{"reason"},
+)
+
+// influxSink writes every poll as an InfluxDB line protocol point, either in
+// batches to the write API of InfluxDB 1.x or 2.x, or a line at a time to a
+// writer such as stdout for Telegraf's execd input.
+type influxSink struct {
+	out io.Writer
+
+	writeURL      string
+	token         string
+	batchSize     int
+	flushInterval time.Duration
+	client        *http.Client
+
+	mtx     sync.Mutex
+	pending [][]byte
+	dropped int
+
+	wake   chan struct{}
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// influxWriteURL returns the write endpoint of the InfluxDB at base: the 2.x
+// API when a bucket is given, the 1.x API with database otherwise.
+func influxWriteURL(base, org, bucket, database string) (string, error) {
+
+	if !strings.Contains(base, "://") {
+		base = "http://" + base
+	}
+	base = strings.TrimSuffix(base, "/")
+
+	params := url.Values{"precision": {"ns"}}
+	switch {
+	case bucket != "":
+		params.Set("bucket", bucket)
+		if org != "" {
+			params.Set("org", org)
+		}
+		return base + "/api/v2/write?" + params.Encode(), nil
+	case database != "":
+		params.Set("db", database)
+		return base + "/write?" + params.Encode(), nil
+	}
+
+	return "", fmt.Errorf("Either an InfluxDB 2.x bucket or a 1.x database is required")
+}
+
+func newInfluxSink(writeURL, tokenFile string, batchSize int, flushInterval time.Duration) (*influxSink, error) {
+
+	s := &influxSink{
+		writeURL:      writeURL,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		client:        &http.Client{Timeout: influxTimeout},
+		wake:          make(chan struct{}, 1),
+		done:          make(chan struct{}),
+	}
+
+	if tokenFile != "" {
+		token, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read InfluxDB token file: %+v", err)
+		}
+		s.token = strings.TrimSpace(string(token))
+	}
+
+	if s.batchSize < 1 {
+		s.batchSize = 1
+	}
+
+	prometheus.MustRegister(influxPointsDropped)
+
+	var ctx context.Context
+	ctx, s.cancel = context.WithCancel(context.Background())
+	go s.run(ctx)
+
+	return s, nil
+}
+
+// newInfluxWriterSink returns a sink writing each point to w as soon as it
+// is polled.
+func newInfluxWriterSink(w io.Writer) *influxSink {
+
+	s := &influxSink{out: w, done: make(chan struct{})}
+	s.cancel = func() {}
+	close(s.done)
+
+	return s
+}
+
+func (s *influxSink) polled(ctx context.Context, t *target) {
+
+	snapshot, lastPoll, lastErr := t.state()
+	if snapshot == nil || lastErr != nil {
+		return
+	}
+
+	line := influxLine(snapshot.Info, t.labels, lastPoll)
+
+	if s.out != nil {
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		if _, err := s.out.Write(line); err != nil {
+			log.Printf("Error writing line protocol for %s: %+v", t.name, err)
+		}
+		return
+	}
+
+	s.mtx.Lock()
+	s.pending = append(s.pending, line)
+	if max := influxMaxPendingBatches * s.batchSize; len(s.pending) > max {
+		log.Printf("InfluxDB write buffer is full, dropping %d points", len(s.pending)-max)
+		s.dropped += len(s.pending) - max
+		influxPointsDropped.WithLabelValues("buffer_full").Add(float64(len(s.pending) - max))
+		s.pending = s.pending[len(s.pending)-max:]
+	}
+	full := len(s.pending) >= s.batchSize
+	s.mtx.Unlock()
+
+	if full {
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run writes the pending points every flushInterval, or as soon as a batch
+// is full.
+func (s *influxSink) run(ctx context.Context) {
+
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.wake:
+		}
+
+		if err := s.flush(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Error writing to InfluxDB, retrying in %s: %+v", s.flushInterval, err)
+		}
+	}
+}
+
+// flush writes the pending points in batches. Points are kept on failure to
+// be retried on the next flush, unless InfluxDB rejected them.
+func (s *influxSink) flush(ctx context.Context) error {
+
+	for {
+		s.mtx.Lock()
+		n := len(s.pending)
+		if n > s.batchSize {
+			n = s.batchSize
+		}
+		batch := s.pending[:n]
+		dropped := s.dropped
+		s.mtx.Unlock()
+
+		if n == 0 {
+			return nil
+		}
+
+		err := s.write(ctx, bytes.Join(batch, nil))
+		if rejected, ok := err.(influxRejected); ok {
+			log.Printf("InfluxDB rejected %d points, dropping them: %+v", n, rejected)
+			influxPointsDropped.WithLabelValues("rejected").Add(float64(n))
+		} else if err != nil {
+			return err
+		}
+
+		s.mtx.Lock()
+		// Points may have been dropped from the front while writing.
+		if written := n - (s.dropped - dropped); written > 0 {
+			s.pending = s.pending[written:]
+		}
+		s.mtx.Unlock()
+	}
+}
+
+func (s *influxSink) write(ctx context.Context, body []byte) error {
+
+	req, err := http.NewRequest("POST", s.writeURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.token != "" {
+		// InfluxDB 1.8 accepts "username:password" as a token too.
+		req.Header.Set("Authorization", "Token "+s.token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+
+	message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests {
+		return influxRejected{status: resp.StatusCode, message: strings.TrimSpace(string(message))}
+	}
+
+	return fmt.Errorf("Unexpected status code %d: %s", resp.StatusCode, strings.TrimSpace(string(message)))
+}
+
+// influxRejected is returned for points InfluxDB will never accept, such as
+// ones conflicting with the type of an existing field, which are dropped
+// rather than retried.
+type influxRejected struct {
+	status  int
+	message string
+}
+
+func (e influxRejected) Error() string {
+	return fmt.Sprintf("Unexpected status code %d: %s", e.status, e.message)
+}
+
+// Close stops the flushing and makes a last attempt at writing the pending
+// points.
+func (s *influxSink) Close() error {
+
+	s.cancel()
+	<-s.done
+
+	if s.out != nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), influxTimeout)
+	defer cancel()
+
+	return s.flush(ctx)
+}
+
+// influxLine formats a snapshot as a line protocol point.
+func influxLine(info *upsInfo, labels map[string]string, ts time.Time) []byte {
+
+	tags := map[string]string{
+		"hostname": info.hostname,
+		"upsname":  info.upsName,
+		"model":    info.model,
+		"serial":   info.serialNumber,
+	}
+	for name, value := range labels {
+		tags[name] = value
+	}
+
+	fields := numericFields(info)
+
+	var b bytes.Buffer
+	b.WriteString(influxMeasurement)
+
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		// Empty tag values are not allowed.
+		if tags[name] == "" {
+			continue
+		}
+		b.WriteByte(',')
+		b.WriteString(influxTagEscaper.Replace(name))
+		b.WriteByte('=')
+		b.WriteString(influxTagEscaper.Replace(tags[name]))
+	}
+
+	for i, f := range fields {
+		if i == 0 {
+			b.WriteByte(' ')
+		} else {
+			b.WriteByte(',')
+		}
+		b.WriteString(f.name)
+		b.WriteByte('=')
+		b.WriteString(strconv.FormatFloat(f.value, 'f', -1, 64))
+	}
+
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatInt(ts.UnixNano(), 10))
+	b.WriteByte('\n')
+
+	return b.Bytes()
+}
+
+var influxTagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
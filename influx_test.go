@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestInfluxWriteURL(t *testing.T) {
+
+	tests := []struct {
+		base, org, bucket, database string
+		want                        string
+		err                         bool
+	}{
+		{base: "http://influxdb:8086/", org: "facilities", bucket: "ups", want: "http://influxdb:8086/api/v2/write?bucket=ups&org=facilities&precision=ns"},
+		{base: "influxdb:8086", bucket: "ups", want: "http://influxdb:8086/api/v2/write?bucket=ups&precision=ns"},
+		{base: "https://influxdb", database: "ups db", want: "https://influxdb/write?db=ups+db&precision=ns"},
+		{base: "influxdb:8086", err: true},
+	}
+
+	for _, test := range tests {
+		got, err := influxWriteURL(test.base, test.org, test.bucket, test.database)
+		if (err != nil) != test.err || got != test.want {
+			t.Errorf("influxWriteURL(%q, %q, %q, %q) = %q, %v, want %q", test.base, test.org, test.bucket, test.database, got, err, test.want)
+		}
+	}
+}
+
+func TestInfluxLine(t *testing.T) {
+
+	info := &upsInfo{
+		status:               "online",
+		hostname:             "beaker",
+		upsName:              "rack 1,a=b",
+		batteryChargePercent: 87.5,
+		timeLeft:             90 * time.Second,
+	}
+	line := string(influxLine(info, map[string]string{"site": "syd"}, time.Unix(1700000000, 5)))
+
+	prefix := `apcupsd,hostname=beaker,site=syd,upsname=rack\ 1\,a\=b status_numeric=0,battery_charge_percent=87.5,load_percent=0,time_left_seconds=90,`
+	if !strings.HasPrefix(line, prefix) {
+		t.Errorf("Line %q does not start with %q", line, prefix)
+	}
+	if !strings.HasSuffix(line, " 1700000000000000005\n") {
+		t.Errorf("Line %q does not end with the timestamp in nanoseconds", line)
+	}
+}
+
+func TestInfluxSinkFlush(t *testing.T) {
+
+	tests := []struct {
+		status   int
+		err      bool
+		pending  int
+		rejected float64
+	}{
+		{status: http.StatusNoContent},
+		{status: http.StatusBadRequest, rejected: 3},
+		{status: http.StatusUnprocessableEntity, rejected: 3},
+		{status: http.StatusTooManyRequests, err: true, pending: 3},
+		{status: http.StatusServiceUnavailable, err: true, pending: 3},
+	}
+
+	for _, test := range tests {
+		t.Run(http.StatusText(test.status), func(t *testing.T) {
+
+			var bodies []string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				bodies = append(bodies, string(body))
+				if r.Header.Get("Authorization") != "Token secret" {
+					t.Errorf("Authorization = %q", r.Header.Get("Authorization"))
+				}
+				w.WriteHeader(test.status)
+			}))
+			defer srv.Close()
+
+			s := &influxSink{writeURL: srv.URL, token: "secret", batchSize: 2, client: &http.Client{Timeout: 5 * time.Second}}
+			s.pending = [][]byte{[]byte("a v=1 1\n"), []byte("a v=2 2\n"), []byte("a v=3 3\n")}
+
+			before := counterValue(t, influxPointsDropped.WithLabelValues("rejected"))
+			err := s.flush(context.Background())
+
+			if (err != nil) != test.err {
+				t.Errorf("flush() = %v, want error %v", err, test.err)
+			}
+			if len(s.pending) != test.pending {
+				t.Errorf("%d points pending, want %d", len(s.pending), test.pending)
+			}
+			if rejected := counterValue(t, influxPointsDropped.WithLabelValues("rejected")) - before; rejected != test.rejected {
+				t.Errorf("Counted %v rejected points, want %v", rejected, test.rejected)
+			}
+			if bodies[0] != "a v=1 1\na v=2 2\n" {
+				t.Errorf("First batch %q, want the first two points", bodies[0])
+			}
+		})
+	}
+}
+
+// counterValue returns the current value of a counter.
+func counterValue(t *testing.T, c interface {
+	Write(*dto.Metric) error
+}) float64 {
+	var pb dto.Metric
+	if err := c.Write(&pb); err != nil {
+		t.Fatalf("Error writing metric: %+v", err)
+	}
+	return pb.GetCounter().GetValue()
+}
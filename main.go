@@ -2,14 +2,20 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -33,9 +39,29 @@ type upsInfo struct {
 	lineVoltage       float64
 	nomBatteryVoltage float64
 	nomInputVoltage   float64
-
-	hostname string
-	upsName  string
+	outputVoltage     float64
+	lowTransfer       float64
+	highTransfer      float64
+
+	internalTemp float64
+
+	// outletGroups maps an outlet group name to whether it is switched on.
+	// Only populated by backends that report outlet groups.
+	outletGroups map[string]bool
+
+	numTransfers       float64
+	lastTransferReason string
+	lastOnBattery      time.Time
+	lastOffBattery     time.Time
+	selfTestResult     string
+	lastSelfTest       time.Time
+	date               time.Time
+
+	hostname     string
+	upsName      string
+	model        string
+	serialNumber string
+	firmware     string
 }
 
 // See SVN code at https://sourceforge.net/p/apcupsd/svn/HEAD/tree/trunk/src/lib/apcstatus.c#l166 for
@@ -55,182 +81,341 @@ var statusList = []string{
 	"shutting down",
 }
 
-var (
-	labels = []string{"hostname", "upsname"}
+// statusFlags splits an apcupsd status such as "onbatt lowbatt" into its
+// individual flags, keeping the two word "shutting down" together.
+func statusFlags(status string) []string {
+
+	var flags []string
+	words := strings.Fields(status)
+	for i := 0; i < len(words); i++ {
+		if words[i] == "shutting" && i+1 < len(words) && words[i+1] == "down" {
+			flags = append(flags, "shutting down")
+			i++
+			continue
+		}
+		flags = append(flags, words[i])
+	}
 
-	status = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "apcups_status",
-		Help: "Current status of UPS",
-	},
-		append(labels, "status"),
-	)
+	return flags
+}
 
-	statusNumeric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "apcups_status_numeric",
-		Help: "Current status of UPS represented as integer",
-	},
-		labels,
-	)
+// subcommands maps the first command line argument to an alternative entry
+// point. Each receives the remaining arguments and returns the exit code.
+var subcommands = map[string]func(args []string) int{}
 
-	nominalPower = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "apcups_nominal_power_watts",
-		Help: "Nominal UPS Power",
-	},
-		labels,
-	)
+func main() {
 
-	batteryChargePercent = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "apcups_battery_charge_percent",
-		Help: "Percentage Battery Charge",
-	},
-		labels,
-	)
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			os.Exit(run(os.Args[2:]))
+		}
+	}
 
-	loadPercent = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "apcups_load_percent",
-		Help: "Percentage Battery Load",
-	},
-		labels,
-	)
+	// TODO: Register a port for listening here: https://github.com/prometheus/prometheus/wiki/Default-port-allocations
+	addr := flag.String("listen-address", ":8080", "The address to listen on for HTTP requests, empty to not serve HTTP at all.")
+	configFile := flag.String("config.file", "", "YAML file listing the UPS targets to poll, reloaded on SIGHUP or POST /-/reload. Overrides -ups-address, -ups-protocol, -modbus-unit-id and -poll-interval")
+	upsAddr := flag.String("ups-address", "localhost:3551", "Comma separated list of UPS targets to query: hostname:port or a URL such as nis://host:3551, file:///var/log/apcupsd.status or modbus://host:502")
+	upsProtocol := flag.String("ups-protocol", "nis", "The protocol used for targets given as plain hostname:port: nis or modbus")
+	modbusUnit := flag.Uint("modbus-unit-id", 1, "The Modbus unit identifier used for plain hostname:port modbus targets")
+	pollInterval := flag.Duration("poll-interval", 10*time.Second, "How often to poll each UPS target")
+	readyQuorum := flag.Int("ready-quorum", 0, "Number of targets that must have been polled successfully before /-/ready succeeds, 0 for all")
+	recordDir := flag.String("record-dir", "", "Directory to save every raw NIS response in, one subdirectory per target, for replay:// targets and bug reports")
+	recordMaxBytes := flag.Int64("record-max-bytes", 100<<20, "Maximum size of the recording of each target; the oldest responses are deleted beyond it, 0 to keep them all")
+	webConfigFile := flag.String("web.config.file", "", "YAML file configuring TLS, basic authentication and an IP allowlist for every HTTP endpoint")
+	pushURL := flag.String("push.url", "", "Pushgateway to push the metrics of every target to after each poll, e.g. http://pushgateway:9091")
+	pushJob := flag.String("push.job", "apcupsd", "Job name to push to the Pushgateway with")
+	textfilePath := flag.String("textfile.path", "", "File to write all metrics to after each poll for the node_exporter textfile collector, e.g. /var/lib/node_exporter/apcups.prom")
+	influxURL := flag.String("influx.url", "", "InfluxDB to write every poll to as a line protocol point, e.g. http://influxdb:8086, or - to print the points on stdout for Telegraf's execd input")
+	influxBucket := flag.String("influx.bucket", "", "InfluxDB 2.x bucket to write to")
+	influxOrg := flag.String("influx.org", "", "InfluxDB 2.x organization of --influx.bucket")
+	influxDatabase := flag.String("influx.database", "", "InfluxDB 1.x database to write to, when no --influx.bucket is given")
+	influxTokenFile := flag.String("influx.token-file", "", "File holding the InfluxDB API token, or username:password for InfluxDB 1.x")
+	influxBatchSize := flag.Int("influx.batch-size", 100, "Number of points to write to InfluxDB in one request")
+	influxFlushInterval := flag.Duration("influx.flush-interval", 10*time.Second, "How often to write pending points to InfluxDB when a batch is not full")
+	mqttURL := flag.String("mqtt.url", "", "MQTT broker to publish the state of every target to after each poll, e.g. mqtt://broker:1883 or mqtts://broker:8883")
+	mqttClientID := flag.String("mqtt.client-id", "", "MQTT client identifier, also naming the exporter's availability topic; defaults to apcupsd-exporter-<hostname>")
+	mqttUsername := flag.String("mqtt.username", "", "User name to authenticate to the MQTT broker with")
+	mqttPasswordFile := flag.String("mqtt.password-file", "", "File holding the password for --mqtt.username")
+	mqttCAFile := flag.String("mqtt.ca-file", "", "CA certificates to verify an mqtts:// broker against instead of the system roots")
+	mqttCertFile := flag.String("mqtt.cert-file", "", "Client certificate to present to an mqtts:// broker")
+	mqttKeyFile := flag.String("mqtt.key-file", "", "Key of --mqtt.cert-file")
+	mqttTopicPrefix := flag.String("mqtt.topic-prefix", "apcupsd", "Prefix of the MQTT topics published to")
+	mqttDiscoveryPrefix := flag.String("mqtt.discovery-prefix", "homeassistant", "Home Assistant MQTT discovery prefix, empty to not publish discovery configs")
+	otlpEndpoint := flag.String("otlp.endpoint", "", "OpenTelemetry Collector to export the metrics of every target to after each poll, e.g. http://collector:4318 for http/protobuf or http://collector:4317 for grpc")
+	otlpProtocol := flag.String("otlp.protocol", "http/protobuf", "OTLP transport: grpc or http/protobuf")
+	otlpHeaders := flag.String("otlp.headers", "", "Headers to send with OTLP requests as comma separated key=value pairs, e.g. for authentication")
+	graphiteAddress := flag.String("graphite.address", "", "Carbon server to send every poll to in the plaintext protocol, e.g. carbon:2003, tcp://carbon:2003 or udp://carbon:2003")
+	graphiteTemplate := flag.String("graphite.path-template", "apcupsd.{hostname}.{upsname}.{metric}", "Graphite path of each value; {hostname}, {upsname}, {model}, {serial}, {target}, {metric} and configured label names are filled in")
+	statsdAddress := flag.String("statsd.address", "", "StatsD server to send every poll to as gauges, e.g. statsd:8125, udp://statsd:8125 or tcp://statsd:8125")
+	statsdTemplate := flag.String("statsd.name-template", "apcupsd.{hostname}.{upsname}.{metric}", "StatsD name of each gauge, with the placeholders of --graphite.path-template")
+	zabbixServer := flag.String("zabbix.server", "", "Zabbix server or proxy to send every poll to as a trapper client, e.g. zabbix:10051")
+	zabbixHost := flag.String("zabbix.host", "", "Host in Zabbix to send the UPS items and discovery to; defaults to the host name")
+	zabbixKeyPrefix := flag.String("zabbix.key-prefix", "apcupsd", "Prefix of the Zabbix item keys")
+	zabbixDiscoveryInterval := flag.Duration("zabbix.discovery-interval", time.Hour, "How often to resend unchanged low-level discovery data to Zabbix")
+	remoteWriteURL := flag.String("remote-write.url", "", "Prometheus remote_write endpoint to send the metrics of every target to after each poll, e.g. http://prometheus:9090/api/v1/write")
+	remoteWriteWALDir := flag.String("remote-write.wal-dir", "remote-write-wal", "Directory for the write-ahead log of samples not yet accepted by --remote-write.url")
+	remoteWriteWALMaxBytes := flag.Int64("remote-write.wal-max-bytes", 256<<20, "Maximum size of the remote_write WAL on disk; the oldest unsent samples are dropped beyond it")
+	webhookConfigFile := flag.String("webhook.config.file", "", "YAML file listing webhooks to notify of UPS status transitions such as going on battery, with body templates, retries and a dead-letter file")
+	once := flag.Bool("once", false, "Poll every target once, hand the results to the configured outputs and exit without serving HTTP; exits 1 if any poll failed")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "How long to wait for in-flight HTTP requests to finish on SIGTERM or SIGINT")
+	flag.Parse()
 
-	timeOnBattery = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "apcups_time_on_battery_seconds",
-		Help: "Total time on UPS battery",
-	},
-		labels,
-	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	timeLeft = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "apcups_time_left_seconds",
-		Help: "Time on UPS battery",
-	},
-		labels,
+	var (
+		cfg *config
+		err error
 	)
+	if *configFile != "" {
+		cfg, err = loadConfig(*configFile)
+	} else {
+		cfg = configFromFlags(*upsAddr, *upsProtocol, *modbusUnit, *pollInterval)
+		err = cfg.resolve()
+	}
+	if err != nil {
+		log.Fatalf("Error loading configuration: %+v", err)
+	}
+	configLastReloadSuccessful.Set(1)
+	configLastReloadSuccessTimestamp.Set(float64(time.Now().Unix()))
 
-	cumTimeOnBattery = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "apcups_cum_time_on_battery_seconds",
-		Help: "Cumululative Time on UPS battery",
-	},
-		labels,
-	)
+	manager := &targetManager{ctx: ctx, recordDir: *recordDir, recordMaxBytes: *recordMaxBytes, labelNames: cfg.labelNames()}
 
-	batteryVoltage = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "apcups_battery_volts",
-		Help: "UPS Battery Voltage",
-	},
-		labels,
-	)
+	if *pushURL != "" {
+		manager.sinks = append(manager.sinks, newPushSink(*pushURL, *pushJob))
+		log.Printf("Pushing to Pushgateway at: %s", *pushURL)
+	}
+	if *textfilePath != "" {
+		manager.sinks = append(manager.sinks, &textfileSink{path: *textfilePath})
+		log.Printf("Writing metrics to textfile: %s", *textfilePath)
+	}
 
-	lineVoltage = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "apcups_line_volts",
-		Help: "UPS Line Voltage",
-	},
-		labels,
-	)
+	if *mqttURL != "" {
+		opts, err := newMQTTOptions(*mqttURL, *mqttCAFile, *mqttCertFile, *mqttKeyFile)
+		if err != nil {
+			log.Fatalf("Error setting up MQTT: %+v", err)
+		}
+		opts.clientID = *mqttClientID
+		if opts.clientID == "" {
+			hostname, _ := os.Hostname()
+			opts.clientID = "apcupsd-exporter-" + hostname
+		}
+		opts.username = *mqttUsername
+		if *mqttPasswordFile != "" {
+			password, err := ioutil.ReadFile(*mqttPasswordFile)
+			if err != nil {
+				log.Fatalf("Error reading MQTT password file: %+v", err)
+			}
+			opts.password = strings.TrimSpace(string(password))
+		}
+		manager.sinks = append(manager.sinks, newMQTTSink(opts, *mqttTopicPrefix, *mqttDiscoveryPrefix))
+		log.Printf("Publishing to MQTT broker at: %s", opts.address)
+	}
+	if *otlpEndpoint != "" {
+		headers, err := parseOTLPHeaders(*otlpHeaders)
+		if err != nil {
+			log.Fatalf("Error setting up OTLP export: %+v", err)
+		}
+		otlp, err := newOTLPSink(*otlpEndpoint, *otlpProtocol, headers)
+		if err != nil {
+			log.Fatalf("Error setting up OTLP export: %+v", err)
+		}
+		manager.sinks = append(manager.sinks, otlp)
+		log.Printf("Exporting OTLP over %s to: %s", *otlpProtocol, otlp.url)
+	}
+	if *graphiteAddress != "" {
+		writer, err := newLineWriter(*graphiteAddress, "tcp")
+		if err != nil {
+			log.Fatalf("Error setting up Graphite output: %+v", err)
+		}
+		template, err := newPathTemplate(*graphiteTemplate)
+		if err != nil {
+			log.Fatalf("Error setting up Graphite output: %+v", err)
+		}
+		manager.sinks = append(manager.sinks, &graphiteSink{writer: writer, template: template})
+		log.Printf("Sending to Graphite at: %s", writer)
+	}
+	if *statsdAddress != "" {
+		writer, err := newLineWriter(*statsdAddress, "udp")
+		if err != nil {
+			log.Fatalf("Error setting up StatsD output: %+v", err)
+		}
+		template, err := newPathTemplate(*statsdTemplate)
+		if err != nil {
+			log.Fatalf("Error setting up StatsD output: %+v", err)
+		}
+		manager.sinks = append(manager.sinks, &statsdSink{writer: writer, template: template})
+		log.Printf("Sending to StatsD at: %s", writer)
+	}
+	if *webhookConfigFile != "" {
+		webhookCfg, err := loadWebhookConfig(*webhookConfigFile)
+		if err != nil {
+			log.Fatalf("Error setting up webhooks: %+v", err)
+		}
+		webhooks, err := newWebhookSink(webhookCfg)
+		if err != nil {
+			log.Fatalf("Error setting up webhooks: %+v", err)
+		}
+		manager.sinks = append(manager.sinks, webhooks)
+		log.Printf("Notifying %d webhooks of status transitions", len(webhooks.webhooks))
+	}
+	if *zabbixServer != "" {
+		host := *zabbixHost
+		if host == "" {
+			host, _ = os.Hostname()
+		}
+		zabbix, err := newZabbixSink(*zabbixServer, host, *zabbixKeyPrefix, *zabbixDiscoveryInterval)
+		if err != nil {
+			log.Fatalf("Error setting up Zabbix output: %+v", err)
+		}
+		manager.sinks = append(manager.sinks, zabbix)
+		log.Printf("Sending to Zabbix at %s as host: %s", zabbix.address, host)
+	}
+	if *remoteWriteURL != "" {
+		rw, err := newRemoteWriteSink(*remoteWriteURL, *remoteWriteWALDir, *remoteWriteWALMaxBytes)
+		if err != nil {
+			log.Fatalf("Error setting up remote write: %+v", err)
+		}
+		manager.sinks = append(manager.sinks, rw)
+		log.Printf("Sending to remote write endpoint at: %s", *remoteWriteURL)
+	}
 
-	nomBatteryVoltage = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "apcups_nom_battery_volts",
-		Help: "UPS Nominal Battery Voltage",
-	},
-		labels,
-	)
+	if *influxURL == "-" {
+		manager.sinks = append(manager.sinks, newInfluxWriterSink(os.Stdout))
+		log.Printf("Writing InfluxDB line protocol to stdout")
+	} else if *influxURL != "" {
+		writeURL, err := influxWriteURL(*influxURL, *influxOrg, *influxBucket, *influxDatabase)
+		if err != nil {
+			log.Fatalf("Error setting up InfluxDB output: %+v", err)
+		}
+		influx, err := newInfluxSink(writeURL, *influxTokenFile, *influxBatchSize, *influxFlushInterval)
+		if err != nil {
+			log.Fatalf("Error setting up InfluxDB output: %+v", err)
+		}
+		manager.sinks = append(manager.sinks, influx)
+		log.Printf("Writing to InfluxDB at: %s", writeURL)
+	}
 
-	nomInputVoltage = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "apcups_nom_input_volts",
-		Help: "UPS Nominal Input Voltage",
-	},
-		labels,
-	)
+	prometheus.MustRegister(&upsCollector{targets: manager.targets, labelNames: manager.configuredLabelNames})
 
-	collectSeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "apcups_collect_time_seconds",
-		Help: "Time to collect stats for last poll of UPS network interface",
-	},
-		labels,
-	)
-)
+	if *once {
+		if failed := manager.pollOnce(cfg); failed > 0 {
+			os.Exit(1)
+		}
+		return
+	}
 
-func main() {
+	if err := manager.apply(cfg); err != nil {
+		log.Fatalf("Error configuring UPS target: %+v", err)
+	}
 
-	// TODO: Register a port for listening here: https://github.com/prometheus/prometheus/wiki/Default-port-allocations
-	addr := flag.String("listen-address", ":8080", "The address to listen on for HTTP requests.")
-	upsAddr := flag.String("ups-address", "localhost:3551", "The address of the acupsd daemon to query: hostname:port")
-	flag.Parse()
+	reloader := &configReloader{path: *configFile, manager: manager}
+	go reloader.watchSignals()
+
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, syscall.SIGINT)
+
+	if *addr == "" {
+		log.Printf("Received %s, shutting down", <-term)
+		cancel()
+		manager.stopAll()
+		log.Printf("Shutdown complete")
+		return
+	}
 
-	log.Printf("Connection to UPS at: %s", *upsAddr)
 	log.Printf("Metric listener at: %s", *addr)
 
-	prometheus.MustRegister(status)
-	prometheus.MustRegister(statusNumeric)
-	prometheus.MustRegister(nominalPower)
-	prometheus.MustRegister(batteryChargePercent)
-	prometheus.MustRegister(timeOnBattery)
-	prometheus.MustRegister(timeLeft)
-	prometheus.MustRegister(cumTimeOnBattery)
-	prometheus.MustRegister(loadPercent)
-	prometheus.MustRegister(batteryVoltage)
-	prometheus.MustRegister(lineVoltage)
-	prometheus.MustRegister(nomBatteryVoltage)
-	prometheus.MustRegister(nomInputVoltage)
-	prometheus.MustRegister(collectSeconds)
+	api := &apiHandler{targets: manager.targets}
+	health := newHealthHandler(manager.targets, *readyQuorum)
 
-	go func() {
-		c := time.Tick(10 * time.Second)
-		for _ = range c {
-			if err := collectUPSData(upsAddr); err != nil {
-				log.Printf("Error collecting UPS data: %+v", err)
+	http.Handle("/metrics", prometheus.Handler())
+	http.Handle("/api/v1/ups", api)
+	http.Handle("/api/v1/ups/", api)
+	http.HandleFunc("/-/healthy", health.healthy)
+	http.HandleFunc("/-/ready", health.ready)
+	http.Handle("/-/reload", reloader)
+	http.Handle("/", &statusPageHandler{targets: manager.targets})
+
+	server := &http.Server{Addr: *addr, Handler: http.DefaultServeMux}
+
+	if *webConfigFile != "" {
+		webCfg, err := loadWebConfig(*webConfigFile)
+		if err != nil {
+			log.Fatalf("Error loading web configuration: %+v", err)
+		}
+		if webCfg.TLSConfig != nil {
+			if server.TLSConfig, err = webCfg.TLSConfig.newTLSConfig(); err != nil {
+				log.Fatalf("Error configuring TLS: %+v", err)
 			}
 		}
+		server.Handler = newWebHandler(server.Handler, webCfg)
+	}
 
-	}()
+	drained := make(chan struct{})
 
-	http.Handle("/metrics", prometheus.Handler())
-	http.ListenAndServe(*addr, nil)
-}
+	go func() {
+		defer close(drained)
 
-func collectUPSData(upsAddr *string) error {
+		log.Printf("Received %s, shutting down", <-term)
 
-	gatherStart := time.Now()
+		// Stop polling straight away, aborting NIS calls in flight, while
+		// the server finishes the scrapes it is serving.
+		cancel()
 
-	data, err := retrieveData(*upsAddr)
-	if err != nil {
-		return err
-	}
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer shutdownCancel()
 
-	gatherDuration := time.Now().Sub(gatherStart)
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Error shutting down HTTP server: %+v", err)
+		}
+	}()
 
-	info, err := transformData(data)
-	if err != nil {
-		return err
+	if server.TLSConfig != nil {
+		// The certificate comes from TLSConfig.GetCertificate.
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		log.Fatalf("Error starting HTTP server: %+v", err)
 	}
-	collectSeconds.WithLabelValues(info.hostname, info.upsName).Set(gatherDuration.Seconds())
 
-	log.Printf("%+v", info)
+	// ListenAndServe returns as soon as Shutdown is called; wait for the
+	// requests in flight before tearing down the pollers.
+	<-drained
+	manager.stopAll()
 
-	for i, stat := range statusList {
-		if stat == info.status {
-			status.WithLabelValues(info.hostname, info.upsName, stat).Set(1)
-			statusNumeric.WithLabelValues(info.hostname, info.upsName).Set(float64(i))
-		} else {
-			status.WithLabelValues(info.hostname, info.upsName, stat).Set(0)
+	log.Printf("Shutdown complete")
+}
+
+// configFromFlags builds the configuration used when no --config.file is
+// given.
+func configFromFlags(upsAddr, protocol string, modbusUnit uint, interval time.Duration) *config {
+
+	cfg := &config{Global: globalConfig{Interval: interval, Backend: protocol}}
+
+	for _, name := range strings.Split(upsAddr, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if protocol == "modbus" && !strings.Contains(name, "://") {
+			name = fmt.Sprintf("modbus://%s?unit=%d", name, modbusUnit)
 		}
+		cfg.Targets = append(cfg.Targets, targetConfig{Address: name})
 	}
 
-	status.WithLabelValues(info.hostname, info.upsName, info.status).Set(1)
-
-	nominalPower.WithLabelValues(info.hostname, info.upsName).Set(info.nomPower)
+	return cfg
+}
 
-	batteryChargePercent.WithLabelValues(info.hostname, info.upsName).Set(info.batteryChargePercent)
-	timeOnBattery.WithLabelValues(info.hostname, info.upsName).Set(info.timeOnBattery.Seconds())
+func collectUPSData(ctx context.Context, t *target) error {
 
-	timeLeft.WithLabelValues(info.hostname, info.upsName).Set(info.timeLeft.Seconds())
+	snapshot, err := t.fetch(withNISObserver(ctx, observeNISDuration(t)))
+	if err != nil {
+		return err
+	}
 
-	cumTimeOnBattery.WithLabelValues(info.hostname, info.upsName).Set(info.cumTimeOnBattery.Seconds())
-	loadPercent.WithLabelValues(info.hostname, info.upsName).Set(info.loadPercent)
-	batteryVoltage.WithLabelValues(info.hostname, info.upsName).Set(info.batteryVoltage)
-	lineVoltage.WithLabelValues(info.hostname, info.upsName).Set(info.lineVoltage)
-	nomBatteryVoltage.WithLabelValues(info.hostname, info.upsName).Set(info.nomBatteryVoltage)
-	nomInputVoltage.WithLabelValues(info.hostname, info.upsName).Set(info.nomInputVoltage)
+	log.Printf("%+v", snapshot.Info)
 
 	return nil
 }
@@ -301,22 +486,79 @@ func transformData(ups map[string]string) (*upsInfo, error) {
 		upsInfo.nomInputVoltage = volts
 	}
 
+	if volts, err := parseUnits(ups["OUTPUTV"]); err != nil {
+		return nil, err
+	} else {
+		upsInfo.outputVoltage = volts
+	}
+
+	if volts, err := parseUnits(ups["LOTRANS"]); err != nil {
+		return nil, err
+	} else {
+		upsInfo.lowTransfer = volts
+	}
+
+	if volts, err := parseUnits(ups["HITRANS"]); err != nil {
+		return nil, err
+	} else {
+		upsInfo.highTransfer = volts
+	}
+
+	if temp, err := parseUnits(ups["ITEMP"]); err != nil {
+		return nil, err
+	} else {
+		upsInfo.internalTemp = temp
+	}
+
+	if transfers, err := parseUnits(ups["NUMXFERS"]); err != nil {
+		return nil, err
+	} else {
+		upsInfo.numTransfers = transfers
+	}
+
+	upsInfo.lastTransferReason = ups["LASTXFER"]
+	upsInfo.lastOnBattery = parseTimestamp(ups["XONBATT"])
+	upsInfo.lastOffBattery = parseTimestamp(ups["XOFFBATT"])
+	upsInfo.selfTestResult = ups["SELFTEST"]
+	upsInfo.lastSelfTest = parseTimestamp(ups["LASTSTEST"])
+	upsInfo.date = parseTimestamp(ups["DATE"])
+
 	upsInfo.hostname = ups["HOSTNAME"]
 	upsInfo.upsName = ups["UPSNAME"]
+	upsInfo.model = ups["MODEL"]
+	upsInfo.serialNumber = ups["SERIALNO"]
+	upsInfo.firmware = ups["FIRMWARE"]
 
 	return upsInfo, nil
 }
 
 // parse time strings like 30 seconds or 1.25 minutes
 func parseTime(t string) (time.Duration, error) {
-	if t == ""{
+	if t == "" {
 		return 0, nil
 	}
-	chunks := strings.Split(t, " ")
+	chunks := strings.Fields(t)
+	if len(chunks) != 2 {
+		return 0, fmt.Errorf("Invalid time %q, expected a number and a unit", t)
+	}
 	fmtStr := chunks[0] + string(strings.ToLower(chunks[1])[0])
 	return time.ParseDuration(fmtStr)
 }
 
+// apcupsdTimeFormat is the layout of timestamps such as DATE and XONBATT in
+// apcupsd 3.14 and later.
+const apcupsdTimeFormat = "2006-01-02 15:04:05 -0700"
+
+// parse timestamps like 2016-08-30 17:03:00 +1000, returning the zero time
+// for N/A and for formats used by older apcupsd versions
+func parseTimestamp(t string) time.Time {
+	ts, err := time.Parse(apcupsdTimeFormat, t)
+	if err != nil {
+		return time.Time{}
+	}
+	return ts
+}
+
 // parse generic units, splitting of units name and converting to float
 func parseUnits(v string) (float64, error) {
 	if v == ""{
@@ -325,52 +567,141 @@ func parseUnits(v string) (float64, error) {
 	return strconv.ParseFloat(strings.Split(v, " ")[0], 32)
 }
 
-func retrieveData(hostPort string) (map[string]string, error) {
+func retrieveData(ctx context.Context, hostPort string) (map[string]string, error) {
 
-	conn, err := net.Dial("tcp", hostPort)
+	raw, err := nisCommand(ctx, hostPort, "status")
 	if err != nil {
+		return nil, err
+	}
+
+	return parseStatus(raw)
+}
+
+// nisCommand sends a single command to apcupsd and returns the raw framed
+// response, including the terminating zero length frame. When reading the
+// response fails it returns the bytes received so far along with the error;
+// they are only nil if the command was never sent.
+func nisCommand(ctx context.Context, hostPort, command string) ([]byte, error) {
+
+	start := time.Now()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", hostPort)
+	observeNIS(ctx, "dial", start, err)
+	if err != nil {
+		observeNIS(ctx, "full", start, err)
 		return nil, fmt.Errorf("Unable to connect to remote port: %+v", err)
 	}
+	defer conn.Close()
 
-	if _, err = conn.Write([]byte{0, 6}); err != nil {
-		return nil, fmt.Errorf("Error writing command length: %+v", err)
+	if deadline, ok := ctx.Deadline(); ok {
+		if err = conn.SetDeadline(deadline); err != nil {
+			return nil, fmt.Errorf("Error setting connection deadline: %+v", err)
+		}
 	}
+	defer abortOnCancel(ctx, conn)()
 
-	if _, err = conn.Write([]byte("status")); err != nil {
-		return nil, fmt.Errorf("Error writing command data: %+v", err)
+	writeStart := time.Now()
+	if err = binary.Write(conn, binary.BigEndian, int16(len(command))); err == nil {
+		_, err = conn.Write([]byte(command))
+	}
+	observeNIS(ctx, "write", writeStart, err)
+	if err != nil {
+		observeNIS(ctx, "full", start, err)
+		return nil, fmt.Errorf("Error writing command: %+v", err)
+	}
+
+	r := &firstByteReader{r: conn, start: time.Now(), ctx: ctx}
+
+	var raw bytes.Buffer
+	if _, err = readRecords(io.TeeReader(r, &raw)); err != nil {
+		if r.err != nil {
+			observeNIS(ctx, "full", start, r.err)
+		} else {
+			observeNIS(ctx, "full", start, err)
+		}
+		return append([]byte{}, raw.Bytes()...), err
+	}
+	observeNIS(ctx, "full", start, nil)
+
+	return raw.Bytes(), nil
+}
+
+// abortOnCancel makes blocked reads and writes on conn fail once ctx is
+// cancelled rather than waiting for its deadline. The returned function
+// must be called once the exchange is over.
+func abortOnCancel(ctx context.Context, conn net.Conn) func() {
+
+	done := make(chan struct{})
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+// parseStatus decodes the raw response to a "status" command.
+func parseStatus(raw []byte) (map[string]string, error) {
+
+	records, err := readRecords(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
 	}
 
-	complete := false
 	upsData := map[string]string{}
+	for _, record := range records {
+		if key, value, ok := parseRecord(record); ok {
+			upsData[key] = value
+		}
+	}
+
+	return upsData, nil
+}
+
+// readRecords reads length prefixed NIS records up to the zero length frame
+// that terminates a response.
+func readRecords(r io.Reader) ([]string, error) {
+
+	complete := false
+	var records []string
 
 	for !complete {
 		sizeBuf := []byte{0, 0}
 		var size int16
-		if _, err := conn.Read(sizeBuf); err != nil {
+		if _, err := io.ReadFull(r, sizeBuf); err != nil {
 			return nil, fmt.Errorf("Error reading size from incoming reader: %+v", err)
 		}
 
-		if err = binary.Read(bytes.NewBuffer(sizeBuf), binary.BigEndian, &size); err != nil {
+		if err := binary.Read(bytes.NewBuffer(sizeBuf), binary.BigEndian, &size); err != nil {
 			return nil, fmt.Errorf("Error decoding size in response: %+v", err)
 		}
 
+		if size < 0 {
+			return nil, fmt.Errorf("Invalid record length %d in response", size)
+		}
+
 		if size > 0 {
 			data := make([]byte, size)
-			if _, err = conn.Read(data); err != nil {
-				log.Panicf("Error reading size from incoming reader: %+v", err)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return nil, fmt.Errorf("Error reading data from incoming reader: %+v", err)
+			}
+			// ASCII text never contains NUL bytes, while a wide
+			// encoding such as UTF-16 has one in every ASCII character.
+			if bytes.IndexByte(data, 0) >= 0 {
+				return nil, fmt.Errorf("Record %q is not ASCII text", data)
 			}
-			chunks := strings.Split(string(data), ":")
-			upsData[strings.TrimSpace(chunks[0])] = strings.TrimSpace(chunks[1])
+			records = append(records, string(data))
 
 		} else {
 			complete = true
 		}
 	}
 
-	if err = conn.Close(); err != nil {
-		log.Panicf("Error closing apcupsd connection: %+v", err)
-	}
-
-	return upsData, nil
+	return records, nil
 
 }
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTime(t *testing.T) {
+
+	tests := []struct {
+		in   string
+		want time.Duration
+		err  bool
+	}{
+		{in: "", want: 0},
+		{in: "30 seconds", want: 30 * time.Second},
+		{in: "1.25 Minutes", want: 75 * time.Second},
+		{in: "2 hours", want: 2 * time.Hour},
+		{in: "30", err: true},
+		{in: "30 ", err: true},
+		{in: "N/A", err: true},
+		{in: "thirty seconds", err: true},
+		{in: "30 seconds ago", err: true},
+	}
+
+	for _, test := range tests {
+		got, err := parseTime(test.in)
+		if (err != nil) != test.err {
+			t.Errorf("parseTime(%q) = %v, want error %v", test.in, err, test.err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("parseTime(%q) = %s, want %s", test.in, got, test.want)
+		}
+	}
+}
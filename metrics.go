@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// upsMetric describes one of the metrics exported for every target. Every
+// series carries the target's name and the configured labels of all targets,
+// empty where a target does not set one, so that two targets reporting the
+// same hostname and UPS name stay apart and every descriptor of a metric has
+// the same label names.
+type upsMetric struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func newUPSMetric(name, help string, extra ...string) upsMetric {
+	return upsMetric{
+		name:   name,
+		help:   help,
+		labels: append([]string{"hostname", "upsname", "target"}, extra...),
+	}
+}
+
+func (m upsMetric) desc(labelNames []string) *prometheus.Desc {
+	return prometheus.NewDesc(m.name, m.help, append(append([]string{}, m.labels...), labelNames...), nil)
+}
+
+// sortedLabelNames returns the names of labels in order.
+func sortedLabelNames(labels map[string]string) []string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+var (
+	status               = newUPSMetric("apcups_status", "Current status of UPS", "status")
+	statusNumeric        = newUPSMetric("apcups_status_numeric", "Current status of UPS represented as integer")
+	nominalPower         = newUPSMetric("apcups_nominal_power_watts", "Nominal UPS Power")
+	batteryChargePercent = newUPSMetric("apcups_battery_charge_percent", "Percentage Battery Charge")
+	loadPercent          = newUPSMetric("apcups_load_percent", "Percentage Battery Load")
+	timeOnBattery        = newUPSMetric("apcups_time_on_battery_seconds", "Total time on UPS battery")
+	timeLeft             = newUPSMetric("apcups_time_left_seconds", "Time on UPS battery")
+	cumTimeOnBattery     = newUPSMetric("apcups_cum_time_on_battery_seconds", "Cumululative Time on UPS battery")
+	batteryVoltage       = newUPSMetric("apcups_battery_volts", "UPS Battery Voltage")
+	lineVoltage          = newUPSMetric("apcups_line_volts", "UPS Line Voltage")
+	nomBatteryVoltage    = newUPSMetric("apcups_nom_battery_volts", "UPS Nominal Battery Voltage")
+	nomInputVoltage      = newUPSMetric("apcups_nom_input_volts", "UPS Nominal Input Voltage")
+	outputVoltage        = newUPSMetric("apcups_output_volts", "UPS Output Voltage")
+	internalTemp         = newUPSMetric("apcups_internal_temperature_celsius", "UPS Internal Temperature")
+	outletGroupOn        = newUPSMetric("apcups_outlet_group_on", "Whether a UPS outlet group is switched on", "group")
+	collectSeconds       = newUPSMetric("apcups_collect_time_seconds", "Time to collect stats for last poll of UPS network interface")
+
+	up = upsMetric{
+		name:   "apcups_up",
+		help:   "Whether the last poll of the UPS target succeeded",
+		labels: []string{"target"},
+	}
+
+	upsMetrics = []upsMetric{
+		status, statusNumeric, nominalPower, batteryChargePercent, loadPercent,
+		timeOnBattery, timeLeft, cumTimeOnBattery, batteryVoltage, lineVoltage,
+		nomBatteryVoltage, nomInputVoltage, outputVoltage, internalTemp,
+		outletGroupOn, collectSeconds, up,
+	}
+)
+
+// upsCollector exports the last snapshot of every target. labelNames
+// returns the configured label names of all targets, which change when a
+// reload adds or removes one.
+//
+// The vendored registry fixes the label names of a metric when it is first
+// registered, even across Unregister, but does not check collected metrics
+// against the described ones. Collect therefore uses the current label
+// names, and Describe those at registration.
+type upsCollector struct {
+	targets    func() []*target
+	labelNames func() []string
+}
+
+func (c *upsCollector) Describe(ch chan<- *prometheus.Desc) {
+	labelNames := c.labelNames()
+	for _, m := range upsMetrics {
+		ch <- m.desc(labelNames)
+	}
+}
+
+func (c *upsCollector) Collect(ch chan<- prometheus.Metric) {
+
+	labelNames := c.labelNames()
+
+	descs := map[string]*prometheus.Desc{}
+	for _, m := range upsMetrics {
+		descs[m.name] = m.desc(labelNames)
+	}
+
+	for _, t := range c.targets() {
+		c.collectTarget(ch, t, labelNames, descs)
+	}
+}
+
+func (c *upsCollector) collectTarget(ch chan<- prometheus.Metric, t *target, labelNames []string, descs map[string]*prometheus.Desc) {
+
+	snapshot, lastPoll, lastErr := t.state()
+
+	configured := make([]string, len(labelNames))
+	for i, name := range labelNames {
+		configured[i] = t.labels[name]
+	}
+
+	gauge := func(m upsMetric, value float64, labelValues ...string) {
+		labelValues = append(labelValues, configured...)
+		ch <- prometheus.MustNewConstMetric(descs[m.name], prometheus.GaugeValue, value, labelValues...)
+	}
+
+	if lastPoll.IsZero() {
+		return
+	}
+
+	if lastErr != nil {
+		gauge(up, 0, t.name)
+	} else {
+		gauge(up, 1, t.name)
+	}
+
+	if snapshot == nil {
+		return
+	}
+
+	info := snapshot.Info
+	host, name := info.hostname, info.upsName
+
+	gauge(collectSeconds, t.lastPollDuration().Seconds(), host, name, t.name)
+
+	matched := false
+	for i, stat := range statusList {
+		if stat == info.status {
+			matched = true
+			gauge(statusNumeric, float64(i), host, name, t.name)
+			gauge(status, 1, host, name, t.name, stat)
+		} else {
+			gauge(status, 0, host, name, t.name, stat)
+		}
+	}
+	if !matched {
+		gauge(status, 1, host, name, t.name, info.status)
+	}
+
+	gauge(nominalPower, info.nomPower, host, name, t.name)
+	gauge(batteryChargePercent, info.batteryChargePercent, host, name, t.name)
+	gauge(timeOnBattery, info.timeOnBattery.Seconds(), host, name, t.name)
+	gauge(timeLeft, info.timeLeft.Seconds(), host, name, t.name)
+	gauge(cumTimeOnBattery, info.cumTimeOnBattery.Seconds(), host, name, t.name)
+	gauge(loadPercent, info.loadPercent, host, name, t.name)
+	gauge(batteryVoltage, info.batteryVoltage, host, name, t.name)
+	gauge(lineVoltage, info.lineVoltage, host, name, t.name)
+	gauge(nomBatteryVoltage, info.nomBatteryVoltage, host, name, t.name)
+	gauge(nomInputVoltage, info.nomInputVoltage, host, name, t.name)
+	gauge(outputVoltage, info.outputVoltage, host, name, t.name)
+	gauge(internalTemp, info.internalTemp, host, name, t.name)
+
+	for group, on := range info.outletGroups {
+		if on {
+			gauge(outletGroupOn, 1, host, name, t.name, group)
+		} else {
+			gauge(outletGroupOn, 0, host, name, t.name, group)
+		}
+	}
+}
+
+// gatherMetricFamilies collects the default registry as served on /metrics,
+// leaving out the go_*, process_* and http_* metrics about the exporter
+// itself. The vendored client has no Gatherer, so the handler is asked for
+// protobuf and its response decoded.
+func gatherMetricFamilies() ([]*dto.MetricFamily, error) {
+
+	req, err := http.NewRequest("GET", "/metrics", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", string(expfmt.FmtProtoDelim))
+
+	rec := httptest.NewRecorder()
+	prometheus.UninstrumentedHandler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		return nil, fmt.Errorf("Error gathering metrics: %s", strings.TrimSpace(rec.Body.String()))
+	}
+
+	var families []*dto.MetricFamily
+	dec := expfmt.NewDecoder(rec.Body, expfmt.ResponseFormat(rec.HeaderMap))
+	for {
+		mf := &dto.MetricFamily{}
+		if err := dec.Decode(mf); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("Error decoding gathered metrics: %+v", err)
+		}
+
+		if isExporterMetric(mf.GetName()) {
+			continue
+		}
+		families = append(families, mf)
+	}
+
+	return families, nil
+}
+
+func isExporterMetric(name string) bool {
+	for _, prefix := range []string{"go_", "process_", "http_"} {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// targetFamilies returns the series in families that belong to t: those
+// labelled with its target name, or with the hostname and UPS name of its
+// last snapshot. Families left without series are dropped.
+func targetFamilies(families []*dto.MetricFamily, t *target) []*dto.MetricFamily {
+
+	snapshot, _, _ := t.state()
+
+	belongs := func(m *dto.Metric) bool {
+		var hostname, upsName *string
+		for _, label := range m.Label {
+			switch label.GetName() {
+			case "target":
+				return label.GetValue() == t.name
+			case "hostname":
+				hostname = label.Value
+			case "upsname":
+				upsName = label.Value
+			}
+		}
+		return snapshot != nil && hostname != nil && upsName != nil &&
+			*hostname == snapshot.Info.hostname && *upsName == snapshot.Info.upsName
+	}
+
+	var filtered []*dto.MetricFamily
+	for _, mf := range families {
+		var metrics []*dto.Metric
+		for _, m := range mf.Metric {
+			if belongs(m) {
+				metrics = append(metrics, m)
+			}
+		}
+		if len(metrics) > 0 {
+			filtered = append(filtered, &dto.MetricFamily{
+				Name:   mf.Name,
+				Help:   mf.Help,
+				Type:   mf.Type,
+				Metric: metrics,
+			})
+		}
+	}
+
+	return filtered
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func newTestTarget(name string, labels map[string]string, info *upsInfo) *target {
+	t := &target{name: name, labels: labels, lastPoll: time.Now()}
+	if info != nil {
+		t.last = &Snapshot{Info: info, Time: t.lastPoll}
+	}
+	return t
+}
+
+var (
+	registerTestCollector sync.Once
+	testTargets           func() []*target
+)
+
+// setTestTargets makes targets the ones collected by the default registry,
+// for tests of sinks gathering it. Every series carries a site label.
+func setTestTargets(targets ...*target) {
+	setTestTargetsFunc(func() []*target { return targets })
+}
+
+// setTestTargetsFunc makes the default registry collect the targets returned
+// by targets, such as those of a targetManager.
+func setTestTargetsFunc(targets func() []*target) {
+	registerTestCollector.Do(func() {
+		prometheus.MustRegister(&upsCollector{targets: func() []*target { return testTargets() }, labelNames: func() []string { return []string{"site"} }})
+	})
+	testTargets = targets
+}
+
+func TestUPSCollectorDescribesWhatItCollects(t *testing.T) {
+
+	info := &upsInfo{status: "online", hostname: "host", upsName: "ups", outletGroups: map[string]bool{"main": true}}
+	targets := []*target{
+		newTestTarget("a:3551", map[string]string{"site": "dc1"}, info),
+		newTestTarget("b:3551", map[string]string{"rack": "r2"}, info),
+	}
+	c := &upsCollector{
+		targets:    func() []*target { return targets },
+		labelNames: (&config{Targets: []targetConfig{{Labels: targets[0].labels}, {Labels: targets[1].labels}}}).labelNames,
+	}
+
+	described := map[string]bool{}
+	descs := make(chan *prometheus.Desc)
+	go func() {
+		c.Describe(descs)
+		close(descs)
+	}()
+	for desc := range descs {
+		described[desc.String()] = true
+	}
+	if len(described) != len(upsMetrics) {
+		t.Errorf("Described %d descriptors, want %d", len(described), len(upsMetrics))
+	}
+
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(metrics)
+		close(metrics)
+	}()
+
+	series := map[string]bool{}
+	for m := range metrics {
+		if !described[m.Desc().String()] {
+			t.Errorf("Collected metric with undescribed descriptor %s", m.Desc())
+		}
+
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			t.Fatalf("Error writing metric: %+v", err)
+		}
+		var labels []string
+		for _, l := range pb.Label {
+			labels = append(labels, l.GetName()+"="+l.GetValue())
+		}
+		sort.Strings(labels)
+
+		id := m.Desc().String() + strings.Join(labels, ",")
+		if series[id] {
+			t.Errorf("Duplicate series %s", id)
+		}
+		series[id] = true
+	}
+
+	for _, want := range []string{"rack=,site=dc1,target=a:3551", "rack=r2,site=,target=b:3551"} {
+		found := false
+		for id := range series {
+			found = found || strings.Contains(id, want)
+		}
+		if !found {
+			t.Errorf("No series labelled %s", want)
+		}
+	}
+}
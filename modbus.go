@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Register map taken from the APC "Modbus register map for Smart-UPS"
+// application note (990-9840), as used by apcupsd's own modbus driver. Each
+// register is 16 bits; multi-register values are big endian. Scaled values
+// are fixed point numbers with the given count of fractional bits.
+const (
+	regUPSStatus            = 0   // 2 regs, UPSStatus_BF
+	regMainOutletGroup      = 3   // 2 regs, OutletStatus_BF
+	regSwitchedOutletGroup0 = 6   // 2 regs per group, 3 regs apart
+	regSimpleSignaling      = 18  // SimpleSignalingStatus_BF
+	regBatterySystemError   = 22  // BatterySystemError_BF
+	regRuntimeRemaining     = 128 // 2 regs, seconds
+	regStateOfCharge        = 130 // percent, 9 fractional bits
+	regBatteryVoltage       = 131 // volts, signed, 5 fractional bits
+	regBatteryTemperature   = 135 // celsius, signed, 7 fractional bits
+	regOutputRealPower      = 136 // percent, 8 fractional bits
+	regOutputVoltage        = 142 // volts, 6 fractional bits
+	regInputVoltage         = 151 // volts, 6 fractional bits
+	regFirmware             = 516 // 8 regs, string
+	regModel                = 532 // 16 regs, string
+	regSerialNumber         = 564 // 8 regs, string
+	regRealPowerRating      = 589 // watts
+	regName                 = 596 // 8 regs, string
+
+	switchedOutletGroups = 4
+)
+
+// UPSStatus_BF bits
+const (
+	upsStatusOnline    = 1 << 1
+	upsStatusOnBattery = 1 << 2
+	upsStatusBypass    = 1 << 3
+	upsStatusOutputOff = 1 << 4
+	upsStatusOverload  = 1 << 21
+)
+
+const (
+	outletStatusOn = 1 << 0
+
+	simpleSignalingShutdownImminent = 1 << 1
+
+	batteryErrorNeedsReplacement = 1 << 2
+	batteryErrorDisconnected     = 1 << 0
+)
+
+const (
+	modbusReadHoldingRegisters = 0x03
+	modbusMaxRegisters         = 125
+)
+
+var modbusTransactionID uint32
+
+// modbusBlock is a contiguous run of holding registers read in one request.
+type modbusBlock struct {
+	start uint16
+	regs  []uint16
+}
+
+func (b *modbusBlock) uint16(addr uint16) uint16 {
+	return b.regs[addr-b.start]
+}
+
+func (b *modbusBlock) uint32(addr uint16) uint32 {
+	return uint32(b.regs[addr-b.start])<<16 | uint32(b.regs[addr-b.start+1])
+}
+
+// scaled decodes an unsigned fixed point register.
+func (b *modbusBlock) scaled(addr uint16, bits uint) float64 {
+	return float64(b.uint16(addr)) / float64(uint(1)<<bits)
+}
+
+// scaledSigned decodes a two's complement fixed point register.
+func (b *modbusBlock) scaledSigned(addr uint16, bits uint) float64 {
+	return float64(int16(b.uint16(addr))) / float64(uint(1)<<bits)
+}
+
+func (b *modbusBlock) string(addr uint16, count int) string {
+	buf := make([]byte, 0, count*2)
+	for _, r := range b.regs[addr-b.start : int(addr-b.start)+count] {
+		buf = append(buf, byte(r>>8), byte(r))
+	}
+	return strings.TrimSpace(strings.Trim(string(buf), "\x00"))
+}
+
+// readHoldingRegisters issues a single Modbus TCP "read holding registers"
+// request and returns the decoded register values.
+func readHoldingRegisters(conn net.Conn, unitID byte, start, count uint16) (*modbusBlock, error) {
+
+	if count == 0 || count > modbusMaxRegisters {
+		return nil, fmt.Errorf("Invalid register count %d", count)
+	}
+
+	tid := uint16(atomic.AddUint32(&modbusTransactionID, 1))
+
+	req := make([]byte, 12)
+	binary.BigEndian.PutUint16(req[0:], tid)
+	binary.BigEndian.PutUint16(req[2:], 0) // protocol identifier
+	binary.BigEndian.PutUint16(req[4:], 6) // remaining length
+	req[6] = unitID
+	req[7] = modbusReadHoldingRegisters
+	binary.BigEndian.PutUint16(req[8:], start)
+	binary.BigEndian.PutUint16(req[10:], count)
+
+	if _, err := conn.Write(req); err != nil {
+		return nil, fmt.Errorf("Error writing modbus request: %+v", err)
+	}
+
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, fmt.Errorf("Error reading modbus response header: %+v", err)
+	}
+
+	if got := binary.BigEndian.Uint16(header[0:]); got != tid {
+		return nil, fmt.Errorf("Unexpected modbus transaction id %d, expected %d", got, tid)
+	}
+
+	if got := binary.BigEndian.Uint16(header[2:]); got != 0 {
+		return nil, fmt.Errorf("Unexpected modbus protocol id %d", got)
+	}
+
+	// The length covers the unit ID and a PDU of at least a function code
+	// and one more byte, the exception code or the byte count.
+	length := binary.BigEndian.Uint16(header[4:])
+	if length < 3 || length > 256 {
+		return nil, fmt.Errorf("Invalid modbus response length %d", length)
+	}
+
+	pdu := make([]byte, length-1)
+	if _, err := io.ReadFull(conn, pdu); err != nil {
+		return nil, fmt.Errorf("Error reading modbus response: %+v", err)
+	}
+
+	if header[6] != unitID {
+		return nil, fmt.Errorf("Unexpected modbus unit id %d, expected %d", header[6], unitID)
+	}
+
+	if pdu[0] == modbusReadHoldingRegisters|0x80 {
+		return nil, fmt.Errorf("Modbus exception %d reading registers %d-%d", pdu[1], start, start+count-1)
+	}
+
+	if pdu[0] != modbusReadHoldingRegisters || int(pdu[1]) != int(count)*2 || len(pdu) != int(count)*2+2 {
+		return nil, fmt.Errorf("Malformed modbus response for registers %d-%d", start, start+count-1)
+	}
+
+	block := &modbusBlock{start: start, regs: make([]uint16, count)}
+	for i := range block.regs {
+		block.regs[i] = binary.BigEndian.Uint16(pdu[2+i*2:])
+	}
+
+	return block, nil
+}
+
+func init() {
+	registerSource("modbus", func(u *url.URL) (Source, error) {
+		if u.Host == "" {
+			return nil, fmt.Errorf("Missing host in modbus target %q", u)
+		}
+		hostPort := u.Host
+		if u.Port() == "" {
+			hostPort += ":502"
+		}
+
+		unitID := uint64(1)
+		if unit := u.Query().Get("unit"); unit != "" {
+			var err error
+			if unitID, err = strconv.ParseUint(unit, 10, 8); err != nil {
+				return nil, fmt.Errorf("Invalid modbus unit %q in target %q", unit, u)
+			}
+		}
+
+		return &modbusSource{hostPort: hostPort, unitID: byte(unitID)}, nil
+	})
+}
+
+// modbusSource reads a Smart-UPS over Modbus TCP, e.g. modbus://host:502?unit=1
+type modbusSource struct {
+	hostPort string
+	unitID   byte
+}
+
+func (s *modbusSource) Fetch(ctx context.Context) (*Snapshot, error) {
+
+	info, err := retrieveModbusData(ctx, s.hostPort, s.unitID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Snapshot{Info: info, Raw: modbusRawFields(info), Time: time.Now()}, nil
+}
+
+// retrieveModbusData reads the APC register map from a Smart-UPS (or a
+// Modbus TCP gateway in front of one) and decodes it into a upsInfo.
+func retrieveModbusData(ctx context.Context, hostPort string, unitID byte) (*upsInfo, error) {
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", hostPort)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to remote port: %+v", err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err = conn.SetDeadline(deadline); err != nil {
+			return nil, fmt.Errorf("Error setting modbus deadline: %+v", err)
+		}
+	}
+	defer abortOnCancel(ctx, conn)()
+
+	status, err := readHoldingRegisters(conn, unitID, regUPSStatus, regBatterySystemError-regUPSStatus+1)
+	if err != nil {
+		return nil, err
+	}
+
+	dynamic, err := readHoldingRegisters(conn, unitID, regRuntimeRemaining, regInputVoltage-regRuntimeRemaining+1)
+	if err != nil {
+		return nil, err
+	}
+
+	static, err := readHoldingRegisters(conn, unitID, regFirmware, regName+8-regFirmware)
+	if err != nil {
+		return nil, err
+	}
+
+	info := decodeModbusData(status, dynamic, static)
+
+	if info.hostname == "" {
+		if host, _, err := net.SplitHostPort(hostPort); err == nil {
+			info.hostname = host
+		}
+	}
+
+	return info, nil
+}
+
+func decodeModbusData(status, dynamic, static *modbusBlock) *upsInfo {
+
+	info := &upsInfo{}
+
+	info.status = modbusStatus(
+		status.uint32(regUPSStatus),
+		status.uint16(regSimpleSignaling),
+		status.uint16(regBatterySystemError),
+	)
+
+	info.outletGroups = map[string]bool{
+		"main": status.uint32(regMainOutletGroup)&outletStatusOn != 0,
+	}
+	for i := 0; i < switchedOutletGroups; i++ {
+		reg := uint16(regSwitchedOutletGroup0 + i*3)
+		info.outletGroups[fmt.Sprintf("sog%d", i)] = status.uint32(reg)&outletStatusOn != 0
+	}
+
+	info.timeLeft = time.Duration(dynamic.uint32(regRuntimeRemaining)) * time.Second
+	info.batteryChargePercent = dynamic.scaled(regStateOfCharge, 9)
+	info.batteryVoltage = dynamic.scaledSigned(regBatteryVoltage, 5)
+	info.internalTemp = dynamic.scaledSigned(regBatteryTemperature, 7)
+	info.loadPercent = dynamic.scaled(regOutputRealPower, 8)
+	info.outputVoltage = dynamic.scaled(regOutputVoltage, 6)
+	info.lineVoltage = dynamic.scaled(regInputVoltage, 6)
+
+	info.nomPower = float64(static.uint16(regRealPowerRating))
+	info.upsName = static.string(regName, 8)
+	info.model = static.string(regModel, 16)
+	info.serialNumber = static.string(regSerialNumber, 8)
+	info.firmware = static.string(regFirmware, 8)
+
+	return info
+}
+
+// modbusStatus maps the Modbus status bitfields onto the space separated
+// status words apcupsd reports over NIS. A UPS on bypass reports "bypass",
+// and one whose output is switched off "off", since neither is covered by
+// the words of a USB or serial UPS.
+func modbusStatus(upsStatus uint32, signaling, batteryError uint16) string {
+
+	var words []string
+
+	if upsStatus&upsStatusOnline != 0 {
+		words = append(words, "online")
+	}
+	if upsStatus&upsStatusBypass != 0 {
+		words = append(words, "bypass")
+	}
+	if upsStatus&upsStatusOnBattery != 0 {
+		words = append(words, "onbatt")
+	}
+	if upsStatus&upsStatusOverload != 0 {
+		words = append(words, "overload")
+	}
+	if signaling&simpleSignalingShutdownImminent != 0 {
+		words = append(words, "lowbatt")
+	}
+	if batteryError&batteryErrorNeedsReplacement != 0 {
+		words = append(words, "replacebatt")
+	}
+	if batteryError&batteryErrorDisconnected != 0 {
+		words = append(words, "nobatt")
+	}
+	if upsStatus&upsStatusOutputOff != 0 {
+		words = append(words, "off")
+	}
+
+	return strings.Join(words, " ")
+}
+
+// modbusRawFields renders decoded register values under the names and units
+// apcupsd uses, so raw field consumers see the same keys for every backend.
+func modbusRawFields(info *upsInfo) map[string]string {
+
+	raw := map[string]string{
+		"HOSTNAME": info.hostname,
+		"UPSNAME":  info.upsName,
+		"MODEL":    info.model,
+		"SERIALNO": info.serialNumber,
+		"FIRMWARE": info.firmware,
+		"STATUS":   strings.ToUpper(info.status),
+		"BCHARGE":  fmt.Sprintf("%.1f Percent", info.batteryChargePercent),
+		"TIMELEFT": fmt.Sprintf("%.1f Minutes", info.timeLeft.Minutes()),
+		"LOADPCT":  fmt.Sprintf("%.1f Percent", info.loadPercent),
+		"BATTV":    fmt.Sprintf("%.1f Volts", info.batteryVoltage),
+		"LINEV":    fmt.Sprintf("%.1f Volts", info.lineVoltage),
+		"OUTPUTV":  fmt.Sprintf("%.1f Volts", info.outputVoltage),
+		"ITEMP":    fmt.Sprintf("%.1f C", info.internalTemp),
+		"NOMPOWER": fmt.Sprintf("%.0f Watts", info.nomPower),
+	}
+
+	for key, value := range raw {
+		if value == "" {
+			delete(raw, key)
+		}
+	}
+
+	return raw
+}
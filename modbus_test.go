@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// modbusTestServer is an in-process Modbus TCP server answering read
+// holding registers requests from a register map. respond may replace the
+// response to a request, e.g. to inject faults.
+type modbusTestServer struct {
+	listener net.Listener
+	unitID   byte
+	regs     map[uint16]uint16
+	respond  func(req, resp []byte) []byte
+}
+
+func newModbusTestServer(t *testing.T) *modbusTestServer {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %+v", err)
+	}
+
+	s := &modbusTestServer{listener: l, unitID: 1, regs: map[uint16]uint16{}}
+	go s.serve()
+
+	return s
+}
+
+func (s *modbusTestServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *modbusTestServer) Close() error {
+	return s.listener.Close()
+}
+
+func (s *modbusTestServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *modbusTestServer) handle(conn net.Conn) {
+
+	defer conn.Close()
+
+	for {
+		req := make([]byte, 12)
+		if _, err := io.ReadFull(conn, req); err != nil {
+			return
+		}
+
+		start := binary.BigEndian.Uint16(req[8:])
+		count := binary.BigEndian.Uint16(req[10:])
+
+		pdu := []byte{modbusReadHoldingRegisters, byte(count * 2)}
+		for i := uint16(0); i < count; i++ {
+			pdu = append(pdu, byte(s.regs[start+i]>>8), byte(s.regs[start+i]))
+		}
+
+		resp := make([]byte, 7, 7+len(pdu))
+		copy(resp, req[:4])
+		binary.BigEndian.PutUint16(resp[4:], uint16(len(pdu)+1))
+		resp[6] = s.unitID
+		resp = append(resp, pdu...)
+
+		if s.respond != nil {
+			resp = s.respond(req, resp)
+		}
+
+		if _, err := conn.Write(resp); err != nil {
+			return
+		}
+	}
+}
+
+func (s *modbusTestServer) setString(addr uint16, value string) {
+	for i := 0; i < len(value); i += 2 {
+		r := uint16(value[i]) << 8
+		if i+1 < len(value) {
+			r |= uint16(value[i+1])
+		}
+		s.regs[addr+uint16(i/2)] = r
+	}
+}
+
+func (s *modbusTestServer) setUint32(addr uint16, value uint32) {
+	s.regs[addr] = uint16(value >> 16)
+	s.regs[addr+1] = uint16(value)
+}
+
+func TestRetrieveModbusData(t *testing.T) {
+
+	s := newModbusTestServer(t)
+	defer s.Close()
+
+	s.setUint32(regUPSStatus, upsStatusOnBattery)
+	s.setUint32(regMainOutletGroup, outletStatusOn)
+	s.setUint32(regSwitchedOutletGroup0+3, outletStatusOn)
+	s.regs[regBatterySystemError] = batteryErrorNeedsReplacement
+	s.setUint32(regRuntimeRemaining, 1234)
+	s.regs[regStateOfCharge] = 87 << 9
+	s.regs[regBatteryVoltage] = 27<<5 | 16 // 27.5
+	s.regs[regBatteryTemperature] = 0xff00 // -2
+	s.regs[regOutputRealPower] = 25<<8 | 128
+	s.regs[regOutputVoltage] = 230 << 6
+	s.regs[regInputVoltage] = 0
+	s.regs[regRealPowerRating] = 980
+	s.setString(regFirmware, "UPS 09.3")
+	s.setString(regModel, "Smart-UPS 1500")
+	s.setString(regSerialNumber, "AS1234567890")
+	s.setString(regName, "rack1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	info, err := retrieveModbusData(ctx, s.addr(), 1)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	tests := []struct {
+		name      string
+		got, want interface{}
+	}{
+		{"status", info.status, "onbatt replacebatt"},
+		{"timeLeft", info.timeLeft, 1234 * time.Second},
+		{"batteryChargePercent", info.batteryChargePercent, 87.0},
+		{"batteryVoltage", info.batteryVoltage, 27.5},
+		{"internalTemp", info.internalTemp, -2.0},
+		{"loadPercent", info.loadPercent, 25.5},
+		{"outputVoltage", info.outputVoltage, 230.0},
+		{"lineVoltage", info.lineVoltage, 0.0},
+		{"nomPower", info.nomPower, 980.0},
+		{"firmware", info.firmware, "UPS 09.3"},
+		{"model", info.model, "Smart-UPS 1500"},
+		{"serialNumber", info.serialNumber, "AS1234567890"},
+		{"upsName", info.upsName, "rack1"},
+		{"hostname", info.hostname, "127.0.0.1"},
+		{"main outlet", info.outletGroups["main"], true},
+		{"sog0 outlet", info.outletGroups["sog0"], false},
+		{"sog1 outlet", info.outletGroups["sog1"], true},
+	}
+
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("%s = %v, want %v", test.name, test.got, test.want)
+		}
+	}
+}
+
+func TestReadHoldingRegistersFaults(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		respond func(req, resp []byte) []byte
+		err     string
+	}{
+		{
+			name: "exception",
+			respond: func(req, resp []byte) []byte {
+				return append(resp[:4:4], 0, 3, 1, modbusReadHoldingRegisters|0x80, 2)
+			},
+			err: "Modbus exception 2",
+		},
+		{
+			name: "exception without code",
+			respond: func(req, resp []byte) []byte {
+				return append(resp[:4:4], 0, 2, 1, modbusReadHoldingRegisters|0x80)
+			},
+			err: "Invalid modbus response length 2",
+		},
+		{
+			name: "wrong unit id",
+			respond: func(req, resp []byte) []byte {
+				resp[6] = 7
+				return resp
+			},
+			err: "Unexpected modbus unit id 7",
+		},
+		{
+			name: "wrong transaction id",
+			respond: func(req, resp []byte) []byte {
+				resp[1]++
+				return resp
+			},
+			err: "Unexpected modbus transaction id",
+		},
+		{
+			name: "wrong protocol id",
+			respond: func(req, resp []byte) []byte {
+				resp[3] = 1
+				return resp
+			},
+			err: "Unexpected modbus protocol id 1",
+		},
+		{
+			name: "wrong byte count",
+			respond: func(req, resp []byte) []byte {
+				resp[8]--
+				return resp
+			},
+			err: "Malformed modbus response",
+		},
+		{
+			name: "truncated",
+			respond: func(req, resp []byte) []byte {
+				return resp[:len(resp)-1]
+			},
+			err: "Error reading modbus response",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			s := newModbusTestServer(t)
+			defer s.Close()
+			s.respond = test.respond
+
+			conn, err := net.Dial("tcp", s.addr())
+			if err != nil {
+				t.Fatalf("Error connecting: %+v", err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(time.Second))
+
+			_, err = readHoldingRegisters(conn, 1, regUPSStatus, 4)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("Error = %v, want one containing %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestModbusStatus(t *testing.T) {
+
+	tests := []struct {
+		upsStatus    uint32
+		signaling    uint16
+		batteryError uint16
+		want         string
+	}{
+		{upsStatusOnline, 0, 0, "online"},
+		{upsStatusBypass, 0, 0, "bypass"},
+		{upsStatusOnline | upsStatusBypass, 0, 0, "online bypass"},
+		{upsStatusOnBattery, simpleSignalingShutdownImminent, 0, "onbatt lowbatt"},
+		{upsStatusOnline | upsStatusOverload, 0, 0, "online overload"},
+		{upsStatusOnline, 0, batteryErrorNeedsReplacement | batteryErrorDisconnected, "online replacebatt nobatt"},
+		{upsStatusOutputOff, 0, 0, "off"},
+		{upsStatusOnline | upsStatusOutputOff, 0, 0, "online off"},
+		{upsStatusOutputOff | upsStatusOnBattery, 0, 0, "onbatt off"},
+	}
+
+	for _, test := range tests {
+		if got := modbusStatus(test.upsStatus, test.signaling, test.batteryError); got != test.want {
+			t.Errorf("modbusStatus(%#x, %#x, %#x) = %q, want %q", test.upsStatus, test.signaling, test.batteryError, got, test.want)
+		}
+	}
+}
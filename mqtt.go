@@ -0,0 +1,692 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MQTT 3.1.1 control packet types, in the high nibble of the first byte.
+const (
+	mqttConnect    = 1 << 4
+	mqttConnack    = 2 << 4
+	mqttPublish    = 3 << 4
+	mqttPingreq    = 12 << 4
+	mqttDisconnect = 14 << 4
+)
+
+// CONNECT flags
+const (
+	mqttFlagCleanSession = 1 << 1
+	mqttFlagWill         = 1 << 2
+	mqttFlagWillRetain   = 1 << 5
+	mqttFlagPassword     = 1 << 6
+	mqttFlagUsername     = 1 << 7
+)
+
+const (
+	mqttKeepAlive    = 60 * time.Second
+	mqttTimeout      = 10 * time.Second
+	mqttMinBackoff   = time.Second
+	mqttMaxBackoff   = time.Minute
+	mqttOnline       = "online"
+	mqttOffline      = "offline"
+	mqttManufacturer = "APC"
+)
+
+var mqttConnackErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "client identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+// mqttOptions configures the connection to the broker.
+type mqttOptions struct {
+	address   string
+	tlsConfig *tls.Config
+	clientID  string
+	username  string
+	password  string
+
+	// The will is published by the broker when the connection is lost
+	// without a DISCONNECT.
+	willTopic   string
+	willPayload string
+}
+
+// mqttClient is a minimal MQTT 3.1.1 client that publishes at QoS 0, the
+// only thing the exporter needs.
+type mqttClient struct {
+	conn net.Conn
+
+	mtx  sync.Mutex
+	done chan struct{}
+	err  error
+}
+
+// newMQTTOptions parses a broker URL such as mqtt://host:1883 or
+// mqtts://host:8883. TLS is used for mqtts, ssl and tls URLs, verifying the
+// broker against caFile if given and presenting certFile and keyFile as the
+// client certificate if given.
+func newMQTTOptions(brokerURL, caFile, certFile, keyFile string) (*mqttOptions, error) {
+
+	if !strings.Contains(brokerURL, "://") {
+		brokerURL = "mqtt://" + brokerURL
+	}
+
+	u, err := url.Parse(brokerURL)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid MQTT broker URL %q: %+v", brokerURL, err)
+	}
+
+	opts := &mqttOptions{address: u.Host}
+	port := "1883"
+
+	switch u.Scheme {
+	case "mqtt", "tcp":
+	case "mqtts", "ssl", "tls":
+		port = "8883"
+		opts.tlsConfig = &tls.Config{ServerName: u.Hostname()}
+	default:
+		return nil, fmt.Errorf("Unsupported MQTT broker URL scheme %q", u.Scheme)
+	}
+	if u.Port() == "" {
+		opts.address = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	if opts.tlsConfig == nil {
+		if caFile != "" || certFile != "" {
+			return nil, fmt.Errorf("MQTT TLS files given for a plain text broker URL, use mqtts://")
+		}
+		return opts, nil
+	}
+
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read MQTT CA file: %+v", err)
+		}
+		opts.tlsConfig.RootCAs = x509.NewCertPool()
+		if !opts.tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in MQTT CA file %s", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load MQTT client certificate: %+v", err)
+		}
+		opts.tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return opts, nil
+}
+
+// dialMQTT connects to the broker and waits for it to accept the session,
+// giving up once ctx is done.
+func dialMQTT(ctx context.Context, opts *mqttOptions) (*mqttClient, error) {
+
+	dialer := &net.Dialer{Timeout: mqttTimeout, Cancel: ctx.Done()}
+
+	var (
+		conn net.Conn
+		err  error
+	)
+	if opts.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", opts.address, opts.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", opts.address)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting to MQTT broker: %+v", err)
+	}
+
+	var flags byte = mqttFlagCleanSession
+	payload := mqttString(opts.clientID)
+	if opts.willTopic != "" {
+		flags |= mqttFlagWill | mqttFlagWillRetain
+		payload = append(payload, mqttString(opts.willTopic)...)
+		payload = append(payload, mqttString(opts.willPayload)...)
+	}
+	if opts.username != "" {
+		flags |= mqttFlagUsername
+		payload = append(payload, mqttString(opts.username)...)
+		if opts.password != "" {
+			flags |= mqttFlagPassword
+			payload = append(payload, mqttString(opts.password)...)
+		}
+	}
+
+	body := append(mqttString("MQTT"), 4, flags, 0, 0)
+	binary.BigEndian.PutUint16(body[len(body)-2:], uint16(mqttKeepAlive/time.Second))
+	body = append(body, payload...)
+
+	conn.SetDeadline(time.Now().Add(mqttTimeout))
+	defer abortOnCancel(ctx, conn)()
+
+	if _, err := conn.Write(mqttPacket(mqttConnect, body)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Error writing MQTT CONNECT: %+v", err)
+	}
+
+	r := bufio.NewReader(conn)
+	packetType, ack, err := readMQTTPacket(r)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Error reading MQTT CONNACK: %+v", err)
+	}
+	if packetType&0xf0 != mqttConnack || len(ack) != 2 {
+		conn.Close()
+		return nil, fmt.Errorf("Unexpected MQTT packet type %d instead of CONNACK", packetType>>4)
+	}
+	if ack[1] != 0 {
+		conn.Close()
+		reason, ok := mqttConnackErrors[ack[1]]
+		if !ok {
+			reason = "return code " + strconv.Itoa(int(ack[1]))
+		}
+		return nil, fmt.Errorf("MQTT broker refused connection: %s", reason)
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	c := &mqttClient{conn: conn, done: make(chan struct{})}
+	go c.read(r)
+	go c.ping()
+
+	return c, nil
+}
+
+// read consumes what the broker sends, which at QoS 0 without subscriptions
+// is only PINGRESP, until the connection fails.
+func (c *mqttClient) read(r *bufio.Reader) {
+	for {
+		if _, _, err := readMQTTPacket(r); err != nil {
+			c.fail(err)
+			return
+		}
+	}
+}
+
+// ping keeps the session alive while nothing is published.
+func (c *mqttClient) ping() {
+
+	ticker := time.NewTicker(mqttKeepAlive / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.write(mqttPacket(mqttPingreq, nil)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *mqttClient) fail(err error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.err == nil {
+		c.err = err
+		close(c.done)
+		c.conn.Close()
+	}
+}
+
+func (c *mqttClient) write(packet []byte) error {
+
+	c.mtx.Lock()
+	if err := c.err; err != nil {
+		c.mtx.Unlock()
+		return err
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(mqttTimeout))
+	_, err := c.conn.Write(packet)
+	c.mtx.Unlock()
+
+	if err != nil {
+		c.fail(err)
+	}
+	return err
+}
+
+// publish sends payload to topic at QoS 0.
+func (c *mqttClient) publish(topic string, payload []byte, retain bool) error {
+
+	var packetType byte = mqttPublish
+	if retain {
+		packetType |= 1
+	}
+
+	return c.write(mqttPacket(packetType, append(mqttString(topic), payload...)))
+}
+
+// disconnect ends the session cleanly, so the broker does not publish the
+// will.
+func (c *mqttClient) disconnect() {
+	c.write(mqttPacket(mqttDisconnect, nil))
+	c.fail(io.EOF)
+}
+
+func mqttString(s string) []byte {
+	b := make([]byte, 2, 2+len(s))
+	binary.BigEndian.PutUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// mqttPacket frames body with a fixed header.
+func mqttPacket(packetType byte, body []byte) []byte {
+
+	packet := []byte{packetType}
+	length := len(body)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if length == 0 {
+			break
+		}
+	}
+
+	return append(packet, body...)
+}
+
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+
+	packetType, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		if i == 4 {
+			return 0, nil, fmt.Errorf("Malformed MQTT remaining length")
+		}
+		length += int(digit&0x7f) * multiplier
+		multiplier *= 128
+		if digit&0x80 == 0 {
+			break
+		}
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+
+	return packetType, body, nil
+}
+
+// mqttField is a value published on its own topic and announced to Home
+// Assistant as a sensor.
+type mqttField struct {
+	key         string
+	name        string
+	unit        string
+	deviceClass string
+	stateClass  string
+	value       func(info *upsInfo) string
+}
+
+func mqttNumber(f func(info *upsInfo) float64) func(info *upsInfo) string {
+	return func(info *upsInfo) string {
+		return strconv.FormatFloat(f(info), 'f', -1, 64)
+	}
+}
+
+// mqttFields use the names of the JSON API.
+var mqttFields = []mqttField{
+	{"status", "Status", "", "", "", func(info *upsInfo) string { return info.status }},
+	{"battery_charge_percent", "Battery charge", "%", "battery", "measurement", mqttNumber(func(info *upsInfo) float64 { return info.batteryChargePercent })},
+	{"load_percent", "Load", "%", "", "measurement", mqttNumber(func(info *upsInfo) float64 { return info.loadPercent })},
+	{"time_left_seconds", "Time left", "s", "duration", "measurement", mqttNumber(func(info *upsInfo) float64 { return info.timeLeft.Seconds() })},
+	{"time_on_battery_seconds", "Time on battery", "s", "duration", "measurement", mqttNumber(func(info *upsInfo) float64 { return info.timeOnBattery.Seconds() })},
+	{"cum_time_on_battery_seconds", "Total time on battery", "s", "duration", "total_increasing", mqttNumber(func(info *upsInfo) float64 { return info.cumTimeOnBattery.Seconds() })},
+	{"nominal_power_watts", "Nominal power", "W", "power", "", mqttNumber(func(info *upsInfo) float64 { return info.nomPower })},
+	{"battery_volts", "Battery voltage", "V", "voltage", "measurement", mqttNumber(func(info *upsInfo) float64 { return info.batteryVoltage })},
+	{"line_volts", "Line voltage", "V", "voltage", "measurement", mqttNumber(func(info *upsInfo) float64 { return info.lineVoltage })},
+	{"output_volts", "Output voltage", "V", "voltage", "measurement", mqttNumber(func(info *upsInfo) float64 { return info.outputVoltage })},
+	{"internal_temperature_celsius", "Internal temperature", "°C", "temperature", "measurement", mqttNumber(func(info *upsInfo) float64 { return info.internalTemp })},
+	{"num_transfers", "Transfers", "", "", "total_increasing", mqttNumber(func(info *upsInfo) float64 { return info.numTransfers })},
+	{"last_transfer_reason", "Last transfer reason", "", "", "", func(info *upsInfo) string { return info.lastTransferReason }},
+	{"self_test_result", "Self test result", "", "", "", func(info *upsInfo) string { return info.selfTestResult }},
+}
+
+var unsafeMQTTIDChars = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// mqttSink publishes the state of every target to an MQTT broker after each
+// poll: retained topics per field and a JSON state topic under
+// <prefix>/<target>/, and Home Assistant discovery configs so the UPSes show
+// up as devices. The exporter's availability topic is set to offline by the
+// broker when the connection is lost, each target's own availability follows
+// its polls.
+//
+// The connection is kept up in the background, so a broker that cannot be
+// reached never holds up polling. Polls while disconnected are not
+// published.
+type mqttSink struct {
+	opts            *mqttOptions
+	prefix          string
+	discoveryPrefix string
+
+	mtx       sync.Mutex
+	client    *mqttClient
+	announced map[*target]bool
+
+	// attempted is closed once the first connection attempt is over, so
+	// that the first polls, e.g. for --once, are not skipped while it is
+	// still being made.
+	attempted chan struct{}
+	cancel    context.CancelFunc
+	done      chan struct{}
+}
+
+func newMQTTSink(opts *mqttOptions, prefix, discoveryPrefix string) *mqttSink {
+
+	prefix = strings.TrimSuffix(prefix, "/")
+	opts.willTopic = prefix + "/availability/" + opts.clientID
+	opts.willPayload = mqttOffline
+
+	s := &mqttSink{
+		opts:            opts,
+		prefix:          prefix,
+		discoveryPrefix: strings.TrimSuffix(discoveryPrefix, "/"),
+		announced:       map[*target]bool{},
+		attempted:       make(chan struct{}),
+		done:            make(chan struct{}),
+	}
+
+	var ctx context.Context
+	ctx, s.cancel = context.WithCancel(context.Background())
+	go s.run(ctx)
+
+	return s
+}
+
+// run connects to the broker and connects again whenever the connection is
+// lost, backing off exponentially while the broker cannot be reached.
+func (s *mqttSink) run(ctx context.Context) {
+
+	defer close(s.done)
+
+	attempted := false
+	defer func() {
+		if !attempted {
+			close(s.attempted)
+		}
+	}()
+
+	backoff := mqttMinBackoff
+	for {
+		client, err := s.connect(ctx)
+		if !attempted {
+			close(s.attempted)
+			attempted = true
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Error connecting to MQTT broker, retrying in %s: %+v", backoff, err)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > mqttMaxBackoff {
+				backoff = mqttMaxBackoff
+			}
+			continue
+		}
+		backoff = mqttMinBackoff
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-client.done:
+		}
+
+		s.mtx.Lock()
+		if s.client == client {
+			s.client = nil
+		}
+		s.mtx.Unlock()
+		log.Printf("Lost connection to MQTT broker: %+v", client.err)
+	}
+}
+
+// connect dials the broker and makes the connection the one published to.
+// Discovery configs are published again on every new connection.
+func (s *mqttSink) connect(ctx context.Context) (*mqttClient, error) {
+
+	client, err := dialMQTT(ctx, s.opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.publish(s.opts.willTopic, []byte(mqttOnline), true); err != nil {
+		client.fail(err)
+		return nil, err
+	}
+
+	s.mtx.Lock()
+	s.client = client
+	s.announced = map[*target]bool{}
+	s.mtx.Unlock()
+
+	return client, nil
+}
+
+func (s *mqttSink) polled(ctx context.Context, t *target) {
+
+	select {
+	case <-ctx.Done():
+		return
+	case <-s.attempted:
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.client == nil {
+		return
+	}
+
+	if err := s.publishTarget(s.client, t); err != nil {
+		log.Printf("Error publishing %s to MQTT: %+v", t.name, err)
+		// run notices the failed connection and connects again.
+		s.client.fail(err)
+		s.client = nil
+	}
+}
+
+func (s *mqttSink) publishTarget(client *mqttClient, t *target) error {
+
+	snapshot, _, lastErr := t.state()
+	base := s.prefix + "/" + t.slug()
+
+	availability := mqttOnline
+	if lastErr != nil {
+		availability = mqttOffline
+	}
+	if err := client.publish(base+"/availability", []byte(availability), true); err != nil {
+		return err
+	}
+
+	if snapshot == nil {
+		return nil
+	}
+
+	if s.discoveryPrefix != "" && !s.announced[t] {
+		if err := s.announce(client, t, snapshot.Info); err != nil {
+			return err
+		}
+		s.announced[t] = true
+	}
+
+	for _, f := range mqttFields {
+		if err := client.publish(base+"/"+f.key, []byte(f.value(snapshot.Info)), true); err != nil {
+			return err
+		}
+	}
+
+	state, err := json.Marshal(newTargetJSON(t, false))
+	if err != nil {
+		return err
+	}
+
+	return client.publish(base+"/state", state, true)
+}
+
+// mqttDiscoveryConfig is the Home Assistant MQTT discovery payload of a
+// sensor.
+type mqttDiscoveryConfig struct {
+	Name             string               `json:"name"`
+	UniqueID         string               `json:"unique_id"`
+	StateTopic       string               `json:"state_topic"`
+	Unit             string               `json:"unit_of_measurement,omitempty"`
+	DeviceClass      string               `json:"device_class,omitempty"`
+	StateClass       string               `json:"state_class,omitempty"`
+	Availability     []mqttDiscoveryTopic `json:"availability"`
+	AvailabilityMode string               `json:"availability_mode"`
+	Device           mqttDiscoveryDevice  `json:"device"`
+	Origin           mqttDiscoveryOrigin  `json:"origin"`
+}
+
+type mqttDiscoveryTopic struct {
+	Topic string `json:"topic"`
+}
+
+type mqttDiscoveryDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model,omitempty"`
+	SerialNumber string   `json:"serial_number,omitempty"`
+	SWVersion    string   `json:"sw_version,omitempty"`
+}
+
+type mqttDiscoveryOrigin struct {
+	Name string `json:"name"`
+}
+
+// announce publishes a discovery config per field of the target. The device
+// is identified by the UPS serial number where known, so that it keeps its
+// entities when the exporter or target is renamed.
+func (s *mqttSink) announce(client *mqttClient, t *target, info *upsInfo) error {
+
+	deviceID := info.serialNumber
+	if deviceID == "" {
+		deviceID = t.slug()
+	}
+	deviceID = "apcupsd_" + strings.Trim(unsafeMQTTIDChars.ReplaceAllString(deviceID, "_"), "_")
+
+	name := info.upsName
+	if name == "" {
+		name = t.name
+	}
+
+	base := s.prefix + "/" + t.slug()
+	for _, f := range mqttFields {
+		config := mqttDiscoveryConfig{
+			Name:        f.name,
+			UniqueID:    deviceID + "_" + f.key,
+			StateTopic:  base + "/" + f.key,
+			Unit:        f.unit,
+			DeviceClass: f.deviceClass,
+			StateClass:  f.stateClass,
+			Availability: []mqttDiscoveryTopic{
+				{Topic: s.opts.willTopic},
+				{Topic: base + "/availability"},
+			},
+			AvailabilityMode: "all",
+			Device: mqttDiscoveryDevice{
+				Identifiers:  []string{deviceID},
+				Name:         name,
+				Manufacturer: mqttManufacturer,
+				Model:        info.model,
+				SerialNumber: info.serialNumber,
+				SWVersion:    info.firmware,
+			},
+			Origin: mqttDiscoveryOrigin{Name: "apcupsd-exporter"},
+		}
+
+		payload, err := json.Marshal(config)
+		if err != nil {
+			return err
+		}
+
+		topic := fmt.Sprintf("%s/sensor/%s/%s/config", s.discoveryPrefix, deviceID, f.key)
+		if err := client.publish(topic, payload, true); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// forget marks a target that is no longer polled as unavailable. Its
+// discovery configs are kept, so Home Assistant keeps its history.
+func (s *mqttSink) forget(t *target) {
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	delete(s.announced, t)
+
+	if s.client == nil {
+		return
+	}
+	if err := s.client.publish(s.prefix+"/"+t.slug()+"/availability", []byte(mqttOffline), true); err != nil {
+		log.Printf("Error publishing %s to MQTT: %+v", t.name, err)
+	}
+}
+
+// Close stops connecting, marks the exporter as offline and disconnects.
+func (s *mqttSink) Close() error {
+
+	s.cancel()
+	<-s.done
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.client == nil {
+		return nil
+	}
+
+	err := s.client.publish(s.opts.willTopic, []byte(mqttOffline), true)
+	s.client.disconnect()
+	s.client = nil
+
+	return err
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mqttTestBroker is an in-process MQTT 3.1.1 broker keeping the messages
+// published to it, including the wills of connections lost without a
+// DISCONNECT. It answers CONNECT with the connack return code.
+type mqttTestBroker struct {
+	listener net.Listener
+
+	mtx       sync.Mutex
+	connack   byte
+	published map[string]string
+	conns     map[net.Conn]bool
+	connects  int
+	wills     int
+}
+
+func newMQTTTestBroker(t *testing.T) *mqttTestBroker {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %+v", err)
+	}
+
+	b := &mqttTestBroker{listener: l, published: map[string]string{}, conns: map[net.Conn]bool{}}
+	go b.serve()
+
+	return b
+}
+
+func (b *mqttTestBroker) Close() error {
+	b.dropConnections()
+	return b.listener.Close()
+}
+
+func (b *mqttTestBroker) serve() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		go b.handle(conn)
+	}
+}
+
+func (b *mqttTestBroker) handle(conn net.Conn) {
+
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	packetType, body, err := readMQTTPacket(r)
+	if err != nil || packetType&0xf0 != mqttConnect {
+		return
+	}
+	willTopic, willPayload := parseMQTTWill(body)
+
+	b.mtx.Lock()
+	code := b.connack
+	b.connects++
+	b.conns[conn] = true
+	b.mtx.Unlock()
+
+	defer func() {
+		b.mtx.Lock()
+		delete(b.conns, conn)
+		b.mtx.Unlock()
+	}()
+
+	if _, err := conn.Write(mqttPacket(mqttConnack, []byte{0, code})); err != nil || code != 0 {
+		return
+	}
+
+	for {
+		packetType, body, err := readMQTTPacket(r)
+		if err != nil {
+			if willTopic != "" {
+				b.publish(willTopic, willPayload)
+				b.mtx.Lock()
+				b.wills++
+				b.mtx.Unlock()
+			}
+			return
+		}
+
+		switch packetType & 0xf0 {
+		case mqttPublish:
+			length := int(binary.BigEndian.Uint16(body))
+			b.publish(string(body[2:2+length]), string(body[2+length:]))
+		case mqttPingreq:
+			conn.Write([]byte{13 << 4, 0})
+		case mqttDisconnect:
+			return
+		}
+	}
+}
+
+// parseMQTTWill returns the will topic and payload of a CONNECT body.
+func parseMQTTWill(body []byte) (string, string) {
+
+	str := func() string {
+		length := int(binary.BigEndian.Uint16(body))
+		s := string(body[2 : 2+length])
+		body = body[2+length:]
+		return s
+	}
+
+	str() // protocol name
+	flags := body[1]
+	body = body[4:]
+	str() // client identifier
+
+	if flags&mqttFlagWill == 0 {
+		return "", ""
+	}
+	return str(), str()
+}
+
+func (b *mqttTestBroker) publish(topic, payload string) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.published[topic] = payload
+}
+
+func (b *mqttTestBroker) message(topic string) string {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	return b.published[topic]
+}
+
+// dropConnections closes every client connection without a DISCONNECT, as
+// when the broker restarts.
+func (b *mqttTestBroker) dropConnections() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	for conn := range b.conns {
+		conn.Close()
+	}
+}
+
+// counts returns the number of connections accepted and wills published.
+func (b *mqttTestBroker) counts() (int, int) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	return b.connects, b.wills
+}
+
+// waitFor polls cond until it holds or fails the test after 5 seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func newTestMQTTSink(t *testing.T, address string) *mqttSink {
+	opts, err := newMQTTOptions("mqtt://"+address, "", "", "")
+	if err != nil {
+		t.Fatalf("Error parsing options: %+v", err)
+	}
+	opts.clientID = "exporter"
+	return newMQTTSink(opts, "apcupsd/", "homeassistant")
+}
+
+func TestMQTTSinkPublishes(t *testing.T) {
+
+	b := newMQTTTestBroker(t)
+	defer b.Close()
+
+	s := newTestMQTTSink(t, b.listener.Addr().String())
+
+	ups := newTestTarget("ups-host:3551", nil, &upsInfo{status: "online", upsName: "rack1", serialNumber: "AS123", batteryChargePercent: 97})
+	s.polled(context.Background(), ups)
+	waitFor(t, "the state", func() bool { return b.message("apcupsd/ups-host_3551/state") != "" })
+
+	tests := []struct {
+		topic, want string
+	}{
+		{"apcupsd/availability/exporter", "online"},
+		{"apcupsd/ups-host_3551/availability", "online"},
+		{"apcupsd/ups-host_3551/status", "online"},
+		{"apcupsd/ups-host_3551/battery_charge_percent", "97"},
+	}
+	for _, test := range tests {
+		if got := b.message(test.topic); got != test.want {
+			t.Errorf("%s = %q, want %q", test.topic, got, test.want)
+		}
+	}
+
+	var state targetJSON
+	if err := json.Unmarshal([]byte(b.message("apcupsd/ups-host_3551/state")), &state); err != nil || state.Target != "ups-host:3551" {
+		t.Errorf("Unexpected state %q: %v", b.message("apcupsd/ups-host_3551/state"), err)
+	}
+
+	var config mqttDiscoveryConfig
+	if err := json.Unmarshal([]byte(b.message("homeassistant/sensor/apcupsd_AS123/load_percent/config")), &config); err != nil {
+		t.Fatalf("Error decoding discovery config: %+v", err)
+	}
+	if config.StateTopic != "apcupsd/ups-host_3551/load_percent" || config.Device.Name != "rack1" || len(config.Availability) != 2 {
+		t.Errorf("Unexpected discovery config %+v", config)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("Error closing: %+v", err)
+	}
+	waitFor(t, "the exporter to go offline", func() bool { return b.message("apcupsd/availability/exporter") == "offline" })
+}
+
+func TestMQTTSinkReconnects(t *testing.T) {
+
+	b := newMQTTTestBroker(t)
+	defer b.Close()
+
+	s := newTestMQTTSink(t, b.listener.Addr().String())
+	defer s.Close()
+
+	ups := newTestTarget("ups", nil, &upsInfo{status: "online"})
+	s.polled(context.Background(), ups)
+	waitFor(t, "the status", func() bool { return b.message("apcupsd/ups/status") == "online" })
+
+	b.dropConnections()
+	waitFor(t, "the will and a new connection", func() bool {
+		connects, wills := b.counts()
+		return wills == 1 && connects == 2
+	})
+
+	ups.last.Info = &upsInfo{status: "onbatt"}
+	waitFor(t, "a publish on the new connection", func() bool {
+		s.polled(context.Background(), ups)
+		return b.message("apcupsd/ups/status") == "onbatt"
+	})
+}
+
+func TestMQTTSinkSkipsPollsWhileDisconnected(t *testing.T) {
+
+	// A broker that accepts connections but never answers CONNECT.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %+v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	s := newTestMQTTSink(t, l.Addr().String())
+	defer s.Close()
+
+	ups := newTestTarget("ups", nil, &upsInfo{status: "online"})
+
+	// The first poll waits for the first connection attempt, but no longer
+	// than the poll itself may take.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	s.polled(ctx, ups)
+	s.polled(ctx, ups)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Polls took %s while the broker hung", elapsed)
+	}
+}
+
+func TestDialMQTTRefused(t *testing.T) {
+
+	b := newMQTTTestBroker(t)
+	defer b.Close()
+	b.connack = 5
+
+	_, err := dialMQTT(context.Background(), &mqttOptions{address: b.listener.Addr().String(), clientID: "exporter"})
+	if err == nil || !strings.Contains(err.Error(), "not authorized") {
+		t.Errorf("dialMQTT() = %v, want an error saying not authorized", err)
+	}
+}
+
+func TestMQTTPacket(t *testing.T) {
+
+	tests := []struct {
+		length int
+		header []byte
+	}{
+		{0, []byte{mqttPublish, 0}},
+		{127, []byte{mqttPublish, 0x7f}},
+		{128, []byte{mqttPublish, 0x80, 0x01}},
+		{16383, []byte{mqttPublish, 0xff, 0x7f}},
+		{16384, []byte{mqttPublish, 0x80, 0x80, 0x01}},
+	}
+
+	for _, test := range tests {
+		body := bytes.Repeat([]byte{'x'}, test.length)
+		packet := mqttPacket(mqttPublish, body)
+
+		if !bytes.HasPrefix(packet, test.header) || len(packet) != len(test.header)+test.length {
+			t.Errorf("mqttPacket() with %d bytes has header % x, want % x", test.length, packet[:len(test.header)], test.header)
+			continue
+		}
+
+		packetType, got, err := readMQTTPacket(bufio.NewReader(bytes.NewReader(packet)))
+		if err != nil || packetType != mqttPublish || !bytes.Equal(got, body) {
+			t.Errorf("readMQTTPacket() of %d bytes = %d, %d bytes, %v", test.length, packetType, len(got), err)
+		}
+	}
+
+	if _, _, err := readMQTTPacket(bufio.NewReader(bytes.NewReader([]byte{mqttPublish, 0xff, 0xff, 0xff, 0xff, 0x01}))); err == nil {
+		t.Errorf("readMQTTPacket() accepted a remaining length of 5 bytes")
+	}
+}
+
+func TestNewMQTTOptions(t *testing.T) {
+
+	tests := []struct {
+		url     string
+		address string
+		tls     bool
+		err     bool
+	}{
+		{url: "broker", address: "broker:1883"},
+		{url: "mqtt://broker:1884", address: "broker:1884"},
+		{url: "tcp://broker", address: "broker:1883"},
+		{url: "mqtts://broker", address: "broker:8883", tls: true},
+		{url: "ssl://broker:9883", address: "broker:9883", tls: true},
+		{url: "ws://broker", err: true},
+	}
+
+	for _, test := range tests {
+		opts, err := newMQTTOptions(test.url, "", "", "")
+		if (err != nil) != test.err {
+			t.Errorf("newMQTTOptions(%q) = %v, want error %v", test.url, err, test.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if opts.address != test.address || (opts.tlsConfig != nil) != test.tls {
+			t.Errorf("newMQTTOptions(%q) = %s with TLS %v, want %s with TLS %v", test.url, opts.address, opts.tlsConfig != nil, test.address, test.tls)
+		}
+	}
+}
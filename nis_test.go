@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/damomurf/apcupsd-exporter/apcupsdtest"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// collectGauges returns the value of every series c exports, keyed by the
+// metric name and its labels other than target, in order.
+func collectGauges(t *testing.T, c prometheus.Collector) map[string]float64 {
+
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(metrics)
+		close(metrics)
+	}()
+
+	values := map[string]float64{}
+	for m := range metrics {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			t.Fatalf("Error writing metric: %+v", err)
+		}
+
+		name := m.Desc().String()
+		name = name[strings.Index(name, `"`)+1:]
+		name = name[:strings.Index(name, `"`)]
+
+		var labels []string
+		for _, l := range pb.Label {
+			if l.GetName() != "target" {
+				labels = append(labels, l.GetName()+"="+l.GetValue())
+			}
+		}
+		values[name+"{"+strings.Join(labels, ",")+"}"] = pb.GetGauge().GetValue()
+	}
+
+	return values
+}
+
+func TestCollectUPSData(t *testing.T) {
+
+	srv := apcupsdtest.NewServer(apcupsdtest.DefaultStatus()...)
+	defer srv.Close()
+
+	ups, err := newTarget(srv.Addr, "nis")
+	if err != nil {
+		t.Fatalf("Error creating target: %+v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := collectUPSData(ctx, ups); err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	got := collectGauges(t, &upsCollector{targets: func() []*target { return []*target{ups} }, labelNames: func() []string { return nil }})
+
+	id := "hostname=beaker.murf.org,upsname=backups-950"
+	tests := []struct {
+		series string
+		want   float64
+	}{
+		{"apcups_up{}", 1},
+		{"apcups_status{hostname=beaker.murf.org,status=online,upsname=backups-950}", 1},
+		{"apcups_status{hostname=beaker.murf.org,status=onbatt,upsname=backups-950}", 0},
+		{"apcups_status_numeric{" + id + "}", 0},
+		{"apcups_nominal_power_watts{" + id + "}", 480},
+		{"apcups_battery_charge_percent{" + id + "}", 100},
+		{"apcups_load_percent{" + id + "}", 5},
+		{"apcups_time_left_seconds{" + id + "}", float64(float32(104.6)) * 60},
+		{"apcups_time_on_battery_seconds{" + id + "}", 0},
+		{"apcups_battery_volts{" + id + "}", 13.5},
+		{"apcups_line_volts{" + id + "}", 242},
+		{"apcups_nom_battery_volts{" + id + "}", 12},
+		{"apcups_nom_input_volts{" + id + "}", 230},
+	}
+
+	for _, test := range tests {
+		value, ok := got[test.series]
+		if !ok {
+			t.Errorf("Missing series %s", test.series)
+			continue
+		}
+		// Values are parsed as 32 bit floats.
+		if diff := value - test.want; diff > 1e-3 || diff < -1e-3 {
+			t.Errorf("%s = %v, want %v", test.series, value, test.want)
+		}
+	}
+}
+
+func TestRetrieveDataFaults(t *testing.T) {
+
+	tests := []struct {
+		fault   apcupsdtest.Fault
+		delay   time.Duration
+		timeout time.Duration
+		err     string
+	}{
+		{fault: apcupsdtest.NoFault, timeout: time.Second},
+		{fault: apcupsdtest.SlowResponse, delay: time.Millisecond, timeout: 5 * time.Second},
+		{fault: apcupsdtest.SlowResponse, delay: time.Second, timeout: 100 * time.Millisecond, err: "i/o timeout"},
+		{fault: apcupsdtest.DropConnection, timeout: time.Second, err: "Error reading size"},
+		{fault: apcupsdtest.MalformedLength, timeout: time.Second, err: "Error reading data"},
+		{fault: apcupsdtest.NegativeLength, timeout: time.Second, err: "Invalid record length"},
+		{fault: apcupsdtest.TruncatedRecord, timeout: time.Second, err: "Error reading data"},
+		{fault: apcupsdtest.WrongEncoding, timeout: time.Second, err: "not ASCII"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.fault.String(), func(t *testing.T) {
+
+			srv := apcupsdtest.NewServer(apcupsdtest.DefaultStatus()...)
+			defer srv.Close()
+			srv.SetFault(test.fault)
+			srv.SetDelay(test.delay)
+
+			ctx, cancel := context.WithTimeout(context.Background(), test.timeout)
+			defer cancel()
+
+			data, err := retrieveData(ctx, srv.Addr)
+
+			if test.err == "" {
+				if err != nil {
+					t.Fatalf("Unexpected error: %+v", err)
+				}
+				if data["UPSNAME"] != "backups-950" || data["END APC"] == "" {
+					t.Errorf("Unexpected status %v", data)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("Error = %v, want one containing %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestCollectUPSDataError(t *testing.T) {
+
+	srv := apcupsdtest.NewServer(apcupsdtest.DefaultStatus()...)
+	defer srv.Close()
+	srv.SetFault(apcupsdtest.DropConnection)
+
+	ups, err := newTarget(srv.Addr, "nis")
+	if err != nil {
+		t.Fatalf("Error creating target: %+v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := collectUPSData(ctx, ups); err == nil {
+		t.Fatalf("Expected an error from a dropped connection")
+	}
+
+	got := collectGauges(t, &upsCollector{targets: func() []*target { return []*target{ups} }, labelNames: func() []string { return nil }})
+	if len(got) != 1 || got["apcups_up{}"] != 0 {
+		t.Errorf("Collected %v, want only apcups_up 0", got)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Phases of a NIS exchange timed by nisCommand:
+//
+//	dial        connecting to the daemon
+//	write       sending the command
+//	first_byte  waiting from the end of the command to the first byte of the response
+//	full        the whole exchange, from dialling to the end of the response
+var nisPhases = []string{"dial", "write", "first_byte", "full"}
+
+var nisOutcomes = []string{"success", "timeout", "cancelled", "error"}
+
+var nisRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "apcups_nis_request_duration_seconds",
+	Help:    "Time taken by each phase of NIS requests to a target, by outcome",
+	Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+},
+	[]string{"target", "phase", "outcome"},
+)
+
+func init() {
+	prometheus.MustRegister(nisRequestDuration)
+}
+
+// nisObserver is told how long each phase of a NIS exchange took and the
+// error it ended with, if any.
+type nisObserver func(ctx context.Context, phase string, elapsed time.Duration, err error)
+
+type nisObserverKey struct{}
+
+// withNISObserver returns a context that makes nisCommand report the timing
+// of its phases to observe, in the manner of net/http/httptrace.
+func withNISObserver(ctx context.Context, observe nisObserver) context.Context {
+	return context.WithValue(ctx, nisObserverKey{}, observe)
+}
+
+// observeNIS reports a phase to the observer in ctx, if any.
+func observeNIS(ctx context.Context, phase string, start time.Time, err error) {
+	if observe, ok := ctx.Value(nisObserverKey{}).(nisObserver); ok {
+		observe(ctx, phase, time.Now().Sub(start), err)
+	}
+}
+
+// observeNISDuration records NIS phases of target t in nisRequestDuration.
+func observeNISDuration(t *target) nisObserver {
+	return func(ctx context.Context, phase string, elapsed time.Duration, err error) {
+		nisRequestDuration.WithLabelValues(t.name, phase, nisOutcome(ctx, err)).Observe(elapsed.Seconds())
+	}
+}
+
+// forgetNISDuration removes the series of a target that is no longer polled.
+func forgetNISDuration(t *target) {
+	for _, phase := range nisPhases {
+		for _, outcome := range nisOutcomes {
+			nisRequestDuration.DeleteLabelValues(t.name, phase, outcome)
+		}
+	}
+}
+
+func nisOutcome(ctx context.Context, err error) string {
+
+	if err == nil {
+		return "success"
+	}
+
+	switch ctx.Err() {
+	case context.Canceled:
+		return "cancelled"
+	case context.DeadlineExceeded:
+		return "timeout"
+	}
+
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return "timeout"
+	}
+
+	return "error"
+}
+
+// firstByteReader notes when the first byte arrives and keeps the last
+// error from the underlying reader, before readRecords wraps it.
+type firstByteReader struct {
+	r     io.Reader
+	start time.Time
+	ctx   context.Context
+
+	seen bool
+	err  error
+}
+
+func (f *firstByteReader) Read(p []byte) (int, error) {
+
+	n, err := f.r.Read(p)
+	if err != nil {
+		f.err = err
+	}
+
+	if !f.seen && (n > 0 || err != nil) {
+		f.seen = true
+		if n > 0 {
+			observeNIS(f.ctx, "first_byte", f.start, nil)
+		} else {
+			observeNIS(f.ctx, "first_byte", f.start, err)
+		}
+	}
+
+	return n, err
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/damomurf/apcupsd-exporter/apcupsdtest"
+)
+
+// timeoutError is a net.Error reporting a timeout.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var _ net.Error = timeoutError{}
+
+func TestNISOutcome(t *testing.T) {
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want string
+	}{
+		{name: "success", ctx: context.Background(), want: "success"},
+		{name: "cancelled", ctx: cancelled, err: errors.New("use of closed network connection"), want: "cancelled"},
+		{name: "deadline", ctx: expired, err: errors.New("use of closed network connection"), want: "timeout"},
+		{name: "connection deadline", ctx: context.Background(), err: timeoutError{}, want: "timeout"},
+		{name: "refused", ctx: context.Background(), err: errors.New("connection refused"), want: "error"},
+	}
+
+	for _, test := range tests {
+		if got := nisOutcome(test.ctx, test.err); got != test.want {
+			t.Errorf("%s: nisOutcome() = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestNISCommandPhases(t *testing.T) {
+
+	down := apcupsdtest.NewServer()
+	down.Close()
+
+	tests := []struct {
+		name    string
+		fault   apcupsdtest.Fault
+		addr    string
+		timeout time.Duration
+		want    []string
+	}{
+		{name: "success", want: []string{"dial success", "write success", "first_byte success", "full success"}},
+		{name: "refused", addr: down.Addr, want: []string{"dial error", "full error"}},
+		{name: "dropped", fault: apcupsdtest.DropConnection, want: []string{"dial success", "write success", "first_byte error", "full error"}},
+		{name: "slow", fault: apcupsdtest.SlowResponse, timeout: 100 * time.Millisecond, want: []string{"dial success", "write success", "first_byte timeout", "full timeout"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			srv := apcupsdtest.NewServer(apcupsdtest.DefaultStatus()...)
+			defer srv.Close()
+			srv.SetFault(test.fault)
+			srv.SetDelay(time.Second)
+
+			addr := test.addr
+			if addr == "" {
+				addr = srv.Addr
+			}
+			timeout := test.timeout
+			if timeout == 0 {
+				timeout = 5 * time.Second
+			}
+
+			var mtx sync.Mutex
+			var got []string
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			ctx = withNISObserver(ctx, func(ctx context.Context, phase string, elapsed time.Duration, err error) {
+				mtx.Lock()
+				defer mtx.Unlock()
+				got = append(got, phase+" "+nisOutcome(ctx, err))
+			})
+
+			nisCommand(ctx, addr, "status")
+
+			mtx.Lock()
+			defer mtx.Unlock()
+			if strings.Join(got, ", ") != strings.Join(test.want, ", ") {
+				t.Errorf("Observed %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestForgetNISDuration(t *testing.T) {
+
+	ups := &target{name: "forgotten:3551"}
+	observe := observeNISDuration(ups)
+	observe(context.Background(), "full", time.Millisecond, nil)
+	observe(context.Background(), "dial", time.Millisecond, errors.New("connection refused"))
+
+	series := func() int {
+		families, err := gatherMetricFamilies()
+		if err != nil {
+			t.Fatalf("Error gathering: %+v", err)
+		}
+		n := 0
+		for _, mf := range families {
+			if mf.GetName() != "apcups_nis_request_duration_seconds" {
+				continue
+			}
+			for _, m := range mf.Metric {
+				for _, l := range m.Label {
+					if l.GetName() == "target" && l.GetValue() == ups.name {
+						n++
+					}
+				}
+			}
+		}
+		return n
+	}
+
+	if n := series(); n != 2 {
+		t.Fatalf("%d series before forgetting, want 2", n)
+	}
+	forgetNISDuration(ups)
+	if n := series(); n != 0 {
+		t.Errorf("%d series left after forgetting, want none", n)
+	}
+}
@@ -0,0 +1,527 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"golang.org/x/net/http2"
+)
+
+const (
+	otlpAttempts       = 3
+	otlpInitialBackoff = time.Second
+	otlpTimeout        = 10 * time.Second
+
+	otlpGRPCPath = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+	otlpHTTPPath = "/v1/metrics"
+
+	// AGGREGATION_TEMPORALITY_CUMULATIVE
+	otlpCumulative = 2
+)
+
+// gRPC status codes the OTLP specification says to retry on.
+var otlpRetryableGRPCCodes = map[int]bool{
+	1:  true, // CANCELLED
+	4:  true, // DEADLINE_EXCEEDED
+	8:  true, // RESOURCE_EXHAUSTED
+	10: true, // ABORTED
+	11: true, // OUT_OF_RANGE
+	14: true, // UNAVAILABLE
+	15: true, // DATA_LOSS
+}
+
+// otlpUnits maps the unit suffixes of the Prometheus metric names to UCUM
+// units, as used by OpenTelemetry.
+var otlpUnits = []struct {
+	suffix string
+	unit   string
+}{
+	{"_seconds", "s"},
+	{"_percent", "%"},
+	{"_volts", "V"},
+	{"_watts", "W"},
+	{"_celsius", "Cel"},
+}
+
+// The OTLP metrics messages the exporter sends, as defined in
+// opentelemetry/proto/collector/metrics/v1/metrics_service.proto and the
+// files it imports. Only the fields the exporter sets are declared; members
+// of a oneof are declared as plain optional fields, which encode the same.
+type otlpExportMetricsServiceRequest struct {
+	ResourceMetrics []*otlpResourceMetrics `protobuf:"bytes,1,rep,name=resource_metrics"`
+}
+
+func (m *otlpExportMetricsServiceRequest) Reset()         { *m = otlpExportMetricsServiceRequest{} }
+func (m *otlpExportMetricsServiceRequest) String() string { return proto.CompactTextString(m) }
+func (*otlpExportMetricsServiceRequest) ProtoMessage()    {}
+
+type otlpResourceMetrics struct {
+	Resource     *otlpResource       `protobuf:"bytes,1,opt,name=resource"`
+	ScopeMetrics []*otlpScopeMetrics `protobuf:"bytes,2,rep,name=scope_metrics"`
+}
+
+func (m *otlpResourceMetrics) Reset()         { *m = otlpResourceMetrics{} }
+func (m *otlpResourceMetrics) String() string { return proto.CompactTextString(m) }
+func (*otlpResourceMetrics) ProtoMessage()    {}
+
+type otlpResource struct {
+	Attributes []*otlpKeyValue `protobuf:"bytes,1,rep,name=attributes"`
+}
+
+func (m *otlpResource) Reset()         { *m = otlpResource{} }
+func (m *otlpResource) String() string { return proto.CompactTextString(m) }
+func (*otlpResource) ProtoMessage()    {}
+
+type otlpScopeMetrics struct {
+	Scope   *otlpInstrumentationScope `protobuf:"bytes,1,opt,name=scope"`
+	Metrics []*otlpMetric             `protobuf:"bytes,2,rep,name=metrics"`
+}
+
+func (m *otlpScopeMetrics) Reset()         { *m = otlpScopeMetrics{} }
+func (m *otlpScopeMetrics) String() string { return proto.CompactTextString(m) }
+func (*otlpScopeMetrics) ProtoMessage()    {}
+
+type otlpInstrumentationScope struct {
+	Name string `protobuf:"bytes,1,opt,name=name,proto3"`
+}
+
+func (m *otlpInstrumentationScope) Reset()         { *m = otlpInstrumentationScope{} }
+func (m *otlpInstrumentationScope) String() string { return proto.CompactTextString(m) }
+func (*otlpInstrumentationScope) ProtoMessage()    {}
+
+type otlpKeyValue struct {
+	Key   string        `protobuf:"bytes,1,opt,name=key,proto3"`
+	Value *otlpAnyValue `protobuf:"bytes,2,opt,name=value"`
+}
+
+func (m *otlpKeyValue) Reset()         { *m = otlpKeyValue{} }
+func (m *otlpKeyValue) String() string { return proto.CompactTextString(m) }
+func (*otlpKeyValue) ProtoMessage()    {}
+
+type otlpAnyValue struct {
+	StringValue *string `protobuf:"bytes,1,opt,name=string_value"`
+}
+
+func (m *otlpAnyValue) Reset()         { *m = otlpAnyValue{} }
+func (m *otlpAnyValue) String() string { return proto.CompactTextString(m) }
+func (*otlpAnyValue) ProtoMessage()    {}
+
+type otlpMetric struct {
+	Name        string         `protobuf:"bytes,1,opt,name=name,proto3"`
+	Description string         `protobuf:"bytes,2,opt,name=description,proto3"`
+	Unit        string         `protobuf:"bytes,3,opt,name=unit,proto3"`
+	Gauge       *otlpGauge     `protobuf:"bytes,5,opt,name=gauge"`
+	Sum         *otlpSum       `protobuf:"bytes,7,opt,name=sum"`
+	Histogram   *otlpHistogram `protobuf:"bytes,9,opt,name=histogram"`
+}
+
+func (m *otlpMetric) Reset()         { *m = otlpMetric{} }
+func (m *otlpMetric) String() string { return proto.CompactTextString(m) }
+func (*otlpMetric) ProtoMessage()    {}
+
+type otlpGauge struct {
+	DataPoints []*otlpNumberDataPoint `protobuf:"bytes,1,rep,name=data_points"`
+}
+
+func (m *otlpGauge) Reset()         { *m = otlpGauge{} }
+func (m *otlpGauge) String() string { return proto.CompactTextString(m) }
+func (*otlpGauge) ProtoMessage()    {}
+
+type otlpSum struct {
+	DataPoints             []*otlpNumberDataPoint `protobuf:"bytes,1,rep,name=data_points"`
+	AggregationTemporality int32                  `protobuf:"varint,2,opt,name=aggregation_temporality,proto3"`
+	IsMonotonic            bool                   `protobuf:"varint,3,opt,name=is_monotonic,proto3"`
+}
+
+func (m *otlpSum) Reset()         { *m = otlpSum{} }
+func (m *otlpSum) String() string { return proto.CompactTextString(m) }
+func (*otlpSum) ProtoMessage()    {}
+
+type otlpHistogram struct {
+	DataPoints             []*otlpHistogramDataPoint `protobuf:"bytes,1,rep,name=data_points"`
+	AggregationTemporality int32                     `protobuf:"varint,2,opt,name=aggregation_temporality,proto3"`
+}
+
+func (m *otlpHistogram) Reset()         { *m = otlpHistogram{} }
+func (m *otlpHistogram) String() string { return proto.CompactTextString(m) }
+func (*otlpHistogram) ProtoMessage()    {}
+
+type otlpNumberDataPoint struct {
+	StartTimeUnixNano uint64          `protobuf:"fixed64,2,opt,name=start_time_unix_nano,proto3"`
+	TimeUnixNano      uint64          `protobuf:"fixed64,3,opt,name=time_unix_nano,proto3"`
+	AsDouble          *float64        `protobuf:"fixed64,4,opt,name=as_double"`
+	Attributes        []*otlpKeyValue `protobuf:"bytes,7,rep,name=attributes"`
+}
+
+func (m *otlpNumberDataPoint) Reset()         { *m = otlpNumberDataPoint{} }
+func (m *otlpNumberDataPoint) String() string { return proto.CompactTextString(m) }
+func (*otlpNumberDataPoint) ProtoMessage()    {}
+
+type otlpHistogramDataPoint struct {
+	StartTimeUnixNano uint64          `protobuf:"fixed64,2,opt,name=start_time_unix_nano,proto3"`
+	TimeUnixNano      uint64          `protobuf:"fixed64,3,opt,name=time_unix_nano,proto3"`
+	Count             uint64          `protobuf:"fixed64,4,opt,name=count,proto3"`
+	Sum               *float64        `protobuf:"fixed64,5,opt,name=sum"`
+	BucketCounts      []uint64        `protobuf:"fixed64,6,rep,packed,name=bucket_counts"`
+	ExplicitBounds    []float64       `protobuf:"fixed64,7,rep,packed,name=explicit_bounds"`
+	Attributes        []*otlpKeyValue `protobuf:"bytes,9,rep,name=attributes"`
+}
+
+func (m *otlpHistogramDataPoint) Reset()         { *m = otlpHistogramDataPoint{} }
+func (m *otlpHistogramDataPoint) String() string { return proto.CompactTextString(m) }
+func (*otlpHistogramDataPoint) ProtoMessage()    {}
+
+// otlpSink exports the metrics of every target to an OpenTelemetry
+// Collector after each poll, over OTLP/gRPC or OTLP/HTTP with protobuf
+// encoding. Each target is a resource described by the UPS it polls.
+type otlpSink struct {
+	url     string
+	grpc    bool
+	headers map[string]string
+	client  *http.Client
+
+	// start is the start time of the cumulative sums and histograms.
+	start time.Time
+}
+
+// newOTLPSink exports to endpoint, e.g. http://collector:4318 for
+// http/protobuf or http://collector:4317 for grpc. Plain http endpoints are
+// used without TLS, with HTTP/2 prior knowledge for grpc.
+func newOTLPSink(endpoint, protocol string, headers map[string]string) (*otlpSink, error) {
+
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "http://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid OTLP endpoint %q: %+v", endpoint, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("Unsupported OTLP endpoint scheme %q", u.Scheme)
+	}
+
+	s := &otlpSink{headers: headers, start: time.Now()}
+
+	switch protocol {
+	case "grpc":
+		s.grpc = true
+		u.Path = otlpGRPCPath
+		transport := &http2.Transport{}
+		if u.Scheme == "http" {
+			transport.AllowHTTP = true
+			transport.DialTLS = func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return net.DialTimeout(network, addr, otlpTimeout)
+			}
+		}
+		s.client = &http.Client{Transport: transport, Timeout: otlpTimeout}
+	case "http/protobuf":
+		if u.Path == "" || u.Path == "/" {
+			u.Path = otlpHTTPPath
+		}
+		s.client = &http.Client{Timeout: otlpTimeout}
+	default:
+		return nil, fmt.Errorf("Unsupported OTLP protocol %q, expected grpc or http/protobuf", protocol)
+	}
+	s.url = u.String()
+
+	return s, nil
+}
+
+// parseOTLPHeaders parses headers given as key=value pairs separated by
+// commas, as in OTEL_EXPORTER_OTLP_HEADERS.
+func parseOTLPHeaders(s string) (map[string]string, error) {
+
+	headers := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("Invalid OTLP header %q, expected key=value", pair)
+		}
+		value, err := url.QueryUnescape(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid OTLP header %q: %+v", pair, err)
+		}
+		headers[strings.TrimSpace(kv[0])] = value
+	}
+
+	return headers, nil
+}
+
+func (s *otlpSink) polled(ctx context.Context, t *target) {
+
+	snapshot, lastPoll, _ := t.state()
+
+	families, err := gatherMetricFamilies()
+	if err != nil {
+		log.Printf("Error gathering metrics of %s for OTLP: %+v", t.name, err)
+		return
+	}
+
+	resource := map[string]string{
+		"service.name": "apcupsd-exporter",
+		"ups.target":   t.name,
+	}
+	if snapshot != nil {
+		resource["host.name"] = snapshot.Info.hostname
+		resource["ups.name"] = snapshot.Info.upsName
+		resource["ups.model"] = snapshot.Info.model
+		resource["ups.serial"] = snapshot.Info.serialNumber
+	}
+	for name, value := range t.labels {
+		resource[name] = value
+	}
+
+	// The labels now on the resource are left off the data points.
+	omit := map[string]bool{"hostname": true, "upsname": true, "target": true}
+	for name := range t.labels {
+		omit[name] = true
+	}
+
+	req := &otlpExportMetricsServiceRequest{
+		ResourceMetrics: []*otlpResourceMetrics{{
+			Resource: &otlpResource{Attributes: otlpAttributes(resource, nil, nil)},
+			ScopeMetrics: []*otlpScopeMetrics{{
+				Scope:   &otlpInstrumentationScope{Name: "github.com/damomurf/apcupsd-exporter"},
+				Metrics: s.metrics(targetFamilies(families, t), lastPoll, omit),
+			}},
+		}},
+	}
+
+	payload, err := proto.Marshal(req)
+	if err != nil {
+		log.Printf("Error encoding OTLP request for %s: %+v", t.name, err)
+		return
+	}
+
+	backoff := otlpInitialBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := s.export(ctx, payload)
+		if err == nil {
+			return
+		}
+
+		if !retry || attempt == otlpAttempts {
+			log.Printf("Error exporting %s over OTLP, giving up after %d attempts: %+v", t.name, attempt, err)
+			return
+		}
+		log.Printf("Error exporting %s over OTLP, retrying in %s: %+v", t.name, backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// export sends one request, returning whether a failure may be retried.
+func (s *otlpSink) export(ctx context.Context, payload []byte) (bool, error) {
+
+	body := payload
+	if s.grpc {
+		// Length-prefixed message, uncompressed.
+		body = make([]byte, 5+len(payload))
+		binary.BigEndian.PutUint32(body[1:], uint32(len(payload)))
+		copy(body[5:], payload)
+	}
+
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	for name, value := range s.headers {
+		req.Header.Set(name, value)
+	}
+	if s.grpc {
+		req.Header.Set("Content-Type", "application/grpc")
+		req.Header.Set("TE", "trailers")
+	} else {
+		req.Header.Set("Content-Type", "application/x-protobuf")
+	}
+	req.Header.Set("User-Agent", "apcupsd-exporter")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	// The body has to be read to the end for the gRPC trailers to arrive.
+	received, err := io.Copy(ioutil.Discard, resp.Body)
+	if err != nil {
+		return true, fmt.Errorf("Error reading response: %+v", err)
+	}
+
+	if !s.grpc {
+		switch resp.StatusCode {
+		case http.StatusOK:
+			return false, nil
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true, fmt.Errorf("Unexpected status code %d", resp.StatusCode)
+		}
+		return false, fmt.Errorf("Unexpected status code %d", resp.StatusCode)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return true, fmt.Errorf("Unexpected status code %d", resp.StatusCode)
+	}
+
+	// Errors may come in a trailers-only response, with the status in
+	// the headers.
+	status := resp.Trailer.Get("Grpc-Status")
+	grpcMessage := resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status = resp.Header.Get("Grpc-Status")
+		grpcMessage = resp.Header.Get("Grpc-Message")
+	}
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return true, fmt.Errorf("Missing gRPC status in response of %d bytes", received)
+	}
+	if code != 0 {
+		grpcMessage, _ = url.QueryUnescape(grpcMessage)
+		return otlpRetryableGRPCCodes[code], fmt.Errorf("gRPC status %d: %s", code, grpcMessage)
+	}
+
+	return false, nil
+}
+
+// metrics converts metric families to OTLP metrics with a data point each,
+// taken at ts. Counters become monotonic cumulative sums; the unit is taken
+// from the name.
+func (s *otlpSink) metrics(families []*dto.MetricFamily, ts time.Time, omit map[string]bool) []*otlpMetric {
+
+	start := uint64(s.start.UnixNano())
+	now := uint64(ts.UnixNano())
+
+	number := func(m *dto.Metric, value float64) *otlpNumberDataPoint {
+		return &otlpNumberDataPoint{
+			StartTimeUnixNano: start,
+			TimeUnixNano:      now,
+			AsDouble:          &value,
+			Attributes:        otlpAttributes(nil, m.Label, omit),
+		}
+	}
+
+	var metrics []*otlpMetric
+	for _, mf := range families {
+		metric := &otlpMetric{
+			Name:        mf.GetName(),
+			Description: mf.GetHelp(),
+		}
+		for _, u := range otlpUnits {
+			if strings.HasSuffix(metric.Name, u.suffix) {
+				metric.Unit = u.unit
+			}
+		}
+
+		switch mf.GetType() {
+		case dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+			metric.Gauge = &otlpGauge{}
+			for _, m := range mf.Metric {
+				value := m.GetGauge().GetValue()
+				if mf.GetType() == dto.MetricType_UNTYPED {
+					value = m.GetUntyped().GetValue()
+				}
+				metric.Gauge.DataPoints = append(metric.Gauge.DataPoints, number(m, value))
+			}
+		case dto.MetricType_COUNTER:
+			metric.Sum = &otlpSum{AggregationTemporality: otlpCumulative, IsMonotonic: true}
+			for _, m := range mf.Metric {
+				metric.Sum.DataPoints = append(metric.Sum.DataPoints, number(m, m.GetCounter().GetValue()))
+			}
+		case dto.MetricType_HISTOGRAM:
+			metric.Histogram = &otlpHistogram{AggregationTemporality: otlpCumulative}
+			for _, m := range mf.Metric {
+				metric.Histogram.DataPoints = append(metric.Histogram.DataPoints, otlpHistogramPoint(m, start, now, omit))
+			}
+		default:
+			continue
+		}
+
+		metrics = append(metrics, metric)
+	}
+
+	return metrics
+}
+
+// otlpHistogramPoint converts the cumulative buckets of a Prometheus
+// histogram to the per-bucket counts of OTLP.
+func otlpHistogramPoint(m *dto.Metric, start, now uint64, omit map[string]bool) *otlpHistogramDataPoint {
+
+	h := m.GetHistogram()
+	sum := h.GetSampleSum()
+
+	point := &otlpHistogramDataPoint{
+		StartTimeUnixNano: start,
+		TimeUnixNano:      now,
+		Count:             h.GetSampleCount(),
+		Sum:               &sum,
+		Attributes:        otlpAttributes(nil, m.Label, omit),
+	}
+
+	var previous uint64
+	for _, b := range h.Bucket {
+		if math.IsInf(b.GetUpperBound(), +1) {
+			break
+		}
+		point.ExplicitBounds = append(point.ExplicitBounds, b.GetUpperBound())
+		point.BucketCounts = append(point.BucketCounts, b.GetCumulativeCount()-previous)
+		previous = b.GetCumulativeCount()
+	}
+	point.BucketCounts = append(point.BucketCounts, h.GetSampleCount()-previous)
+
+	return point
+}
+
+// otlpAttributes returns attrs and the labels not in omit as attributes,
+// leaving out empty values.
+func otlpAttributes(attrs map[string]string, labels []*dto.LabelPair, omit map[string]bool) []*otlpKeyValue {
+
+	var kvs []*otlpKeyValue
+	add := func(key, value string) {
+		if value == "" {
+			return
+		}
+		kvs = append(kvs, &otlpKeyValue{Key: key, Value: &otlpAnyValue{StringValue: &value}})
+	}
+
+	keys := make([]string, 0, len(attrs))
+	for key := range attrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		add(key, attrs[key])
+	}
+
+	for _, l := range labels {
+		if omit[l.GetName()] {
+			continue
+		}
+		add(l.GetName(), l.GetValue())
+	}
+
+	return kvs
+}
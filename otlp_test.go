@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"golang.org/x/net/http2"
+)
+
+func TestOTLPEncoding(t *testing.T) {
+
+	fixed64 := func(tag byte, v uint64) []byte {
+		b := make([]byte, 9)
+		b[0] = tag
+		binary.LittleEndian.PutUint64(b[1:], v)
+		return b
+	}
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+
+	value, sum := 1.5, 0.25
+	attribute := []byte{0x0a, 1, 'a', 0x12, 3, 0x0a, 1, 'b'}
+
+	tests := []struct {
+		name string
+		msg  proto.Message
+		want []byte
+	}{
+		{
+			name: "number data point",
+			msg: &otlpNumberDataPoint{
+				StartTimeUnixNano: 1,
+				TimeUnixNano:      2,
+				AsDouble:          &value,
+				Attributes:        otlpAttributes(map[string]string{"a": "b"}, nil, nil),
+			},
+			want: join(fixed64(0x11, 1), fixed64(0x19, 2), fixed64(0x21, math.Float64bits(1.5)), []byte{0x3a, 8}, attribute),
+		},
+		{
+			name: "histogram data point",
+			msg: &otlpHistogramDataPoint{
+				Count:          3,
+				Sum:            &sum,
+				BucketCounts:   []uint64{1, 2},
+				ExplicitBounds: []float64{0.5},
+			},
+			want: join(fixed64(0x21, 3), fixed64(0x29, math.Float64bits(0.25)),
+				[]byte{0x32, 16}, fixed64(0, 1)[1:], fixed64(0, 2)[1:],
+				[]byte{0x3a, 8}, fixed64(0, math.Float64bits(0.5))[1:]),
+		},
+		{
+			name: "cumulative monotonic sum",
+			msg:  &otlpSum{AggregationTemporality: otlpCumulative, IsMonotonic: true},
+			want: []byte{0x10, 2, 0x18, 1},
+		},
+		{
+			name: "metric",
+			msg:  &otlpMetric{Name: "up", Unit: "s", Gauge: &otlpGauge{}},
+			want: []byte{0x0a, 2, 'u', 'p', 0x1a, 1, 's', 0x2a, 0},
+		},
+	}
+
+	for _, test := range tests {
+		got, err := proto.Marshal(test.msg)
+		if err != nil {
+			t.Errorf("%s: error encoding: %+v", test.name, err)
+			continue
+		}
+		if !bytes.Equal(got, test.want) {
+			t.Errorf("%s: encoded as % x, want % x", test.name, got, test.want)
+		}
+	}
+}
+
+func TestOTLPMetrics(t *testing.T) {
+
+	label := func(name, value string) *dto.LabelPair {
+		return &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)}
+	}
+
+	families := []*dto.MetricFamily{
+		{
+			Name:   proto.String("apcups_battery_volts"),
+			Help:   proto.String("Battery voltage"),
+			Type:   dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{Label: []*dto.LabelPair{label("target", "ups"), label("phase", "1")}, Gauge: &dto.Gauge{Value: proto.Float64(13.5)}}},
+		},
+		{
+			Name:   proto.String("apcups_events_total"),
+			Type:   dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{{Counter: &dto.Counter{Value: proto.Float64(4)}}},
+		},
+		{
+			Name: proto.String("apcups_nis_request_duration_seconds"),
+			Type: dto.MetricType_HISTOGRAM.Enum(),
+			Metric: []*dto.Metric{{Histogram: &dto.Histogram{
+				SampleCount: proto.Uint64(5),
+				SampleSum:   proto.Float64(0.3),
+				Bucket: []*dto.Bucket{
+					{UpperBound: proto.Float64(0.01), CumulativeCount: proto.Uint64(2)},
+					{UpperBound: proto.Float64(0.1), CumulativeCount: proto.Uint64(4)},
+					{UpperBound: proto.Float64(math.Inf(+1)), CumulativeCount: proto.Uint64(5)},
+				},
+			}}},
+		},
+		{
+			Name:   proto.String("apcups_latency_seconds"),
+			Type:   dto.MetricType_SUMMARY.Enum(),
+			Metric: []*dto.Metric{{Summary: &dto.Summary{}}},
+		},
+	}
+
+	s := &otlpSink{start: time.Unix(100, 0)}
+	metrics := s.metrics(families, time.Unix(200, 0), map[string]bool{"target": true})
+
+	if len(metrics) != 3 {
+		t.Fatalf("Got %d metrics, want 3 without the summary", len(metrics))
+	}
+
+	volts := metrics[0]
+	if volts.Unit != "V" || volts.Description != "Battery voltage" || volts.Gauge == nil || len(volts.Gauge.DataPoints) != 1 {
+		t.Fatalf("Unexpected gauge %v", volts)
+	}
+	point := volts.Gauge.DataPoints[0]
+	if *point.AsDouble != 13.5 || point.StartTimeUnixNano != 100e9 || point.TimeUnixNano != 200e9 {
+		t.Errorf("Unexpected gauge point %v", point)
+	}
+	if len(point.Attributes) != 1 || point.Attributes[0].Key != "phase" {
+		t.Errorf("Gauge point has attributes %v, want only phase", point.Attributes)
+	}
+
+	if events := metrics[1]; events.Sum == nil || !events.Sum.IsMonotonic || events.Sum.AggregationTemporality != otlpCumulative || *events.Sum.DataPoints[0].AsDouble != 4 {
+		t.Errorf("Unexpected sum %v", events)
+	}
+
+	histogram := metrics[2].Histogram.DataPoints[0]
+	if got := histogram.BucketCounts; len(got) != 3 || got[0] != 2 || got[1] != 2 || got[2] != 1 {
+		t.Errorf("Bucket counts %v, want [2 2 1]", got)
+	}
+	if got := histogram.ExplicitBounds; len(got) != 2 || got[0] != 0.01 || got[1] != 0.1 {
+		t.Errorf("Bounds %v, want [0.01 0.1]", got)
+	}
+	if metrics[2].Unit != "s" || histogram.Count != 5 || *histogram.Sum != 0.3 {
+		t.Errorf("Unexpected histogram %v", metrics[2])
+	}
+}
+
+// serveH2C serves handler over HTTP/2 without TLS, as gRPC collectors do
+// on plain http endpoints.
+func serveH2C(t *testing.T, handler http.Handler) net.Listener {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %+v", err)
+	}
+
+	go func() {
+		server := &http2.Server{}
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go server.ServeConn(conn, &http2.ServeConnOpts{Handler: handler})
+		}
+	}()
+
+	return l
+}
+
+func TestOTLPExportGRPC(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		body     int
+		status   string
+		inHeader bool
+		retry    bool
+		err      string
+	}{
+		{name: "ok", status: "0"},
+		{name: "ok after a large body", body: 10000, status: "0"},
+		{name: "unavailable", status: "14", retry: true, err: "gRPC status 14: try later"},
+		{name: "invalid argument", status: "3", err: "gRPC status 3"},
+		{name: "trailers only", status: "8", inHeader: true, retry: true, err: "gRPC status 8"},
+		{name: "no status", retry: true, err: "Missing gRPC status"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			var received otlpExportMetricsServiceRequest
+			l := serveH2C(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				if r.URL.Path != otlpGRPCPath || r.Header.Get("Content-Type") != "application/grpc" || r.Header.Get("Authorization") != "Bearer x" {
+					t.Errorf("Unexpected request %s %v", r.URL.Path, r.Header)
+				}
+				if len(body) < 5 || int(binary.BigEndian.Uint32(body[1:])) != len(body)-5 {
+					t.Errorf("Body of %d bytes is not a single length-prefixed message", len(body))
+				} else if err := proto.Unmarshal(body[5:], &received); err != nil {
+					t.Errorf("Error decoding request: %+v", err)
+				}
+
+				if test.inHeader {
+					w.Header().Set("Grpc-Status", test.status)
+					w.WriteHeader(http.StatusOK)
+					return
+				}
+				w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+				w.WriteHeader(http.StatusOK)
+				w.Write(bytes.Repeat([]byte{0}, test.body))
+				if test.status != "" {
+					w.Header().Set("Grpc-Status", test.status)
+					w.Header().Set("Grpc-Message", "try%20later")
+				}
+			}))
+			defer l.Close()
+
+			s, err := newOTLPSink(l.Addr().String(), "grpc", map[string]string{"Authorization": "Bearer x"})
+			if err != nil {
+				t.Fatalf("Error creating sink: %+v", err)
+			}
+
+			payload, _ := proto.Marshal(&otlpExportMetricsServiceRequest{ResourceMetrics: []*otlpResourceMetrics{{
+				Resource: &otlpResource{Attributes: otlpAttributes(map[string]string{"ups.target": "ups"}, nil, nil)},
+			}}})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			retry, err := s.export(ctx, payload)
+
+			if test.err == "" && err != nil {
+				t.Fatalf("Unexpected error: %+v", err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Errorf("Error = %v, want one containing %q", err, test.err)
+			}
+			if retry != test.retry {
+				t.Errorf("retry = %v, want %v", retry, test.retry)
+			}
+			if len(received.ResourceMetrics) != 1 {
+				t.Errorf("Collector received %v", received)
+			}
+		})
+	}
+}
+
+func TestOTLPExportHTTP(t *testing.T) {
+
+	tests := []struct {
+		status int
+		retry  bool
+		err    bool
+	}{
+		{status: http.StatusOK},
+		{status: http.StatusServiceUnavailable, retry: true, err: true},
+		{status: http.StatusTooManyRequests, retry: true, err: true},
+		{status: http.StatusBadRequest, err: true},
+	}
+
+	for _, test := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != otlpHTTPPath || r.Header.Get("Content-Type") != "application/x-protobuf" {
+				t.Errorf("Unexpected request %s %v", r.URL.Path, r.Header)
+			}
+			w.WriteHeader(test.status)
+		}))
+
+		s, err := newOTLPSink(srv.URL, "http/protobuf", nil)
+		if err != nil {
+			t.Fatalf("Error creating sink: %+v", err)
+		}
+
+		retry, err := s.export(context.Background(), []byte{})
+		if (err != nil) != test.err || retry != test.retry {
+			t.Errorf("Status %d: export() = %v, %v, want retry %v and error %v", test.status, retry, err, test.retry, test.err)
+		}
+
+		srv.Close()
+	}
+}
+
+func TestParseOTLPHeaders(t *testing.T) {
+
+	tests := []struct {
+		in   string
+		want map[string]string
+		err  bool
+	}{
+		{in: "", want: map[string]string{}},
+		{in: "api-key=secret, X-Scope-OrgID = tenant1", want: map[string]string{"api-key": "secret", "X-Scope-OrgID": "tenant1"}},
+		{in: "Authorization=Bearer%20abc", want: map[string]string{"Authorization": "Bearer abc"}},
+		{in: "novalue", err: true},
+		{in: "=value", err: true},
+	}
+
+	for _, test := range tests {
+		got, err := parseOTLPHeaders(test.in)
+		if (err != nil) != test.err {
+			t.Errorf("parseOTLPHeaders(%q) = %v, want error %v", test.in, err, test.err)
+			continue
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("parseOTLPHeaders(%q) = %v, want %v", test.in, got, test.want)
+		}
+		for k, v := range test.want {
+			if got[k] != v {
+				t.Errorf("parseOTLPHeaders(%q)[%s] = %q, want %q", test.in, k, got[k], v)
+			}
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// sink is handed every target after each poll, successful or not, e.g. to
+// push its state elsewhere. polled is called from the target's poller
+// goroutine with a context that ends one poll timeout after the sinks are
+// handed the target, shared by all sinks, so it must not block past it.
+//
+// Sinks holding state per target implement forgettingSink, and sinks with
+// buffered data implement io.Closer to flush it on shutdown.
+type sink interface {
+	polled(ctx context.Context, t *target)
+}
+
+// forgettingSink is implemented by sinks that need to know when a target is
+// no longer polled.
+type forgettingSink interface {
+	forget(t *target)
+}
+
+// targetManager runs a poller for every configured target and starts and
+// stops them as the configuration changes.
+type targetManager struct {
+	// ctx is the parent of every poller's context; cancelling it stops all
+	// polling and aborts polls in flight.
+	ctx            context.Context
+	recordDir      string
+	recordMaxBytes int64
+	sinks          []sink
+
+	mtx     sync.RWMutex
+	pollers []*poller
+
+	// labelNames are the configured label names every series carries.
+	labelNames []string
+}
+
+// poller polls a single target until it is stopped.
+type poller struct {
+	target *target
+	config targetConfig
+	sinks  []sink
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// targets returns the currently polled targets in configuration order.
+func (m *targetManager) targets() []*target {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	targets := make([]*target, len(m.pollers))
+	for i, p := range m.pollers {
+		targets[i] = p.target
+	}
+	return targets
+}
+
+// configuredLabelNames returns the label names set on any current target.
+func (m *targetManager) configuredLabelNames() []string {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	return m.labelNames
+}
+
+// apply makes the running pollers match cfg. Targets whose configuration is
+// unchanged keep polling with their state intact, changed targets are
+// restarted. Nothing is changed if any new target cannot be created.
+//
+// The lock is only held to swap the pollers: a sink of a poller being
+// stopped may be gathering the registry, which lists the targets.
+func (m *targetManager) apply(cfg *config) error {
+
+	m.mtx.Lock()
+
+	running := map[string]*poller{}
+	for _, p := range m.pollers {
+		running[p.config.Name] = p
+	}
+
+	var (
+		pollers []*poller
+		started []*poller
+		stopped []*poller
+		kept    = map[*poller]bool{}
+	)
+	for _, tc := range cfg.Targets {
+		if p, ok := running[tc.Name]; ok && reflect.DeepEqual(p.config, tc) {
+			pollers = append(pollers, p)
+			kept[p] = true
+			continue
+		}
+
+		t, err := m.newTarget(tc)
+		if err != nil {
+			m.mtx.Unlock()
+			return err
+		}
+
+		p := &poller{target: t, config: tc, sinks: m.sinks, done: make(chan struct{})}
+		p.target.startPolling(time.Now())
+		pollers = append(pollers, p)
+		started = append(started, p)
+	}
+
+	for _, p := range m.pollers {
+		if !kept[p] {
+			stopped = append(stopped, p)
+		}
+	}
+
+	// The new pollers can be stopped before they run, by stopAll, which
+	// then waits for run to notice they were cancelled.
+	contexts := make([]context.Context, len(started))
+	for i, p := range started {
+		contexts[i], p.cancel = context.WithCancel(m.ctx)
+	}
+
+	m.pollers = pollers
+	m.labelNames = cfg.labelNames()
+	m.mtx.Unlock()
+
+	// Sinks forget targets by name, so a changed target is stopped before
+	// it is started again.
+	for _, p := range stopped {
+		log.Printf("Stopping poller for %s", p.target.name)
+		p.stop()
+	}
+
+	for i, p := range started {
+		log.Printf("Connection to UPS at: %s", p.target.name)
+		go p.run(contexts[i])
+	}
+
+	return nil
+}
+
+// newTarget creates a target and sets up its recording, if enabled.
+func (m *targetManager) newTarget(tc targetConfig) (*target, error) {
+
+	t, err := newConfiguredTarget(tc)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.recordDir != "" {
+		if rs, ok := t.source.(recordableSource); ok {
+			r, err := newRecorder(m.recordDir, t.name, m.recordMaxBytes)
+			if err != nil {
+				return nil, err
+			}
+			rs.recordTo(r)
+			log.Printf("Recording responses from %s to %s", t.name, r.dir)
+		}
+	}
+
+	return t, nil
+}
+
+// pollOnce polls every target of cfg once, concurrently, hands them all to
+// the sinks and flushes those, for --once. It returns the number of targets
+// that could not be polled.
+func (m *targetManager) pollOnce(cfg *config) int {
+
+	var pollers []*poller
+	for _, tc := range cfg.Targets {
+		t, err := m.newTarget(tc)
+		if err != nil {
+			log.Printf("Error configuring UPS target %s: %+v", tc.Name, err)
+			return len(cfg.Targets)
+		}
+		pollers = append(pollers, &poller{target: t, config: tc, sinks: m.sinks})
+	}
+
+	m.mtx.Lock()
+	m.pollers = pollers
+	m.labelNames = cfg.labelNames()
+	m.mtx.Unlock()
+
+	var (
+		wg     sync.WaitGroup
+		failed = make(chan struct{}, len(pollers))
+	)
+	for _, p := range pollers {
+		wg.Add(1)
+		go func(t *target) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(m.ctx, t.timeout)
+			defer cancel()
+
+			if err := collectUPSData(ctx, t); err != nil {
+				log.Printf("Error collecting UPS data from %s: %+v", t.name, err)
+				failed <- struct{}{}
+			}
+		}(p.target)
+	}
+	wg.Wait()
+
+	for _, p := range pollers {
+		p.handToSinks(m.ctx)
+	}
+	m.closeSinks()
+
+	return len(failed)
+}
+
+// stopAll stops every poller, waiting for polls in flight to give up, closes
+// their sources and flushes the sinks. As in apply, the lock is released
+// before waiting for sinks, which may gather the registry.
+func (m *targetManager) stopAll() {
+	m.mtx.Lock()
+	pollers := m.pollers
+	m.pollers = nil
+	m.mtx.Unlock()
+
+	for _, p := range pollers {
+		p.stop()
+	}
+
+	m.closeSinks()
+}
+
+func (m *targetManager) closeSinks() {
+	for _, s := range m.sinks {
+		if c, ok := s.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				log.Printf("Error closing %T: %+v", s, err)
+			}
+		}
+	}
+}
+
+func (p *poller) run(ctx context.Context) {
+
+	defer close(p.done)
+
+	ticker := time.NewTicker(p.target.interval)
+	defer ticker.Stop()
+
+	for {
+		pollCtx, cancel := context.WithTimeout(ctx, p.target.timeout)
+		if err := collectUPSData(pollCtx, p.target); err != nil && ctx.Err() == nil {
+			log.Printf("Error collecting UPS data from %s: %+v", p.target.name, err)
+		}
+		cancel()
+
+		if ctx.Err() == nil {
+			p.handToSinks(ctx)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// handToSinks hands the target to every sink. A sink retrying a failing
+// push must not keep the poller from its next poll, or from being stopped.
+func (p *poller) handToSinks(ctx context.Context) {
+
+	ctx, cancel := context.WithTimeout(ctx, p.target.timeout)
+	defer cancel()
+
+	for _, s := range p.sinks {
+		s.polled(ctx, p.target)
+	}
+}
+
+// stop cancels the poller, waits for an outstanding poll to give up and
+// releases the target's source.
+func (p *poller) stop() {
+	p.cancel()
+	<-p.done
+
+	forgetNISDuration(p.target)
+	for _, s := range p.sinks {
+		if f, ok := s.(forgettingSink); ok {
+			f.forget(p.target)
+		}
+	}
+
+	if c, ok := p.target.source.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			log.Printf("Error closing %s: %+v", p.target.name, err)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/damomurf/apcupsd-exporter/apcupsdtest"
+)
+
+// recordingSink counts the polls of every target and the targets forgotten.
+type recordingSink struct {
+	mtx       sync.Mutex
+	polls     map[string]int
+	forgotten []string
+}
+
+func (s *recordingSink) polled(ctx context.Context, t *target) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.polls[t.name]++
+}
+
+func (s *recordingSink) forget(t *target) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.forgotten = append(s.forgotten, t.name)
+}
+
+func (s *recordingSink) count(name string) int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.polls[name]
+}
+
+// gatheringSink gathers the default registry once the poll's context is
+// cancelled, as the push and textfile sinks do when a poller is stopped in
+// the middle of a poll.
+type gatheringSink struct {
+	entered chan struct{}
+}
+
+func (s *gatheringSink) polled(ctx context.Context, t *target) {
+	select {
+	case s.entered <- struct{}{}:
+	default:
+	}
+	<-ctx.Done()
+	gatherMetricFamilies()
+}
+
+// deadlineSink records how long the sinks were given after each poll.
+type deadlineSink struct {
+	mtx    sync.Mutex
+	budget []time.Duration
+}
+
+func (s *deadlineSink) polled(ctx context.Context, t *target) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		s.budget = append(s.budget, time.Until(deadline))
+	} else {
+		s.budget = append(s.budget, -1)
+	}
+}
+
+func (s *deadlineSink) budgets() []time.Duration {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return append([]time.Duration{}, s.budget...)
+}
+
+func TestPollerBoundsSinks(t *testing.T) {
+
+	srv := apcupsdtest.NewServer(apcupsdtest.DefaultStatus()...)
+	defer srv.Close()
+
+	tests := []struct {
+		name     string
+		interval time.Duration
+		timeout  time.Duration
+		once     bool
+	}{
+		{name: "timeout", interval: time.Hour, timeout: 2 * time.Second},
+		{name: "timeout of the interval", interval: 5 * time.Second, timeout: 5 * time.Second},
+		{name: "once", interval: time.Hour, timeout: 2 * time.Second, once: true},
+	}
+
+	for _, test := range tests {
+		s := &deadlineSink{}
+		m := &targetManager{ctx: context.Background(), sinks: []sink{s}}
+		cfg := &config{Targets: []targetConfig{{Name: "ups", Address: srv.Addr, Backend: "nis", Interval: test.interval, Timeout: test.timeout}}}
+
+		if test.once {
+			m.pollOnce(cfg)
+		} else {
+			if err := m.apply(cfg); err != nil {
+				t.Fatalf("%s: error applying: %+v", test.name, err)
+			}
+			waitFor(t, test.name+": a poll", func() bool { return len(s.budgets()) > 0 })
+			m.stopAll()
+		}
+
+		budgets := s.budgets()
+		if len(budgets) == 0 || budgets[0] <= 0 || budgets[0] > test.timeout {
+			t.Errorf("%s: sinks given %v, want at most the %s timeout", test.name, budgets, test.timeout)
+		}
+	}
+}
+
+func TestTargetManagerApply(t *testing.T) {
+
+	srv := apcupsdtest.NewServer(apcupsdtest.DefaultStatus()...)
+	defer srv.Close()
+
+	configured := func(name string, interval time.Duration) targetConfig {
+		return targetConfig{Name: name, Address: srv.Addr, Backend: "nis", Interval: interval, Timeout: interval, Labels: map[string]string{}}
+	}
+
+	s := &recordingSink{polls: map[string]int{}}
+	m := &targetManager{ctx: context.Background(), sinks: []sink{s}}
+	defer m.stopAll()
+
+	tests := []struct {
+		name      string
+		targets   []targetConfig
+		kept      []string
+		forgotten []string
+	}{
+		{
+			name:    "start",
+			targets: []targetConfig{configured("a", time.Hour), configured("b", time.Hour), configured("c", time.Hour)},
+		},
+		{
+			name:      "change b and remove c",
+			targets:   []targetConfig{configured("a", time.Hour), configured("b", 30*time.Minute)},
+			kept:      []string{"a"},
+			forgotten: []string{"b", "c"},
+		},
+		{
+			name:    "unchanged",
+			targets: []targetConfig{configured("b", 30*time.Minute), configured("a", time.Hour)},
+			kept:    []string{"a", "b"},
+		},
+	}
+
+	for _, test := range tests {
+		before := map[string]*target{}
+		for _, ups := range m.targets() {
+			before[ups.name] = ups
+		}
+		s.forgotten = nil
+
+		if err := m.apply(&config{Targets: test.targets}); err != nil {
+			t.Fatalf("%s: error applying: %+v", test.name, err)
+		}
+
+		targets := m.targets()
+		if len(targets) != len(test.targets) {
+			t.Fatalf("%s: %d targets polled, want %d", test.name, len(targets), len(test.targets))
+		}
+
+		kept := map[string]bool{}
+		for _, name := range test.kept {
+			kept[name] = true
+		}
+		for i, ups := range targets {
+			if ups.name != test.targets[i].Name {
+				t.Errorf("%s: target %d is %s, want %s", test.name, i, ups.name, test.targets[i].Name)
+			}
+			if (before[ups.name] == ups) != kept[ups.name] {
+				t.Errorf("%s: target %s kept %v, want %v", test.name, ups.name, before[ups.name] == ups, kept[ups.name])
+			}
+			name := ups.name
+			waitFor(t, "a poll of "+name, func() bool { return s.count(name) > 0 })
+		}
+
+		if strings.Join(s.forgotten, ",") != strings.Join(test.forgotten, ",") {
+			t.Errorf("%s: forgot %q, want %q", test.name, s.forgotten, test.forgotten)
+		}
+	}
+}
+
+func TestTargetManagerApplyWhileSinkGathers(t *testing.T) {
+
+	srv := apcupsdtest.NewServer(apcupsdtest.DefaultStatus()...)
+	defer srv.Close()
+
+	// The pollers are stopped by the last apply rather than a deferred
+	// stopAll, so that a deadlock fails the test instead of hanging it.
+	s := &gatheringSink{entered: make(chan struct{}, 1)}
+	m := &targetManager{ctx: context.Background(), sinks: []sink{s}}
+
+	setTestTargetsFunc(m.targets)
+	defer setTestTargets()
+
+	tests := []struct {
+		name    string
+		targets []targetConfig
+	}{
+		{name: "start", targets: []targetConfig{{Name: "a", Address: srv.Addr, Backend: "nis", Interval: time.Hour, Timeout: time.Hour}}},
+		{name: "remove while gathering", targets: []targetConfig{{Name: "b", Address: srv.Addr, Backend: "nis", Interval: time.Hour, Timeout: time.Hour}}},
+		{name: "change while gathering", targets: []targetConfig{{Name: "b", Address: srv.Addr, Backend: "nis", Interval: time.Minute, Timeout: time.Minute}}},
+		{name: "remove all while gathering"},
+	}
+
+	for _, test := range tests {
+		applied := make(chan error, 1)
+		go func() { applied <- m.apply(&config{Targets: test.targets}) }()
+
+		select {
+		case err := <-applied:
+			if err != nil {
+				t.Fatalf("%s: error applying: %+v", test.name, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: apply() deadlocked with a sink gathering", test.name)
+		}
+
+		if len(test.targets) == 0 {
+			continue
+		}
+		select {
+		case <-s.entered:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: the sink was never handed a poll", test.name)
+		}
+	}
+}
+
+func TestTargetManagerStopAllWhileSinkGathers(t *testing.T) {
+
+	srv := apcupsdtest.NewServer(apcupsdtest.DefaultStatus()...)
+	defer srv.Close()
+
+	s := &gatheringSink{entered: make(chan struct{}, 1)}
+	m := &targetManager{ctx: context.Background(), sinks: []sink{s}}
+
+	setTestTargetsFunc(m.targets)
+	defer setTestTargets()
+
+	tests := []struct {
+		name    string
+		targets []string
+	}{
+		{name: "one target", targets: []string{"a"}},
+		{name: "several targets", targets: []string{"a", "b", "c"}},
+	}
+
+	for _, test := range tests {
+		cfg := &config{}
+		for _, name := range test.targets {
+			cfg.Targets = append(cfg.Targets, targetConfig{Name: name, Address: srv.Addr, Backend: "nis", Interval: time.Hour, Timeout: time.Hour})
+		}
+		if err := m.apply(cfg); err != nil {
+			t.Fatalf("%s: error applying: %+v", test.name, err)
+		}
+		select {
+		case <-s.entered:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: the sink was never handed a poll", test.name)
+		}
+
+		stopped := make(chan struct{})
+		go func() {
+			m.stopAll()
+			close(stopped)
+		}()
+
+		select {
+		case <-stopped:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: stopAll() deadlocked with a sink gathering", test.name)
+		}
+		if targets := m.targets(); len(targets) != 0 {
+			t.Errorf("%s: %d targets left after stopAll()", test.name, len(targets))
+		}
+	}
+}
+
+func TestTargetManagerApplyLabelNames(t *testing.T) {
+
+	srv := apcupsdtest.NewServer(apcupsdtest.DefaultStatus()...)
+	defer srv.Close()
+
+	m := &targetManager{ctx: context.Background(), labelNames: []string{"site"}}
+	defer m.stopAll()
+	c := &upsCollector{targets: m.targets, labelNames: m.configuredLabelNames}
+
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   string
+	}{
+		{name: "unchanged label names", labels: map[string]string{"site": "dc1"}, want: "apcups_up{site=dc1}"},
+		{name: "label name added", labels: map[string]string{"site": "dc1", "rack": "r1"}, want: "apcups_up{rack=r1,site=dc1}"},
+		{name: "label names removed", want: "apcups_up{}"},
+	}
+
+	for _, test := range tests {
+		cfg := &config{Targets: []targetConfig{{Name: "ups", Address: srv.Addr, Backend: "nis", Interval: time.Hour, Timeout: time.Hour, Labels: test.labels}}}
+		if err := m.apply(cfg); err != nil {
+			t.Fatalf("%s: error applying: %+v", test.name, err)
+		}
+
+		waitFor(t, test.name+": a poll", func() bool { return len(collectGauges(t, c)) > 0 })
+		if _, ok := collectGauges(t, c)[test.want]; !ok {
+			t.Errorf("%s: no %s series in %v", test.name, test.want, collectGauges(t, c))
+		}
+	}
+}
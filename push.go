@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+const (
+	pushAttempts       = 3
+	pushInitialBackoff = time.Second
+)
+
+// pushClient bounds every request to the Pushgateway, so one that hangs
+// cannot stall polling, reloads or shutdown.
+var pushClient = &http.Client{Timeout: 10 * time.Second}
+
+// pushSink pushes the metrics of every target to a Pushgateway after each
+// poll, for hosts Prometheus cannot scrape. Each UPS gets its own group,
+// with the instance named upsname@hostname, and the group is deleted when the
+// target is removed or the exporter shuts down.
+type pushSink struct {
+	url string
+	job string
+
+	mtx       sync.Mutex
+	instances map[*target]string
+}
+
+func newPushSink(pushURL, job string) *pushSink {
+
+	if !strings.Contains(pushURL, "://") {
+		pushURL = "http://" + pushURL
+	}
+
+	return &pushSink{
+		url:       strings.TrimSuffix(pushURL, "/"),
+		job:       job,
+		instances: map[*target]string{},
+	}
+}
+
+func (s *pushSink) polled(ctx context.Context, t *target) {
+
+	snapshot, _, _ := t.state()
+	if snapshot == nil {
+		return
+	}
+
+	instance := snapshot.Info.upsName + "@" + snapshot.Info.hostname
+	if snapshot.Info.upsName == "" {
+		instance = snapshot.Info.hostname
+	}
+
+	s.mtx.Lock()
+	previous := s.instances[t]
+	s.instances[t] = instance
+	s.mtx.Unlock()
+
+	// The UPS was renamed or moved, don't leave the old group behind.
+	if previous != "" && previous != instance {
+		if err := s.delete(previous); err != nil {
+			log.Printf("Error deleting Pushgateway group %s: %+v", previous, err)
+		}
+	}
+
+	families, err := gatherMetricFamilies()
+	if err != nil {
+		log.Printf("Error gathering metrics of %s for the Pushgateway: %+v", t.name, err)
+		return
+	}
+
+	body, err := encodePushBody(targetFamilies(families, t))
+	if err != nil {
+		log.Printf("Error encoding metrics of %s for the Pushgateway: %+v", t.name, err)
+		return
+	}
+
+	backoff := pushInitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := s.push(ctx, instance, body)
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+
+		if attempt == pushAttempts {
+			log.Printf("Error pushing %s to Pushgateway, giving up after %d attempts: %+v", t.name, attempt, err)
+			return
+		}
+		log.Printf("Error pushing %s to Pushgateway, retrying in %s: %+v", t.name, backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// forget deletes the group of a target that is no longer polled, including
+// on shutdown.
+func (s *pushSink) forget(t *target) {
+
+	s.mtx.Lock()
+	instance, ok := s.instances[t]
+	delete(s.instances, t)
+	s.mtx.Unlock()
+
+	if !ok {
+		return
+	}
+
+	if err := s.delete(instance); err != nil {
+		log.Printf("Error deleting Pushgateway group %s: %+v", instance, err)
+	}
+}
+
+// push replaces the group of instance with body, giving up once ctx is
+// done. The URL is built the same way as by prometheus.Push.
+func (s *pushSink) push(ctx context.Context, instance string, body []byte) error {
+
+	pushURL := s.groupURL(instance)
+
+	req, err := http.NewRequest("PUT", pushURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", string(expfmt.FmtProtoDelim))
+
+	resp, err := pushClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("Unexpected status code %d while pushing to %s", resp.StatusCode, pushURL)
+	}
+
+	return nil
+}
+
+// delete removes a group from the Pushgateway. The vendored client has no
+// call for this.
+func (s *pushSink) delete(instance string) error {
+
+	deleteURL := s.groupURL(instance)
+
+	req, err := http.NewRequest("DELETE", deleteURL, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := pushClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("Unexpected status code %d while deleting %s", resp.StatusCode, deleteURL)
+	}
+
+	return nil
+}
+
+func (s *pushSink) groupURL(instance string) string {
+	return fmt.Sprintf("%s/metrics/jobs/%s/instances/%s", s.url, url.QueryEscape(s.job), url.QueryEscape(instance))
+}
+
+// encodePushBody encodes families in the delimited protobuf format. Labels
+// with empty values, left by label names configured on other targets only,
+// are dropped.
+func encodePushBody(families []*dto.MetricFamily) ([]byte, error) {
+
+	var buf bytes.Buffer
+	enc := expfmt.NewEncoder(&buf, expfmt.FmtProtoDelim)
+
+	for _, mf := range families {
+		metrics := make([]*dto.Metric, len(mf.Metric))
+		for i, m := range mf.Metric {
+			stripped := *m
+			stripped.Label = nil
+			for _, label := range m.Label {
+				if label.GetValue() != "" {
+					stripped.Label = append(stripped.Label, label)
+				}
+			}
+			metrics[i] = &stripped
+		}
+
+		if err := enc.Encode(&dto.MetricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type, Metric: metrics}); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
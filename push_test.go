@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestPushSinkPushesTargetGroup(t *testing.T) {
+
+	var (
+		method, path string
+		families     = map[string]*dto.MetricFamily{}
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.EscapedPath()
+		dec := expfmt.NewDecoder(r.Body, expfmt.ResponseFormat(r.Header))
+		for {
+			mf := &dto.MetricFamily{}
+			if err := dec.Decode(mf); err != nil {
+				break
+			}
+			families[mf.GetName()] = mf
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	ups := newTestTarget("rack1", nil, &upsInfo{status: "online", hostname: "host", upsName: "ups1"})
+	other := newTestTarget("rack2", map[string]string{"site": "dc1"}, &upsInfo{status: "onbatt", hostname: "host2", upsName: "ups2"})
+	setTestTargets(ups, other)
+	defer setTestTargets()
+
+	s := newPushSink(srv.URL, "apcupsd")
+	s.polled(context.Background(), ups)
+
+	if want := "/metrics/jobs/apcupsd/instances/ups1%40host"; method != "PUT" || path != want {
+		t.Errorf("Pushed with %s %s, want PUT %s", method, path, want)
+	}
+
+	up := families["apcups_up"]
+	if up == nil || len(up.Metric) != 1 {
+		t.Fatalf("Pushed apcups_up %v, want the single series of the target", up)
+	}
+	for _, mf := range families {
+		for _, m := range mf.Metric {
+			for _, label := range m.Label {
+				if label.GetValue() == "" || (label.GetName() == "target" && label.GetValue() != "rack1") {
+					t.Errorf("Pushed %s with label %s=%q", mf.GetName(), label.GetName(), label.GetValue())
+				}
+			}
+		}
+	}
+}
+
+func TestPushSinkGivesUpWithPoll(t *testing.T) {
+
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	ups := newTestTarget("rack1", nil, &upsInfo{status: "online", hostname: "host", upsName: "ups1"})
+	setTestTargets(ups)
+	defer setTestTargets()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	newPushSink(srv.URL, "apcupsd").polled(ctx, ups)
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Push to a hanging Pushgateway took %s after the poll was cancelled", elapsed)
+	}
+}
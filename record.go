@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Recordings are directories holding one file per raw NIS response, named
+// after the time the response was received so that they sort in order.
+// Sessions that failed also get a file with the error next to the bytes
+// received before it.
+const (
+	recordingTimeFormat = "20060102T150405.000000000Z"
+	recordingSuffix     = ".nis"
+	recordingErrSuffix  = ".err"
+)
+
+// recordableSource is implemented by sources able to save the raw responses
+// they receive.
+type recordableSource interface {
+	recordTo(r *recorder)
+}
+
+// recorder saves raw NIS responses for a single target, deleting the oldest
+// files once they take up more than maxBytes.
+type recorder struct {
+	dir      string
+	maxBytes int64
+
+	mtx   sync.Mutex
+	files []recordedFile
+	size  int64
+}
+
+// recordedFile is a file of a recording, kept oldest first by the recorder.
+type recordedFile struct {
+	name string
+	size int64
+}
+
+// newRecorder creates the recording directory for target below baseDir,
+// picking up the files already in it so that they count towards maxBytes.
+// A maxBytes of 0 keeps every response.
+func newRecorder(baseDir, target string, maxBytes int64) (*recorder, error) {
+
+	dir := filepath.Join(baseDir, targetSlug(target))
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("Unable to create recording directory: %+v", err)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read recording directory: %+v", err)
+	}
+
+	r := &recorder{dir: dir, maxBytes: maxBytes}
+
+	// ReadDir sorts by name, which is by time for recordings.
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !(strings.HasSuffix(name, recordingSuffix) || strings.HasSuffix(name, recordingErrSuffix)) {
+			continue
+		}
+		r.files = append(r.files, recordedFile{name: name, size: f.Size()})
+		r.size += f.Size()
+	}
+
+	return r, nil
+}
+
+// record writes raw to a new file named after at and, if the session
+// failed, failure to a file next to it. Files are renamed into place so
+// replays never see partial responses.
+func (r *recorder) record(raw []byte, at time.Time, failure error) error {
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	base := at.UTC().Format(recordingTimeFormat)
+
+	if err := r.write(base+recordingSuffix, raw); err != nil {
+		return err
+	}
+
+	if failure != nil {
+		if err := r.write(base+recordingErrSuffix, []byte(failure.Error()+"\n")); err != nil {
+			return err
+		}
+	}
+
+	r.prune()
+
+	return nil
+}
+
+func (r *recorder) write(name string, data []byte) error {
+
+	tmp, err := ioutil.TempFile(r.dir, ".recording")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), filepath.Join(r.dir, name)); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	r.files = append(r.files, recordedFile{name: name, size: int64(len(data))})
+	r.size += int64(len(data))
+
+	return nil
+}
+
+// prune deletes the oldest files until the recording fits in maxBytes,
+// always keeping the latest response.
+func (r *recorder) prune() {
+
+	if r.maxBytes <= 0 {
+		return
+	}
+
+	for r.size > r.maxBytes && len(r.files) > 2 {
+		oldest := r.files[0]
+		if err := os.Remove(filepath.Join(r.dir, oldest.name)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Error pruning recording %s: %+v", oldest.name, err)
+			return
+		}
+		r.files = r.files[1:]
+		r.size -= oldest.size
+	}
+}
+
+type recording struct {
+	at   time.Time
+	path string
+}
+
+func init() {
+	registerSource("replay", func(u *url.URL) (Source, error) {
+		if u.Path == "" {
+			return nil, fmt.Errorf("Missing recording directory in replay target %q", u)
+		}
+
+		s := &replaySource{dir: u.Path, speed: 1}
+
+		query := u.Query()
+		if speed := query.Get("speed"); speed != "" {
+			var err error
+			if s.speed, err = strconv.ParseFloat(speed, 64); err != nil || s.speed < 0 {
+				return nil, fmt.Errorf("Invalid speed %q in replay target %q", speed, u)
+			}
+		}
+		if loop := query.Get("loop"); loop != "" {
+			var err error
+			if s.loop, err = strconv.ParseBool(loop); err != nil {
+				return nil, fmt.Errorf("Invalid loop %q in replay target %q", loop, u)
+			}
+		}
+
+		return s, nil
+	})
+}
+
+// replaySource plays back a recording made with -record-dir, e.g.
+// replay:///tmp/recordings/nis_ups-host_3551?speed=10&loop=true
+//
+// At speed 1 each Fetch returns the response that was current at the same
+// offset into the recording as the replay has been running; higher speeds
+// compress time. Speed 0 returns the next response on every Fetch.
+type replaySource struct {
+	dir   string
+	speed float64
+	loop  bool
+
+	mtx        sync.Mutex
+	recordings []recording
+	started    time.Time
+	next       int
+}
+
+func (s *replaySource) Fetch(ctx context.Context) (*Snapshot, error) {
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.recordings == nil {
+		recordings, err := loadRecordings(s.dir)
+		if err != nil {
+			return nil, err
+		}
+		s.recordings = recordings
+		s.started = time.Now()
+	}
+
+	rec := s.pick(time.Now())
+
+	raw, err := ioutil.ReadFile(rec.path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading recording: %+v", err)
+	}
+
+	data, err := parseStatus(raw)
+	if err != nil {
+		return nil, fmt.Errorf("Error replaying %s: %+v", filepath.Base(rec.path), err)
+	}
+
+	snapshot, err := newSnapshot(data)
+	if err != nil {
+		return nil, fmt.Errorf("Error replaying %s: %+v", filepath.Base(rec.path), err)
+	}
+	snapshot.Time = rec.at
+
+	return snapshot, nil
+}
+
+// pick selects the recording to return at now.
+func (s *replaySource) pick(now time.Time) recording {
+
+	last := len(s.recordings) - 1
+
+	if s.speed == 0 {
+		if s.next > last {
+			if !s.loop {
+				return s.recordings[last]
+			}
+			s.next = 0
+		}
+		s.next++
+		return s.recordings[s.next-1]
+	}
+
+	first := s.recordings[0].at
+	span := s.recordings[last].at.Sub(first)
+	offset := time.Duration(float64(now.Sub(s.started)) * s.speed)
+
+	if offset > span {
+		if !s.loop || span == 0 {
+			return s.recordings[last]
+		}
+		offset %= span
+	}
+
+	at := first.Add(offset)
+	i := sort.Search(len(s.recordings), func(i int) bool {
+		return s.recordings[i].at.After(at)
+	})
+	return s.recordings[i-1]
+}
+
+// loadRecordings lists the responses in a recording directory in order.
+func loadRecordings(dir string) ([]recording, error) {
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read recording directory: %+v", err)
+	}
+
+	var recordings []recording
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasSuffix(name, recordingSuffix) {
+			continue
+		}
+
+		at, err := time.Parse(recordingTimeFormat, strings.TrimSuffix(name, recordingSuffix))
+		if err != nil {
+			continue
+		}
+
+		recordings = append(recordings, recording{at: at, path: filepath.Join(dir, name)})
+	}
+
+	if len(recordings) == 0 {
+		return nil, fmt.Errorf("No recordings found in %s", dir)
+	}
+
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].at.Before(recordings[j].at)
+	})
+
+	return recordings, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/damomurf/apcupsd-exporter/apcupsdtest"
+)
+
+func TestRecordFailedSessions(t *testing.T) {
+
+	tests := []struct {
+		fault apcupsdtest.Fault
+		err   string
+	}{
+		{fault: apcupsdtest.NoFault},
+		{fault: apcupsdtest.DropConnection, err: "Error reading size"},
+		{fault: apcupsdtest.MalformedLength, err: "Error reading data"},
+		{fault: apcupsdtest.TruncatedRecord, err: "Error reading data"},
+		{fault: apcupsdtest.WrongEncoding, err: "not ASCII"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.fault.String(), func(t *testing.T) {
+
+			dir, err := ioutil.TempDir("", "recording")
+			if err != nil {
+				t.Fatalf("Error creating directory: %+v", err)
+			}
+			defer os.RemoveAll(dir)
+
+			srv := apcupsdtest.NewServer(apcupsdtest.DefaultStatus()...)
+			defer srv.Close()
+			srv.SetFault(test.fault)
+
+			r, err := newRecorder(dir, srv.Addr, 0)
+			if err != nil {
+				t.Fatalf("Error creating recorder: %+v", err)
+			}
+			source := &nisSource{hostPort: srv.Addr}
+			source.recordTo(r)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			_, fetchErr := source.Fetch(ctx)
+
+			replay := &replaySource{dir: r.dir}
+			_, replayErr := replay.Fetch(ctx)
+
+			if test.err == "" {
+				if fetchErr != nil || replayErr != nil {
+					t.Fatalf("Unexpected errors fetching (%v) and replaying (%v)", fetchErr, replayErr)
+				}
+				return
+			}
+
+			if fetchErr == nil || !strings.Contains(fetchErr.Error(), test.err) {
+				t.Errorf("Fetch error = %v, want one containing %q", fetchErr, test.err)
+			}
+			if replayErr == nil || !strings.Contains(replayErr.Error(), test.err) {
+				t.Errorf("Replay error = %v, want one containing %q", replayErr, test.err)
+			}
+
+			errFiles, _ := filepath.Glob(filepath.Join(r.dir, "*"+recordingErrSuffix))
+			if len(errFiles) != 1 {
+				t.Fatalf("Found %d error files, want 1", len(errFiles))
+			}
+			if msg, _ := ioutil.ReadFile(errFiles[0]); !strings.Contains(string(msg), test.err) {
+				t.Errorf("Recorded error %q, want one containing %q", msg, test.err)
+			}
+		})
+	}
+}
+
+func TestRecorderPrunesOldestFiles(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "recording")
+	if err != nil {
+		t.Fatalf("Error creating directory: %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	response := make([]byte, 100)
+
+	// Files left by an earlier run count towards the limit too.
+	r, err := newRecorder(dir, "ups", 0)
+	if err != nil {
+		t.Fatalf("Error creating recorder: %+v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := r.record(response, start.Add(time.Duration(i)*time.Second), nil); err != nil {
+			t.Fatalf("Error recording: %+v", err)
+		}
+	}
+
+	r, err = newRecorder(dir, "ups", 450)
+	if err != nil {
+		t.Fatalf("Error creating recorder: %+v", err)
+	}
+	for i := 3; i < 6; i++ {
+		if err := r.record(response, start.Add(time.Duration(i)*time.Second), nil); err != nil {
+			t.Fatalf("Error recording: %+v", err)
+		}
+	}
+
+	recordings, err := loadRecordings(r.dir)
+	if err != nil {
+		t.Fatalf("Error loading recordings: %+v", err)
+	}
+	if len(recordings) != 4 {
+		t.Fatalf("Kept %d recordings, want 4", len(recordings))
+	}
+	if want := start.Add(2 * time.Second); !recordings[0].at.Equal(want) {
+		t.Errorf("Oldest recording kept is from %v, want %v", recordings[0].at, want)
+	}
+}
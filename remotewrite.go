@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	remoteWriteMaxSamplesPerSend = 2000
+	remoteWriteMinBackoff        = time.Second
+	remoteWriteMaxBackoff        = 5 * time.Minute
+	remoteWriteTimeout           = 30 * time.Second
+	remoteWriteFlushTimeout      = 5 * time.Second
+	remoteWriteMaxSegmentSize    = 4 << 20
+)
+
+var (
+	remoteWriteSamplesSent = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "apcups_remote_write_samples_sent_total",
+		Help: "Samples accepted by the remote_write endpoint",
+	})
+	remoteWriteSamplesDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "apcups_remote_write_samples_dropped_total",
+		Help: "Samples dropped without being sent, because the endpoint rejected them or the WAL was full",
+	},
+		[]string{"reason"},
+	)
+	remoteWriteFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "apcups_remote_write_failed_requests_total",
+		Help: "remote_write requests that failed and will be retried",
+	})
+)
+
+// The remote_write WriteRequest message and the messages it is made of, as
+// defined in prometheus/prompb/types.proto. Only the fields the exporter sends
+// are declared.
+type prompbWriteRequest struct {
+	Timeseries []*prompbTimeSeries `protobuf:"bytes,1,rep,name=timeseries"`
+}
+
+func (m *prompbWriteRequest) Reset()         { *m = prompbWriteRequest{} }
+func (m *prompbWriteRequest) String() string { return proto.CompactTextString(m) }
+func (*prompbWriteRequest) ProtoMessage()    {}
+
+type prompbTimeSeries struct {
+	Labels  []*prompbLabel  `protobuf:"bytes,1,rep,name=labels"`
+	Samples []*prompbSample `protobuf:"bytes,2,rep,name=samples"`
+}
+
+func (m *prompbTimeSeries) Reset()         { *m = prompbTimeSeries{} }
+func (m *prompbTimeSeries) String() string { return proto.CompactTextString(m) }
+func (*prompbTimeSeries) ProtoMessage()    {}
+
+type prompbLabel struct {
+	Name  string `protobuf:"bytes,1,opt,name=name,proto3"`
+	Value string `protobuf:"bytes,2,opt,name=value,proto3"`
+}
+
+func (m *prompbLabel) Reset()         { *m = prompbLabel{} }
+func (m *prompbLabel) String() string { return proto.CompactTextString(m) }
+func (*prompbLabel) ProtoMessage()    {}
+
+type prompbSample struct {
+	Value     float64 `protobuf:"fixed64,1,opt,name=value,proto3"`
+	Timestamp int64   `protobuf:"varint,2,opt,name=timestamp,proto3"`
+}
+
+func (m *prompbSample) Reset()         { *m = prompbSample{} }
+func (m *prompbSample) String() string { return proto.CompactTextString(m) }
+func (*prompbSample) ProtoMessage()    {}
+
+// remoteWriteSink sends the metrics of every target to a Prometheus
+// remote_write endpoint. Each poll is appended to a write-ahead log on disk
+// first and sent from there, so samples taken while the endpoint cannot be
+// reached are delivered once it is back, including across restarts.
+type remoteWriteSink struct {
+	url    string
+	client *http.Client
+	wal    *wal
+
+	wake   chan struct{}
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newRemoteWriteSink(writeURL, walDir string, walMaxBytes int64) (*remoteWriteSink, error) {
+
+	if !strings.Contains(writeURL, "://") {
+		writeURL = "http://" + writeURL
+	}
+
+	segmentSize := walMaxBytes / 8
+	if segmentSize > remoteWriteMaxSegmentSize {
+		segmentSize = remoteWriteMaxSegmentSize
+	}
+
+	w, err := openWAL(walDir, segmentSize, walMaxBytes, func(samples int) {
+		log.Printf("Remote write WAL is full, dropped %d unsent samples", samples)
+		remoteWriteSamplesDropped.WithLabelValues("wal_full").Add(float64(samples))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	prometheus.MustRegister(
+		remoteWriteSamplesSent, remoteWriteSamplesDropped, remoteWriteFailures,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "apcups_remote_write_samples_queued",
+			Help: "Samples in the remote_write WAL waiting to be sent",
+		}, func() float64 {
+			queued, _ := w.stats()
+			return float64(queued)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "apcups_remote_write_wal_bytes",
+			Help: "Size of the remote_write WAL on disk",
+		}, func() float64 {
+			_, size := w.stats()
+			return float64(size)
+		}),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &remoteWriteSink{
+		url:    writeURL,
+		client: &http.Client{Timeout: remoteWriteTimeout},
+		wal:    w,
+		wake:   make(chan struct{}, 1),
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go s.run(ctx)
+
+	return s, nil
+}
+
+func (s *remoteWriteSink) polled(ctx context.Context, t *target) {
+
+	_, lastPoll, _ := t.state()
+
+	families, err := gatherMetricFamilies()
+	if err != nil {
+		log.Printf("Error gathering metrics of %s for remote write: %+v", t.name, err)
+		return
+	}
+
+	req := familiesToWriteRequest(targetFamilies(families, t), lastPoll)
+	if len(req.Timeseries) == 0 {
+		return
+	}
+
+	payload, err := proto.Marshal(req)
+	if err != nil {
+		log.Printf("Error encoding remote write request for %s: %+v", t.name, err)
+		return
+	}
+
+	if err := s.wal.append(payload, len(req.Timeseries)); err != nil {
+		log.Printf("Error queueing samples of %s for remote write: %+v", t.name, err)
+		return
+	}
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run sends the WAL to the endpoint until ctx is cancelled, backing off
+// exponentially while the endpoint fails.
+func (s *remoteWriteSink) run(ctx context.Context) {
+
+	defer close(s.done)
+
+	backoff := remoteWriteMinBackoff
+	for {
+		err := s.sendNext(ctx)
+		if err == io.EOF {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.wake:
+			}
+			continue
+		}
+
+		if err == nil {
+			backoff = remoteWriteMinBackoff
+			continue
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+		remoteWriteFailures.Inc()
+		log.Printf("Error sending to remote write endpoint, retrying in %s: %+v", backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > remoteWriteMaxBackoff {
+			backoff = remoteWriteMaxBackoff
+		}
+	}
+}
+
+// sendNext sends the next batch from the WAL and removes it from the WAL
+// once the endpoint has accepted or permanently rejected it. It returns
+// io.EOF when there is nothing to send.
+func (s *remoteWriteSink) sendNext(ctx context.Context) error {
+
+	records, samples, end, err := s.wal.next(remoteWriteMaxSamplesPerSend)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return io.EOF
+	}
+
+	// Repeated fields of concatenated messages are merged, so the records
+	// together are a single WriteRequest.
+	err = s.send(ctx, bytes.Join(records, nil))
+	if rejected, ok := err.(remoteWriteRejected); ok {
+		log.Printf("Remote write endpoint rejected %d samples, dropping them: %+v", samples, rejected)
+		remoteWriteSamplesDropped.WithLabelValues("rejected").Add(float64(samples))
+	} else if err != nil {
+		return err
+	} else {
+		remoteWriteSamplesSent.Add(float64(samples))
+	}
+
+	return s.wal.commit(end, samples)
+}
+
+// remoteWriteRejected is returned for requests the endpoint will never
+// accept, which are dropped rather than retried.
+type remoteWriteRejected struct {
+	status int
+	body   string
+}
+
+func (e remoteWriteRejected) Error() string {
+	return fmt.Sprintf("Unexpected status code %d: %s", e.status, e.body)
+}
+
+func (s *remoteWriteSink) send(ctx context.Context, payload []byte) error {
+
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(snappy.Encode(nil, payload)))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "apcupsd-exporter")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests {
+		return remoteWriteRejected{status: resp.StatusCode, body: strings.TrimSpace(string(body))}
+	}
+
+	return fmt.Errorf("Unexpected status code %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+}
+
+// Close stops the sender and makes a last attempt at sending what is left in
+// the WAL, e.g. after --once. Anything still unsent is sent on the next start.
+func (s *remoteWriteSink) Close() error {
+
+	s.cancel()
+	<-s.done
+
+	ctx, cancel := context.WithTimeout(context.Background(), remoteWriteFlushTimeout)
+	defer cancel()
+
+	for {
+		err := s.sendNext(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("Error flushing remote write WAL, unsent samples are kept for the next start: %+v", err)
+			break
+		}
+	}
+
+	return s.wal.Close()
+}
+
+// familiesToWriteRequest turns metric families into remote_write series with
+// a single sample each, taken at ts. Histograms and summaries are split into
+// their _bucket, _sum and _count series as in the text format.
+func familiesToWriteRequest(families []*dto.MetricFamily, ts time.Time) *prompbWriteRequest {
+
+	req := &prompbWriteRequest{}
+	timestamp := ts.UnixNano() / int64(time.Millisecond)
+
+	add := func(name string, m *dto.Metric, value float64, extraName, extraValue string) {
+		labels := []*prompbLabel{{Name: "__name__", Value: name}}
+		for _, l := range m.Label {
+			// An empty label is no label, as for Prometheus scrapes.
+			if l.GetValue() != "" {
+				labels = append(labels, &prompbLabel{Name: l.GetName(), Value: l.GetValue()})
+			}
+		}
+		if extraName != "" {
+			labels = append(labels, &prompbLabel{Name: extraName, Value: extraValue})
+		}
+		sort.Sort(prompbLabelsByName(labels))
+
+		req.Timeseries = append(req.Timeseries, &prompbTimeSeries{
+			Labels:  labels,
+			Samples: []*prompbSample{{Value: value, Timestamp: timestamp}},
+		})
+	}
+
+	for _, mf := range families {
+		name := mf.GetName()
+		for _, m := range mf.Metric {
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add(name, m, m.GetCounter().GetValue(), "", "")
+			case dto.MetricType_GAUGE:
+				add(name, m, m.GetGauge().GetValue(), "", "")
+			case dto.MetricType_UNTYPED:
+				add(name, m, m.GetUntyped().GetValue(), "", "")
+			case dto.MetricType_SUMMARY:
+				summary := m.GetSummary()
+				for _, q := range summary.Quantile {
+					add(name, m, q.GetValue(), "quantile", formatFloat(q.GetQuantile()))
+				}
+				add(name+"_sum", m, summary.GetSampleSum(), "", "")
+				add(name+"_count", m, float64(summary.GetSampleCount()), "", "")
+			case dto.MetricType_HISTOGRAM:
+				histogram := m.GetHistogram()
+				infSeen := false
+				for _, b := range histogram.Bucket {
+					if math.IsInf(b.GetUpperBound(), +1) {
+						infSeen = true
+					}
+					add(name+"_bucket", m, float64(b.GetCumulativeCount()), "le", formatFloat(b.GetUpperBound()))
+				}
+				if !infSeen {
+					add(name+"_bucket", m, float64(histogram.GetSampleCount()), "le", "+Inf")
+				}
+				add(name+"_sum", m, histogram.GetSampleSum(), "", "")
+				add(name+"_count", m, float64(histogram.GetSampleCount()), "", "")
+			}
+		}
+	}
+
+	return req
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+type prompbLabelsByName []*prompbLabel
+
+func (l prompbLabelsByName) Len() int           { return len(l) }
+func (l prompbLabelsByName) Less(i, j int) bool { return l[i].Name < l[j].Name }
+func (l prompbLabelsByName) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// seriesString renders a remote_write series as name{label="value",...} value.
+func seriesString(ts *prompbTimeSeries) string {
+
+	var name string
+	var labels []string
+	for _, l := range ts.Labels {
+		if l.Name == "__name__" {
+			name = l.Value
+			continue
+		}
+		labels = append(labels, l.Name+"="+l.Value)
+	}
+
+	return name + "{" + strings.Join(labels, ",") + "} " + formatFloat(ts.Samples[0].Value)
+}
+
+func TestFamiliesToWriteRequest(t *testing.T) {
+
+	label := func(name, value string) *dto.LabelPair {
+		return &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)}
+	}
+
+	families := []*dto.MetricFamily{
+		{
+			Name: proto.String("apcups_up"),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{
+				Label: []*dto.LabelPair{label("target", "ups"), label("site", ""), label("rack", "r1")},
+				Gauge: &dto.Gauge{Value: proto.Float64(1)},
+			}},
+		},
+		{
+			Name: proto.String("apcups_events_total"),
+			Type: dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{{
+				Counter: &dto.Counter{Value: proto.Float64(3)},
+			}},
+		},
+		{
+			Name: proto.String("apcups_nis_request_duration_seconds"),
+			Type: dto.MetricType_HISTOGRAM.Enum(),
+			Metric: []*dto.Metric{{
+				Histogram: &dto.Histogram{
+					SampleCount: proto.Uint64(4),
+					SampleSum:   proto.Float64(0.5),
+					Bucket:      []*dto.Bucket{{UpperBound: proto.Float64(0.1), CumulativeCount: proto.Uint64(3)}},
+				},
+			}},
+		},
+		{
+			Name: proto.String("apcups_latency_seconds"),
+			Type: dto.MetricType_SUMMARY.Enum(),
+			Metric: []*dto.Metric{{
+				Summary: &dto.Summary{
+					SampleCount: proto.Uint64(2),
+					SampleSum:   proto.Float64(1.5),
+					Quantile:    []*dto.Quantile{{Quantile: proto.Float64(0.5), Value: proto.Float64(0.7)}},
+				},
+			}},
+		},
+	}
+
+	at := time.Unix(1700000000, 123000000)
+	req := familiesToWriteRequest(families, at)
+
+	want := []string{
+		"apcups_up{rack=r1,target=ups} 1",
+		"apcups_events_total{} 3",
+		"apcups_nis_request_duration_seconds_bucket{le=0.1} 3",
+		"apcups_nis_request_duration_seconds_bucket{le=+Inf} 4",
+		"apcups_nis_request_duration_seconds_sum{} 0.5",
+		"apcups_nis_request_duration_seconds_count{} 4",
+		"apcups_latency_seconds{quantile=0.5} 0.7",
+		"apcups_latency_seconds_sum{} 1.5",
+		"apcups_latency_seconds_count{} 2",
+	}
+
+	if len(req.Timeseries) != len(want) {
+		t.Fatalf("Got %d series, want %d", len(req.Timeseries), len(want))
+	}
+	for i, ts := range req.Timeseries {
+		if got := seriesString(ts); got != want[i] {
+			t.Errorf("Series %d = %s, want %s", i, got, want[i])
+		}
+		if ts.Samples[0].Timestamp != 1700000000123 {
+			t.Errorf("Series %d has timestamp %d, want 1700000000123", i, ts.Samples[0].Timestamp)
+		}
+	}
+}
+
+func TestRemoteWriteSinkSendNext(t *testing.T) {
+
+	tests := []struct {
+		status    int
+		err       bool
+		committed bool
+	}{
+		{status: http.StatusNoContent, committed: true},
+		{status: http.StatusBadRequest, committed: true},
+		{status: http.StatusTooManyRequests, err: true},
+		{status: http.StatusInternalServerError, err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(http.StatusText(test.status), func(t *testing.T) {
+
+			var received *prompbWriteRequest
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+					t.Errorf("Unexpected headers %v", r.Header)
+				}
+				decoded, err := snappy.Decode(nil, body)
+				if err != nil {
+					t.Errorf("Error decoding snappy body: %+v", err)
+				}
+				received = &prompbWriteRequest{}
+				if err := proto.Unmarshal(decoded, received); err != nil {
+					t.Errorf("Error decoding write request: %+v", err)
+				}
+				w.WriteHeader(test.status)
+			}))
+			defer srv.Close()
+
+			dir := tempDir(t)
+			defer os.RemoveAll(dir)
+			w, err := openWAL(dir, 1<<20, 1<<30, nil)
+			if err != nil {
+				t.Fatalf("Error opening WAL: %+v", err)
+			}
+			defer w.Close()
+
+			// Two polls are sent as a single request.
+			for _, value := range []float64{1, 0} {
+				req := &prompbWriteRequest{Timeseries: []*prompbTimeSeries{{
+					Labels:  []*prompbLabel{{Name: "__name__", Value: "apcups_up"}},
+					Samples: []*prompbSample{{Value: value, Timestamp: 1}},
+				}}}
+				payload, _ := proto.Marshal(req)
+				if err := w.append(payload, 1); err != nil {
+					t.Fatalf("Error appending: %+v", err)
+				}
+			}
+
+			s := &remoteWriteSink{url: srv.URL, client: &http.Client{Timeout: 5 * time.Second}, wal: w}
+			err = s.sendNext(context.Background())
+
+			if (err != nil) != test.err {
+				t.Errorf("sendNext() = %v, want error %v", err, test.err)
+			}
+			if received == nil || len(received.Timeseries) != 2 {
+				t.Fatalf("Endpoint received %v, want both series", received)
+			}
+			if queued, _ := w.stats(); (queued == 0) != test.committed {
+				t.Errorf("%d samples still queued, want committed %v", queued, test.committed)
+			}
+		})
+	}
+}
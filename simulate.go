@@ -0,0 +1,499 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/damomurf/apcupsd-exporter/apcupsdtest"
+	"gopkg.in/yaml.v2"
+)
+
+func init() {
+	subcommands["simulate"] = runSimulate
+}
+
+// scenario describes a simulated UPS and the power events it goes through.
+// Durations in steps are measured from the start of the simulation.
+type scenario struct {
+	UPS struct {
+		Hostname          string        `yaml:"hostname"`
+		UPSName           string        `yaml:"upsname"`
+		Model             string        `yaml:"model"`
+		Serial            string        `yaml:"serial"`
+		NomPower          float64       `yaml:"nompower"`
+		NomInputVoltage   float64       `yaml:"nominv"`
+		NomBatteryVoltage float64       `yaml:"nombattv"`
+		LowTransfer       float64       `yaml:"lotrans"`
+		HighTransfer      float64       `yaml:"hitrans"`
+		RuntimeFullLoad   time.Duration `yaml:"runtime_full_load"`
+		RechargeTime      time.Duration `yaml:"recharge_time"`
+		MinCharge         float64       `yaml:"mbattchg"`
+		MinTimeLeft       time.Duration `yaml:"mintimel"`
+		ShutdownDelay     time.Duration `yaml:"shutdown_delay"`
+	} `yaml:"ups"`
+
+	Initial struct {
+		Charge      float64 `yaml:"charge"`
+		Load        float64 `yaml:"load"`
+		LineVoltage float64 `yaml:"linev"`
+	} `yaml:"initial"`
+
+	Steps []scenarioStep `yaml:"steps"`
+
+	// Repeat restarts the scenario from its initial state after this long.
+	Repeat time.Duration `yaml:"repeat"`
+}
+
+type scenarioStep struct {
+	At time.Duration `yaml:"at"`
+
+	// Power is "fail" or "restore".
+	Power string `yaml:"power"`
+
+	// Reason is reported as LASTXFER when the power fails.
+	Reason string `yaml:"reason"`
+
+	Load        *float64 `yaml:"load"`
+	LineVoltage *float64 `yaml:"linev"`
+	Charge      *float64 `yaml:"charge"`
+
+	// Status replaces the extra status words such as REPLACEBATT or
+	// COMMLOST appended to the computed status. "none" clears them.
+	Status string `yaml:"status"`
+
+	// Event is added to the event log verbatim.
+	Event string `yaml:"event"`
+}
+
+func loadScenario(path string) (*scenario, error) {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	sc := &scenario{}
+	if err := yaml.UnmarshalStrict(data, sc); err != nil {
+		return nil, fmt.Errorf("Error parsing scenario %s: %+v", path, err)
+	}
+
+	u := &sc.UPS
+	if u.Hostname == "" {
+		u.Hostname, _ = os.Hostname()
+	}
+	if u.UPSName == "" {
+		u.UPSName = "simulated"
+	}
+	if u.Model == "" {
+		u.Model = "Smart-UPS 1500"
+	}
+	if u.Serial == "" {
+		u.Serial = "SIM0000000001"
+	}
+	if u.NomPower == 0 {
+		u.NomPower = 980
+	}
+	if u.NomInputVoltage == 0 {
+		u.NomInputVoltage = 230
+	}
+	if u.NomBatteryVoltage == 0 {
+		u.NomBatteryVoltage = 24
+	}
+	if u.LowTransfer == 0 {
+		u.LowTransfer = u.NomInputVoltage * 0.78
+	}
+	if u.HighTransfer == 0 {
+		u.HighTransfer = u.NomInputVoltage * 1.15
+	}
+	if u.RuntimeFullLoad == 0 {
+		u.RuntimeFullLoad = 10 * time.Minute
+	}
+	if u.RechargeTime == 0 {
+		u.RechargeTime = 3 * time.Hour
+	}
+	if u.MinCharge == 0 {
+		u.MinCharge = 10
+	}
+	if u.MinTimeLeft == 0 {
+		u.MinTimeLeft = 3 * time.Minute
+	}
+
+	if sc.Initial.Charge == 0 {
+		sc.Initial.Charge = 100
+	}
+	if sc.Initial.Load == 0 {
+		sc.Initial.Load = 30
+	}
+	if sc.Initial.LineVoltage == 0 {
+		sc.Initial.LineVoltage = u.NomInputVoltage
+	}
+
+	for i, step := range sc.Steps {
+		if step.Power != "" && step.Power != "fail" && step.Power != "restore" {
+			return nil, fmt.Errorf("Step %d: power must be fail or restore, not %q", i, step.Power)
+		}
+		if i > 0 && step.At < sc.Steps[i-1].At {
+			return nil, fmt.Errorf("Step %d: steps must be ordered by time", i)
+		}
+	}
+
+	return sc, nil
+}
+
+// simulator evolves the state of a simulated UPS through a scenario.
+type simulator struct {
+	sc    *scenario
+	speed float64
+
+	mtx sync.Mutex
+
+	realStart time.Time
+	simStart  time.Time
+
+	elapsed    time.Duration // simulated time since simStart
+	cycleStart time.Duration // simulated time the current repetition began
+	next       int           // index of the next step to apply
+
+	onBattery    bool
+	charge       float64
+	load         float64
+	lineVoltage  float64
+	extraStatus  string
+	lowBattAt    time.Duration // simulated time LOWBATT was raised, -1 if not
+	shuttingDown bool
+	exhausted    bool
+
+	onBattSince time.Duration
+	cumOnBatt   time.Duration
+	numXfers    int
+	lastXfer    string
+	xOnBatt     time.Time
+	xOffBatt    time.Time
+
+	events []string
+}
+
+func newSimulator(sc *scenario, speed float64, now time.Time) *simulator {
+	sim := &simulator{
+		sc:        sc,
+		speed:     speed,
+		realStart: now,
+		simStart:  now,
+		lastXfer:  "No transfers since turnon",
+	}
+	sim.reset()
+	return sim
+}
+
+func (sim *simulator) reset() {
+	sim.cycleStart = sim.elapsed
+	sim.next = 0
+	sim.onBattery = false
+	sim.charge = sim.sc.Initial.Charge
+	sim.load = sim.sc.Initial.Load
+	sim.lineVoltage = sim.sc.Initial.LineVoltage
+	sim.extraStatus = ""
+	sim.lowBattAt = -1
+	sim.shuttingDown = false
+	sim.exhausted = false
+}
+
+func (sim *simulator) clock() time.Time {
+	return sim.simStart.Add(sim.elapsed)
+}
+
+func (sim *simulator) event(msg string) {
+	line := fmt.Sprintf("%s  %s", sim.clock().Format(apcupsdTimeFormat), msg)
+	log.Print(msg)
+
+	sim.events = append(sim.events, line)
+	if len(sim.events) > 50 {
+		sim.events = sim.events[len(sim.events)-50:]
+	}
+}
+
+// advance integrates the simulation up to the real time now.
+func (sim *simulator) advance(now time.Time) {
+	sim.mtx.Lock()
+	defer sim.mtx.Unlock()
+
+	target := time.Duration(float64(now.Sub(sim.realStart)) * sim.speed)
+
+	for sim.elapsed < target {
+		dt := target - sim.elapsed
+		if dt > time.Second {
+			dt = time.Second
+		}
+		sim.elapsed += dt
+		sim.step(dt)
+	}
+}
+
+func (sim *simulator) step(dt time.Duration) {
+
+	u := &sim.sc.UPS
+
+	if sim.sc.Repeat > 0 && sim.elapsed-sim.cycleStart >= sim.sc.Repeat {
+		sim.event("Simulation restarting.")
+		sim.reset()
+	}
+
+	for sim.next < len(sim.sc.Steps) && sim.sc.Steps[sim.next].At <= sim.elapsed-sim.cycleStart {
+		sim.apply(sim.sc.Steps[sim.next])
+		sim.next++
+	}
+
+	if sim.onBattery {
+		sim.cumOnBatt += dt
+		if !sim.exhausted {
+			sim.charge -= sim.load * float64(dt) / float64(u.RuntimeFullLoad)
+		}
+	} else {
+		sim.charge += 100 * float64(dt) / float64(u.RechargeTime)
+	}
+
+	if sim.charge > 100 {
+		sim.charge = 100
+	}
+
+	if sim.charge <= 0 {
+		sim.charge = 0
+		if !sim.exhausted {
+			sim.exhausted = true
+			sim.event("Battery power exhausted.")
+		}
+	}
+
+	if !sim.onBattery {
+		return
+	}
+
+	if sim.lowBattAt < 0 && (sim.charge <= u.MinCharge || sim.timeLeft() <= u.MinTimeLeft) {
+		sim.lowBattAt = sim.elapsed
+		if sim.charge <= u.MinCharge {
+			sim.event("Battery charge below low limit.")
+		} else {
+			sim.event("Reached run time limit on batteries.")
+		}
+	}
+
+	if sim.lowBattAt >= 0 && !sim.shuttingDown && sim.elapsed-sim.lowBattAt >= u.ShutdownDelay {
+		sim.shuttingDown = true
+		sim.event("Initiating system shutdown!")
+	}
+}
+
+func (sim *simulator) apply(step scenarioStep) {
+
+	if step.Load != nil {
+		sim.load = *step.Load
+	}
+	if step.LineVoltage != nil {
+		sim.lineVoltage = *step.LineVoltage
+	}
+	if step.Charge != nil {
+		sim.charge = *step.Charge
+	}
+	if step.Status == "none" {
+		sim.extraStatus = ""
+	} else if step.Status != "" {
+		sim.extraStatus = strings.ToUpper(step.Status)
+	}
+	if step.Event != "" {
+		sim.event(step.Event)
+	}
+
+	switch {
+	case step.Power == "fail" && !sim.onBattery:
+		sim.onBattery = true
+		sim.onBattSince = sim.elapsed
+		sim.numXfers++
+		sim.xOnBatt = sim.clock()
+		sim.lastXfer = step.Reason
+		if sim.lastXfer == "" {
+			sim.lastXfer = "Low line voltage"
+		}
+		if step.LineVoltage == nil {
+			sim.lineVoltage = 0
+		}
+		sim.event("Power failure.")
+		sim.event("Running on UPS batteries.")
+
+	case step.Power == "restore" && sim.onBattery:
+		sim.onBattery = false
+		sim.xOffBatt = sim.clock()
+		sim.lowBattAt = -1
+		sim.shuttingDown = false
+		sim.exhausted = false
+		if step.LineVoltage == nil {
+			sim.lineVoltage = sim.sc.Initial.LineVoltage
+		}
+		sim.event("Mains returned. No longer on UPS batteries.")
+		sim.event("Power is back. UPS running on mains.")
+	}
+}
+
+func (sim *simulator) timeLeft() time.Duration {
+	if sim.load <= 0 {
+		return sim.sc.UPS.RuntimeFullLoad * 100
+	}
+	return time.Duration(float64(sim.sc.UPS.RuntimeFullLoad) * sim.charge / sim.load)
+}
+
+func (sim *simulator) status() string {
+	if sim.exhausted {
+		return "COMMLOST"
+	}
+
+	words := []string{"ONLINE"}
+	if sim.onBattery {
+		words = []string{"ONBATT"}
+	}
+	if sim.lowBattAt >= 0 {
+		words = append(words, "LOWBATT")
+	}
+	if sim.extraStatus != "" {
+		words = append(words, sim.extraStatus)
+	}
+	if sim.shuttingDown {
+		words = append(words, "SHUTTING DOWN")
+	}
+	return strings.Join(words, " ")
+}
+
+// records renders the current state as the fields of an apcupsd status.
+func (sim *simulator) records() []apcupsdtest.Record {
+	sim.mtx.Lock()
+	defer sim.mtx.Unlock()
+
+	u := &sim.sc.UPS
+	now := sim.clock().Format(apcupsdTimeFormat)
+
+	tonbatt := time.Duration(0)
+	if sim.onBattery {
+		tonbatt = sim.elapsed - sim.onBattSince
+	}
+
+	formatTime := func(t time.Time) string {
+		if t.IsZero() {
+			return "N/A"
+		}
+		return t.Format(apcupsdTimeFormat)
+	}
+
+	battV := u.NomBatteryVoltage * (0.9 + 0.2*sim.charge/100)
+
+	return []apcupsdtest.Record{
+		{Key: "APC", Value: "001,036,0923"},
+		{Key: "DATE", Value: now},
+		{Key: "HOSTNAME", Value: u.Hostname},
+		{Key: "VERSION", Value: "3.14.14 (simulated)"},
+		{Key: "UPSNAME", Value: u.UPSName},
+		{Key: "CABLE", Value: "Simulated"},
+		{Key: "DRIVER", Value: "apcupsd-exporter simulator"},
+		{Key: "UPSMODE", Value: "Stand Alone"},
+		{Key: "STARTTIME", Value: sim.simStart.Format(apcupsdTimeFormat)},
+		{Key: "MODEL", Value: u.Model},
+		{Key: "STATUS", Value: sim.status()},
+		{Key: "LINEV", Value: fmt.Sprintf("%.1f Volts", sim.lineVoltage)},
+		{Key: "LOADPCT", Value: fmt.Sprintf("%.1f Percent", sim.load)},
+		{Key: "BCHARGE", Value: fmt.Sprintf("%.1f Percent", sim.charge)},
+		{Key: "TIMELEFT", Value: fmt.Sprintf("%.1f Minutes", sim.timeLeft().Minutes())},
+		{Key: "MBATTCHG", Value: fmt.Sprintf("%.0f Percent", u.MinCharge)},
+		{Key: "MINTIMEL", Value: fmt.Sprintf("%.0f Minutes", u.MinTimeLeft.Minutes())},
+		{Key: "MAXTIME", Value: "0 Seconds"},
+		{Key: "OUTPUTV", Value: fmt.Sprintf("%.1f Volts", u.NomInputVoltage)},
+		{Key: "LOTRANS", Value: fmt.Sprintf("%.1f Volts", u.LowTransfer)},
+		{Key: "HITRANS", Value: fmt.Sprintf("%.1f Volts", u.HighTransfer)},
+		{Key: "BATTV", Value: fmt.Sprintf("%.1f Volts", battV)},
+		{Key: "LASTXFER", Value: sim.lastXfer},
+		{Key: "NUMXFERS", Value: fmt.Sprintf("%d", sim.numXfers)},
+		{Key: "XONBATT", Value: formatTime(sim.xOnBatt)},
+		{Key: "TONBATT", Value: fmt.Sprintf("%.0f Seconds", tonbatt.Seconds())},
+		{Key: "CUMONBATT", Value: fmt.Sprintf("%.0f Seconds", sim.cumOnBatt.Seconds())},
+		{Key: "XOFFBATT", Value: formatTime(sim.xOffBatt)},
+		{Key: "SELFTEST", Value: "NO"},
+		{Key: "SERIALNO", Value: u.Serial},
+		{Key: "NOMINV", Value: fmt.Sprintf("%.0f Volts", u.NomInputVoltage)},
+		{Key: "NOMBATTV", Value: fmt.Sprintf("%.1f Volts", u.NomBatteryVoltage)},
+		{Key: "NOMPOWER", Value: fmt.Sprintf("%.0f Watts", u.NomPower)},
+		{Key: "END APC", Value: now},
+	}
+}
+
+func (sim *simulator) eventLog() []string {
+	sim.mtx.Lock()
+	defer sim.mtx.Unlock()
+
+	return append([]string(nil), sim.events...)
+}
+
+// runSimulate serves the NIS protocol for a simulated UPS following a YAML
+// scenario, for exercising alerting and shutdown automation end to end.
+func runSimulate(args []string) int {
+
+	flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	addr := flags.String("listen-address", ":3551", "The address to serve the apcupsd NIS protocol on.")
+	scenarioFile := flags.String("scenario", "", "YAML file describing the simulated UPS and its power events.")
+	speed := flags.Float64("speed", 1, "How much faster than real time the scenario runs.")
+	flags.Parse(args)
+
+	if *scenarioFile == "" {
+		fmt.Fprintln(os.Stderr, "simulate: -scenario is required")
+		flags.Usage()
+		return 2
+	}
+	if *speed <= 0 {
+		fmt.Fprintln(os.Stderr, "simulate: -speed must be positive")
+		return 2
+	}
+
+	sc, err := loadScenario(*scenarioFile)
+	if err != nil {
+		log.Printf("Error loading scenario: %+v", err)
+		return 1
+	}
+
+	l, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Printf("Error listening on %s: %+v", *addr, err)
+		return 1
+	}
+
+	sim := newSimulator(sc, *speed, time.Now())
+
+	srv := apcupsdtest.NewUnstartedServer()
+	srv.Listener.Close()
+	srv.Listener = l
+	srv.SetStatus(sim.records()...)
+	srv.Start()
+	defer srv.Close()
+
+	log.Printf("Simulating %s (%s) on %s at %gx speed", sc.UPS.UPSName, sc.UPS.Model, srv.Addr, *speed)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	tick := time.NewTicker(250 * time.Millisecond)
+	defer tick.Stop()
+
+	for {
+		select {
+		case now := <-tick.C:
+			sim.advance(now)
+			srv.SetStatus(sim.records()...)
+			srv.SetEvents(sim.eventLog()...)
+		case <-signals:
+			return 0
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeScenario writes a scenario file and returns its path.
+func writeScenario(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "scenario")
+	if err != nil {
+		t.Fatalf("Error creating scenario: %+v", err)
+	}
+	f.WriteString(content)
+	f.Close()
+	return f.Name()
+}
+
+func TestLoadScenario(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{name: "defaults", content: "steps:\n  - at: 1m\n    power: fail\n"},
+		{name: "unknown power", content: "steps:\n  - at: 1m\n    power: off\n", err: "power must be fail or restore"},
+		{name: "unordered steps", content: "steps:\n  - at: 2m\n    load: 50\n  - at: 1m\n    power: fail\n", err: "ordered by time"},
+		{name: "unknown field", content: "ups:\n  voltage: 230\n", err: "Error parsing scenario"},
+	}
+
+	for _, test := range tests {
+		path := writeScenario(t, test.content)
+		defer os.Remove(path)
+
+		sc, err := loadScenario(path)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: loadScenario() = %v, want an error containing %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %+v", test.name, err)
+			continue
+		}
+		if sc.UPS.UPSName != "simulated" || sc.UPS.LowTransfer != 230*0.78 || sc.Initial.Charge != 100 || sc.Initial.LineVoltage != 230 {
+			t.Errorf("%s: unexpected defaults %+v %+v", test.name, sc.UPS, sc.Initial)
+		}
+	}
+
+	if _, err := loadScenario("examples/outage.yml"); err != nil {
+		t.Errorf("Error loading the example scenario: %+v", err)
+	}
+}
+
+func TestSimulatorOutage(t *testing.T) {
+
+	// The battery lasts 20 minutes at half load, so power failing after a
+	// minute raises LOWBATT at 15% charge, with 3 minutes left, after 18
+	// minutes and exhausts it after 21.
+	path := writeScenario(t, `
+ups:
+  upsname: sim
+  runtime_full_load: 10m
+  recharge_time: 1h
+  mbattchg: 10
+  mintimel: 3m
+  shutdown_delay: 30s
+initial:
+  load: 50
+steps:
+  - at: 1m
+    power: fail
+  - at: 25m
+    power: restore
+  - at: 26m
+    status: replacebatt
+repeat: 30m
+`)
+	defer os.Remove(path)
+
+	sc, err := loadScenario(path)
+	if err != nil {
+		t.Fatalf("Error loading scenario: %+v", err)
+	}
+
+	start := time.Unix(1700000000, 0)
+	sim := newSimulator(sc, 1, start)
+
+	tests := []struct {
+		at      time.Duration
+		status  string
+		charge  float64
+		tonbatt time.Duration
+		xfers   float64
+	}{
+		{at: 30 * time.Second, status: "online", charge: 100},
+		{at: 10 * time.Minute, status: "onbatt", charge: 55, tonbatt: 9 * time.Minute, xfers: 1},
+		{at: 18*time.Minute + 15*time.Second, status: "onbatt lowbatt", charge: 13.75, tonbatt: 17*time.Minute + 15*time.Second, xfers: 1},
+		{at: 19 * time.Minute, status: "onbatt lowbatt shutting down", charge: 10, tonbatt: 18 * time.Minute, xfers: 1},
+		{at: 22 * time.Minute, status: "commlost", charge: 0, xfers: 1},
+		{at: 25*time.Minute + 30*time.Second, status: "online", charge: 0.8333, xfers: 1},
+		{at: 27 * time.Minute, status: "online replacebatt", charge: 3.3333, xfers: 1},
+		{at: 30*time.Minute + 30*time.Second, status: "online", charge: 100, xfers: 1},
+	}
+
+	for _, test := range tests {
+		sim.advance(start.Add(test.at))
+
+		data := map[string]string{}
+		for _, r := range sim.records() {
+			data[r.Key] = r.Value
+		}
+		snapshot, err := newSnapshot(data)
+		if err != nil {
+			t.Fatalf("At %s: error decoding status: %+v", test.at, err)
+		}
+
+		info := snapshot.Info
+		if test.status == "commlost" {
+			if info.status != test.status {
+				t.Errorf("At %s: status %q, want %q", test.at, info.status, test.status)
+			}
+			continue
+		}
+		if info.status != test.status || math.Abs(info.batteryChargePercent-test.charge) > 0.2 ||
+			info.timeOnBattery != test.tonbatt || info.numTransfers != test.xfers {
+			t.Errorf("At %s: status %q, charge %v, on battery for %s after %v transfers, want %q, %v, %s and %v",
+				test.at, info.status, info.batteryChargePercent, info.timeOnBattery, info.numTransfers,
+				test.status, test.charge, test.tonbatt, test.xfers)
+		}
+	}
+
+	events := strings.Join(sim.eventLog(), "\n")
+	for _, want := range []string{"Power failure.", "Reached run time limit on batteries.", "Initiating system shutdown!", "Battery power exhausted.", "Power is back.", "Simulation restarting."} {
+		if !strings.Contains(events, want) {
+			t.Errorf("Event log lacks %q:\n%s", want, events)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Snapshot is the state of a single UPS as returned by a Source.
+type Snapshot struct {
+	Info *upsInfo
+
+	// Raw holds the fields as reported by the backend, keyed by their
+	// apcupsd names (STATUS, BCHARGE, ...) where the backend has them.
+	Raw map[string]string
+
+	Time time.Time
+}
+
+// Source retrieves the state of a single UPS from one backend. Fetch must
+// give up once ctx is done.
+type Source interface {
+	Fetch(ctx context.Context) (*Snapshot, error)
+}
+
+// eventSource is implemented by sources that can also return the daemon's
+// event log, oldest first.
+type eventSource interface {
+	Events(ctx context.Context) ([]string, error)
+}
+
+// namedSource is implemented by sources that export metrics of their own,
+// to label them with the name of their target.
+type namedSource interface {
+	setTargetName(name string)
+}
+
+// sourceFactory builds a Source from a target URL.
+type sourceFactory func(u *url.URL) (Source, error)
+
+var (
+	sourceFactoriesMtx sync.RWMutex
+	sourceFactories    = map[string]sourceFactory{}
+)
+
+// registerSource makes a backend available for targets using the given URL
+// scheme. It is intended to be called from init functions.
+func registerSource(scheme string, factory sourceFactory) {
+	sourceFactoriesMtx.Lock()
+	defer sourceFactoriesMtx.Unlock()
+
+	if _, exists := sourceFactories[scheme]; exists {
+		panic(fmt.Sprintf("source scheme %q registered twice", scheme))
+	}
+	sourceFactories[scheme] = factory
+}
+
+// sourceSchemes returns the registered URL schemes in sorted order.
+func sourceSchemes() []string {
+	sourceFactoriesMtx.RLock()
+	defer sourceFactoriesMtx.RUnlock()
+
+	schemes := make([]string, 0, len(sourceFactories))
+	for scheme := range sourceFactories {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// newSource creates the Source for a target URL such as nis://host:3551 or
+// file:///var/log/apcupsd.status. Targets without a scheme are plain
+// host:port addresses and use defaultScheme.
+func newSource(target, defaultScheme string) (Source, error) {
+
+	if !strings.Contains(target, "://") {
+		target = defaultScheme + "://" + target
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid target %q: %+v", target, err)
+	}
+
+	sourceFactoriesMtx.RLock()
+	factory, ok := sourceFactories[u.Scheme]
+	sourceFactoriesMtx.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("Unknown scheme %q in target %q, expected one of %s", u.Scheme, target, strings.Join(sourceSchemes(), ", "))
+	}
+
+	return factory(u)
+}
+
+func init() {
+	registerSource("nis", func(u *url.URL) (Source, error) {
+		if u.Host == "" {
+			return nil, fmt.Errorf("Missing host in NIS target %q", u)
+		}
+		hostPort := u.Host
+		if u.Port() == "" {
+			hostPort += ":3551"
+		}
+		return &nisSource{hostPort: hostPort}, nil
+	})
+
+	registerSource("file", func(u *url.URL) (Source, error) {
+		if u.Path == "" {
+			return nil, fmt.Errorf("Missing path in file target %q", u)
+		}
+		return &fileSource{path: u.Path}, nil
+	})
+}
+
+// nisSource queries an apcupsd daemon over its Network Information Server
+// protocol.
+type nisSource struct {
+	hostPort string
+	recorder *recorder
+}
+
+func (s *nisSource) Fetch(ctx context.Context) (*Snapshot, error) {
+
+	raw, err := nisCommand(ctx, s.hostPort, "status")
+
+	// Record before decoding, and whatever arrived of sessions that failed,
+	// so malformed, truncated and timed out responses end up in the
+	// recording too.
+	if s.recorder != nil && raw != nil {
+		if err := s.recorder.record(raw, time.Now(), err); err != nil {
+			log.Printf("Error recording NIS response from %s: %+v", s.hostPort, err)
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := parseStatus(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return newSnapshot(data)
+}
+
+func (s *nisSource) recordTo(r *recorder) {
+	s.recorder = r
+}
+
+func (s *nisSource) Events(ctx context.Context) ([]string, error) {
+
+	raw, err := nisCommand(ctx, s.hostPort, "events")
+	if err != nil {
+		return nil, err
+	}
+
+	events, err := readRecords(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	for i, event := range events {
+		events[i] = strings.TrimSpace(event)
+	}
+
+	return events, nil
+}
+
+// fileSource reads the status file apcupsd writes on every poll (STATFILE in
+// apcupsd.conf), which uses the same "KEY : value" lines as NIS.
+type fileSource struct {
+	path string
+}
+
+func (s *fileSource) Fetch(ctx context.Context) (*Snapshot, error) {
+
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open status file: %+v", err)
+	}
+	defer f.Close()
+
+	data := map[string]string{}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if key, value, ok := parseRecord(scanner.Text()); ok {
+			data[key] = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading status file: %+v", err)
+	}
+
+	return newSnapshot(data)
+}
+
+// newSnapshot builds a Snapshot from apcupsd style raw fields.
+func newSnapshot(data map[string]string) (*Snapshot, error) {
+
+	info, err := transformData(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Snapshot{Info: info, Raw: data, Time: time.Now()}, nil
+}
+
+// parseRecord splits a single "KEY : value" status line. Only the first colon
+// separates key from value, as values such as DATE contain colons themselves.
+func parseRecord(line string) (string, string, bool) {
+
+	chunks := strings.SplitN(line, ":", 2)
+	if len(chunks) != 2 {
+		return "", "", false
+	}
+
+	key := strings.TrimSpace(chunks[0])
+	if key == "" {
+		return "", "", false
+	}
+
+	return key, strings.TrimSpace(chunks[1]), true
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/damomurf/apcupsd-exporter/apcupsdtest"
+)
+
+func TestNewSource(t *testing.T) {
+
+	tests := []struct {
+		target string
+		want   Source
+		err    string
+	}{
+		{target: "ups-host", want: &nisSource{hostPort: "ups-host:3551"}},
+		{target: "ups-host:3552", want: &nisSource{hostPort: "ups-host:3552"}},
+		{target: "nis://[::1]", want: &nisSource{hostPort: "[::1]:3551"}},
+		{target: "file:///var/log/apcupsd.status", want: &fileSource{path: "/var/log/apcupsd.status"}},
+		{target: "nis://", err: "Missing host"},
+		{target: "file://", err: "Missing path"},
+		{target: "snmp://ups-host", err: `Unknown scheme "snmp"`},
+		{target: "nis://ups host", err: "Invalid target"},
+	}
+
+	for _, test := range tests {
+		got, err := newSource(test.target, "nis")
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("newSource(%q) = %v, want an error containing %q", test.target, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("newSource(%q) = %+v", test.target, err)
+			continue
+		}
+
+		switch want := test.want.(type) {
+		case *nisSource:
+			if nis, ok := got.(*nisSource); !ok || nis.hostPort != want.hostPort {
+				t.Errorf("newSource(%q) = %#v, want a NIS source for %s", test.target, got, want.hostPort)
+			}
+		case *fileSource:
+			if file, ok := got.(*fileSource); !ok || file.path != want.path {
+				t.Errorf("newSource(%q) = %#v, want a file source for %s", test.target, got, want.path)
+			}
+		}
+	}
+}
+
+func TestParseRecord(t *testing.T) {
+
+	tests := []struct {
+		line       string
+		key, value string
+		ok         bool
+	}{
+		{line: "STATUS   : ONLINE \n", key: "STATUS", value: "ONLINE", ok: true},
+		{line: "DATE     : 2016-08-30 17:03:00 +1000", key: "DATE", value: "2016-08-30 17:03:00 +1000", ok: true},
+		{line: "XOFFBATT :", key: "XOFFBATT", value: "", ok: true},
+		{line: "no separator"},
+		{line: " : value"},
+	}
+
+	for _, test := range tests {
+		key, value, ok := parseRecord(test.line)
+		if key != test.key || value != test.value || ok != test.ok {
+			t.Errorf("parseRecord(%q) = %q, %q, %v, want %q, %q, %v", test.line, key, value, ok, test.key, test.value, test.ok)
+		}
+	}
+}
+
+func TestFileSourceFetch(t *testing.T) {
+
+	file, err := ioutil.TempFile("", "apcupsd.status")
+	if err != nil {
+		t.Fatalf("Error creating status file: %+v", err)
+	}
+	defer os.Remove(file.Name())
+	for _, r := range apcupsdtest.DefaultStatus() {
+		file.WriteString(r.String())
+	}
+	file.Close()
+
+	tests := []struct {
+		path string
+		err  bool
+	}{
+		{path: file.Name()},
+		{path: file.Name() + ".missing", err: true},
+	}
+
+	for _, test := range tests {
+		snapshot, err := (&fileSource{path: test.path}).Fetch(context.Background())
+		if (err != nil) != test.err {
+			t.Errorf("Fetch() of %s = %v, want error %v", test.path, err, test.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if snapshot.Info.upsName != "backups-950" || snapshot.Info.batteryChargePercent != 100 || snapshot.Raw["MODEL"] != "Back-UPS XS 950U" {
+			t.Errorf("Fetch() of %s = %+v", test.path, snapshot.Info)
+		}
+	}
+}
+
+func TestNISSourceEvents(t *testing.T) {
+
+	srv := apcupsdtest.NewServer(apcupsdtest.DefaultStatus()...)
+	defer srv.Close()
+	srv.SetEvents("2016-08-30 16:51:00 +1000  apcupsd 3.14.10 startup succeeded  \n", "2016-08-30 17:00:00 +1000  Power failure.\n")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	events, err := (&nisSource{hostPort: srv.Addr}).Events(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	want := []string{"2016-08-30 16:51:00 +1000  apcupsd 3.14.10 startup succeeded", "2016-08-30 17:00:00 +1000  Power failure."}
+	if strings.Join(events, "|") != strings.Join(want, "|") {
+		t.Errorf("Events() = %q, want %q", events, want)
+	}
+}
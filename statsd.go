@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+)
+
+// statsdSink sends the values of every poll to StatsD as gauges, named by
+// the same templates as for Graphite.
+type statsdSink struct {
+	writer   *lineWriter
+	template pathTemplate
+}
+
+func (s *statsdSink) polled(ctx context.Context, t *target) {
+
+	snapshot, _, lastErr := t.state()
+	if snapshot == nil {
+		return
+	}
+
+	var lines []string
+	gauge := func(metric string, value float64) {
+		name := s.template.path(t, snapshot.Info, metric)
+		// A signed gauge value changes the gauge by that amount, so a
+		// negative value is set by resetting the gauge first.
+		if value < 0 {
+			lines = append(lines, name+":0|g\n")
+		}
+		lines = append(lines, name+":"+strconv.FormatFloat(value, 'f', -1, 64)+"|g\n")
+	}
+
+	if lastErr != nil {
+		gauge("up", 0)
+	} else {
+		gauge("up", 1)
+		for _, f := range numericFields(snapshot.Info) {
+			gauge(f.name, f.value)
+		}
+	}
+
+	if err := s.writer.write(lines); err != nil {
+		log.Printf("Error sending %s to StatsD at %s: %+v", t.name, s.writer, err)
+	}
+}
+
+func (s *statsdSink) Close() error {
+	return s.writer.Close()
+}
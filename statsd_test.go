@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsdSinkPolled(t *testing.T) {
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %+v", err)
+	}
+	defer conn.Close()
+
+	w, err := newLineWriter(conn.LocalAddr().String(), "udp")
+	if err != nil {
+		t.Fatalf("Error creating writer: %+v", err)
+	}
+	s := &statsdSink{writer: w, template: "ups.{upsname}.{metric}"}
+	defer s.Close()
+
+	ups := newTestTarget("ups", nil, &upsInfo{status: "online", upsName: "rack1", loadPercent: 12.5, internalTemp: -3})
+
+	tests := []struct {
+		name    string
+		lastErr error
+		want    []string
+		absent  []string
+	}{
+		{
+			name: "poll succeeded",
+			want: []string{
+				"ups.rack1.up:1|g\n",
+				"ups.rack1.load_percent:12.5|g\n",
+				// A negative gauge is reset before it is set.
+				"ups.rack1.internal_temperature_celsius:0|g\nups.rack1.internal_temperature_celsius:-3|g\n",
+			},
+		},
+		{
+			name:    "poll failed",
+			lastErr: errors.New("connection refused"),
+			want:    []string{"ups.rack1.up:0|g\n"},
+			absent:  []string{"load_percent"},
+		},
+	}
+
+	buf := make([]byte, 65536)
+	for _, test := range tests {
+		ups.lastErr = test.lastErr
+		s.polled(context.Background(), ups)
+
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("%s: error reading datagram: %+v", test.name, err)
+		}
+
+		got := string(buf[:n])
+		for _, want := range test.want {
+			if !strings.Contains(got, want) {
+				t.Errorf("%s: sent %q, want %q", test.name, got, want)
+			}
+		}
+		for _, absent := range test.absent {
+			if strings.Contains(got, absent) {
+				t.Errorf("%s: sent %q, want no %s", test.name, got, absent)
+			}
+		}
+	}
+}
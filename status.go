@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+func init() {
+	subcommands["status"] = runStatus
+}
+
+// runStatus prints the status of an apcupsd daemon like apcaccess does, using
+// the exporter's own NIS client.
+func runStatus(args []string) int {
+
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	upsAddr := flags.String("ups", "localhost:3551", "The UPS to query: hostname[:port] of an apcupsd daemon, or a URL such as nis://host:3551, file:///var/log/apcupsd.status or modbus://host:502")
+	output := flags.String("o", "text", "Output format: text, json or yaml")
+	field := flags.String("f", "", "Only print the given field, e.g. BCHARGE")
+	timeout := flags.Duration("timeout", 10*time.Second, "How long to wait for the apcupsd daemon")
+	flags.Parse(args)
+
+	if *output != "text" && *output != "json" && *output != "yaml" {
+		fmt.Fprintf(os.Stderr, "status: unknown output format %q\n", *output)
+		return 2
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	source, err := newSource(*upsAddr, "nis")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "status: %+v\n", err)
+		return 2
+	}
+
+	records, err := statusRecords(ctx, source)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "status: %+v\n", err)
+		return 1
+	}
+
+	if *field != "" {
+		var selected []string
+		for _, record := range records {
+			if key, _, ok := parseRecord(record); ok && strings.EqualFold(key, *field) {
+				selected = append(selected, record)
+			}
+		}
+		if len(selected) == 0 {
+			fmt.Fprintf(os.Stderr, "status: no field %s in response\n", *field)
+			return 1
+		}
+		records = selected
+	}
+
+	if err := writeStatus(os.Stdout, records, *output, *field != ""); err != nil {
+		fmt.Fprintf(os.Stderr, "status: %+v\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+// statusRecords returns the status of source as "KEY : value" records. NIS
+// daemons' records are returned as sent; other backends' fields are
+// rendered in the same format, sorted by name.
+func statusRecords(ctx context.Context, source Source) ([]string, error) {
+
+	if nis, ok := source.(*nisSource); ok {
+		raw, err := nisCommand(ctx, nis.hostPort, "status")
+		if err != nil {
+			return nil, err
+		}
+		return readRecords(bytes.NewReader(raw))
+	}
+
+	snapshot, err := source.Fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(snapshot.Raw))
+	for key := range snapshot.Raw {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	records := make([]string, 0, len(keys))
+	for _, key := range keys {
+		records = append(records, fmt.Sprintf("%-9s: %s\n", key, snapshot.Raw[key]))
+	}
+
+	return records, nil
+}
+
+// writeStatus prints NIS status records in the given format, keeping the
+// order apcupsd sent them in. In text format a single selected field is
+// printed as its bare value, like apcaccess -p.
+func writeStatus(w io.Writer, records []string, format string, valueOnly bool) error {
+
+	switch format {
+	case "json":
+		var buf bytes.Buffer
+		buf.WriteString("{\n")
+		first := true
+		for _, record := range records {
+			key, value, ok := parseRecord(record)
+			if !ok {
+				continue
+			}
+			if !first {
+				buf.WriteString(",\n")
+			}
+			first = false
+			k, _ := json.Marshal(key)
+			v, _ := json.Marshal(value)
+			fmt.Fprintf(&buf, "  %s: %s", k, v)
+		}
+		buf.WriteString("\n}\n")
+		_, err := w.Write(buf.Bytes())
+		return err
+
+	case "yaml":
+		var fields yaml.MapSlice
+		for _, record := range records {
+			if key, value, ok := parseRecord(record); ok {
+				fields = append(fields, yaml.MapItem{Key: key, Value: value})
+			}
+		}
+		data, err := yaml.Marshal(fields)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+
+	default:
+		for _, record := range records {
+			line := record
+			if valueOnly {
+				_, line, _ = parseRecord(record)
+			}
+			if _, err := fmt.Fprintln(w, strings.TrimRight(line, "\n")); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
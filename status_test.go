@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/damomurf/apcupsd-exporter/apcupsdtest"
+)
+
+func TestStatusRecords(t *testing.T) {
+
+	srv := apcupsdtest.NewServer(apcupsdtest.DefaultStatus()...)
+	defer srv.Close()
+
+	file, err := ioutil.TempFile("", "apcupsd.status")
+	if err != nil {
+		t.Fatalf("Error creating status file: %+v", err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("UPSNAME  : rack1\nSTATUS   : ONLINE \nBCHARGE  : 100.0 Percent\n")
+	file.Close()
+
+	tests := []struct {
+		addr  string
+		first string
+		want  map[string]string
+	}{
+		{addr: srv.Addr, first: "APC", want: map[string]string{"UPSNAME": "backups-950", "STATUS": "ONLINE"}},
+		{addr: "nis://" + srv.Addr, first: "APC", want: map[string]string{"UPSNAME": "backups-950"}},
+		{addr: "file://" + file.Name(), first: "BCHARGE", want: map[string]string{"UPSNAME": "rack1", "BCHARGE": "100.0 Percent"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.addr, func(t *testing.T) {
+
+			source, err := newSource(test.addr, "nis")
+			if err != nil {
+				t.Fatalf("Error creating source: %+v", err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			records, err := statusRecords(ctx, source)
+			if err != nil {
+				t.Fatalf("Unexpected error: %+v", err)
+			}
+			if len(records) == 0 {
+				t.Fatalf("No records")
+			}
+
+			if key, _, _ := parseRecord(records[0]); key != test.first {
+				t.Errorf("First record is %q, want %s", records[0], test.first)
+			}
+
+			got := map[string]string{}
+			for _, record := range records {
+				if key, value, ok := parseRecord(record); ok {
+					got[key] = value
+				}
+			}
+			for key, value := range test.want {
+				if got[key] != value {
+					t.Errorf("%s = %q, want %q", key, got[key], value)
+				}
+			}
+		})
+	}
+}
+
+func TestStatusDefaultsToNISPort(t *testing.T) {
+
+	source, err := newSource("ups-host", "nis")
+	if err != nil {
+		t.Fatalf("Error creating source: %+v", err)
+	}
+
+	if nis, ok := source.(*nisSource); !ok || nis.hostPort != "ups-host:3551" {
+		t.Errorf("newSource(ups-host) = %#v, want a NIS source for ups-host:3551", source)
+	}
+}
+
+func TestWriteStatus(t *testing.T) {
+
+	records := []string{"APC      : 001,036,0857\n", "DATE     : 2024-01-02 03:04:05 +1100  \n", "BCHARGE  : 100.0 Percent\n"}
+
+	tests := []struct {
+		format    string
+		valueOnly bool
+		records   []string
+		want      string
+	}{
+		{format: "text", records: records, want: "APC      : 001,036,0857\nDATE     : 2024-01-02 03:04:05 +1100  \nBCHARGE  : 100.0 Percent\n"},
+		{format: "text", valueOnly: true, records: records[2:], want: "100.0 Percent\n"},
+		{format: "json", records: records, want: "{\n  \"APC\": \"001,036,0857\",\n  \"DATE\": \"2024-01-02 03:04:05 +1100\",\n  \"BCHARGE\": \"100.0 Percent\"\n}\n"},
+		{format: "yaml", records: records[1:], want: "DATE: 2024-01-02 03:04:05 +1100\nBCHARGE: 100.0 Percent\n"},
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+		if err := writeStatus(&buf, test.records, test.format, test.valueOnly); err != nil {
+			t.Fatalf("Unexpected error: %+v", err)
+		}
+		if got := buf.String(); got != test.want {
+			t.Errorf("writeStatus(%s, %v) = %q, want %q", test.format, test.valueOnly, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// statusPageTemplate renders every target on one page. It refreshes itself
+// so it can be left open during an outage without any JavaScript.
+var statusPageTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"duration": func(seconds float64) string {
+		return formatDuration(time.Duration(seconds * float64(time.Second)))
+	},
+	"timestamp": func(t *time.Time) string {
+		if t == nil {
+			return "never"
+		}
+		return t.Format("2006-01-02 15:04:05")
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="10">
+<title>UPS status</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { padding: 0.4em 0.8em; border-bottom: 1px solid #ddd; text-align: left; }
+.status { font-weight: bold; padding: 0.2em 0.5em; border-radius: 0.3em; }
+.ok { background: #3c3; color: #fff; }
+.warn { background: #fc3; color: #000; }
+.crit { background: #d33; color: #fff; }
+.unknown { background: #999; color: #fff; }
+</style>
+</head>
+<body>
+{{block "content" .}}
+<h1>UPS status</h1>
+<p>Updated {{.Now.Format "2006-01-02 15:04:05"}}. <a href="/metrics">Metrics</a> &middot; <a href="/api/v1/ups">JSON</a></p>
+<table>
+<tr><th>UPS</th><th>Status</th><th>Charge</th><th>Runtime</th><th>Load</th><th>Line</th><th>Last transfer</th><th>Last self-test</th><th></th></tr>
+{{range .Targets}}
+<tr>
+{{if .Info}}
+<td>{{.Info.UPSName}}<br><small>{{.Info.Model}} on {{.Info.Hostname}}</small></td>
+<td><span class="status {{.Class}}">{{.Status}}</span>{{if .Error}}<br><small>{{.Error}}</small>{{end}}</td>
+<td>{{printf "%.1f" .Info.BatteryChargePercent}}%</td>
+<td>{{duration .Info.TimeLeftSeconds}}</td>
+<td>{{printf "%.1f" .Info.LoadPercent}}%</td>
+<td>{{printf "%.1f" .Info.LineVolts}} V</td>
+<td>{{with .Info.LastTransferReason}}{{.}}{{else}}none{{end}}<br><small>{{timestamp .Info.LastOnBattery}}</small></td>
+<td>{{with .Info.SelfTestResult}}{{.}}{{else}}unknown{{end}}<br><small>{{timestamp .Info.LastSelfTest}}</small></td>
+{{else}}
+<td>{{.Name}}</td>
+<td><span class="status {{.Class}}">{{.Status}}</span>{{if .Error}}<br><small>{{.Error}}</small>{{end}}</td>
+<td colspan="6"></td>
+{{end}}
+<td><a href="/ups/{{.ID}}">raw fields</a></td>
+</tr>
+{{end}}
+</table>
+{{end}}
+</body>
+</html>
+`))
+
+var rawPageTemplate = template.Must(template.Must(statusPageTemplate.Clone()).Parse(`{{define "content"}}
+<h1>{{.Name}}</h1>
+<p><a href="/">All UPSes</a> &middot; <a href="/api/v1/ups/{{.ID}}">JSON</a></p>
+<p><span class="status {{.Class}}">{{.Status}}</span>{{if .Error}} {{.Error}}{{end}}</p>
+<table>
+{{range .Raw}}<tr><th>{{.Key}}</th><td>{{.Value}}</td></tr>
+{{end}}
+</table>
+{{end}}`))
+
+type statusPageTarget struct {
+	ID     string
+	Name   string
+	Info   *upsJSON
+	Status string
+	Class  string
+	Error  error
+	Raw    []rawField
+}
+
+type rawField struct {
+	Key   string
+	Value string
+}
+
+func newStatusPageTarget(t *target) statusPageTarget {
+
+	snapshot, _, err := t.state()
+
+	v := statusPageTarget{ID: t.slug(), Name: t.name, Error: err}
+
+	if snapshot == nil {
+		v.Status, v.Class = "UNKNOWN", "unknown"
+		if err != nil {
+			v.Status, v.Class = "UNREACHABLE", "crit"
+		}
+		return v
+	}
+
+	v.Info = newUPSJSON(snapshot.Info)
+	v.Status = strings.ToUpper(snapshot.Info.status)
+	v.Class = statusClass(snapshot.Info.status)
+	if err != nil {
+		v.Status += " (STALE)"
+		v.Class = "unknown"
+	}
+
+	for key, value := range snapshot.Raw {
+		v.Raw = append(v.Raw, rawField{Key: key, Value: value})
+	}
+	sort.Slice(v.Raw, func(i, j int) bool { return v.Raw[i].Key < v.Raw[j].Key })
+
+	return v
+}
+
+// statusClass grades an apcupsd status for colouring.
+func statusClass(status string) string {
+	for _, flag := range statusFlags(status) {
+		switch flag {
+		case "lowbatt", "commlost", "shutting down", "nobatt", "slavedown", "off":
+			return "crit"
+		}
+	}
+	for _, flag := range statusFlags(status) {
+		switch flag {
+		case "onbatt", "replacebatt", "overload", "trim", "boost", "bypass":
+			return "warn"
+		}
+	}
+	if status == "" {
+		return "unknown"
+	}
+	return "ok"
+}
+
+// statusPageHandler serves the HTML overview of all targets at / and the raw
+// fields of a single target at /ups/{id}.
+type statusPageHandler struct {
+	targets func() []*target
+}
+
+func (h *statusPageHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	var (
+		tmpl *template.Template
+		data interface{}
+	)
+
+	switch {
+	case r.URL.Path == "/":
+		page := struct {
+			Now     time.Time
+			Targets []statusPageTarget
+		}{Now: time.Now()}
+		for _, t := range h.targets() {
+			page.Targets = append(page.Targets, newStatusPageTarget(t))
+		}
+		tmpl, data = statusPageTemplate, page
+
+	case strings.HasPrefix(r.URL.Path, "/ups/"):
+		t := findTarget(h.targets(), strings.TrimPrefix(r.URL.Path, "/ups/"))
+		if t == nil {
+			http.NotFound(w, r)
+			return
+		}
+		tmpl, data = rawPageTemplate, newStatusPageTarget(t)
+
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := tmpl.Execute(w, data); err != nil {
+		log.Printf("Error rendering status page: %+v", err)
+	}
+}
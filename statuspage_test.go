@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStatusClass(t *testing.T) {
+
+	tests := []struct {
+		status string
+		want   string
+	}{
+		{"online", "ok"},
+		{"online trim", "warn"},
+		{"onbatt", "warn"},
+		{"online replacebatt", "warn"},
+		{"onbatt lowbatt", "crit"},
+		{"onbatt shutting down", "crit"},
+		{"commlost", "crit"},
+		{"online bypass", "warn"},
+		{"online off", "crit"},
+		{"", "unknown"},
+	}
+
+	for _, test := range tests {
+		if got := statusClass(test.status); got != test.want {
+			t.Errorf("statusClass(%q) = %q, want %q", test.status, got, test.want)
+		}
+	}
+}
+
+func TestNewStatusPageTarget(t *testing.T) {
+
+	refused := errors.New("connection refused")
+
+	stale := newTestTarget("stale", nil, &upsInfo{status: "onbatt"})
+	stale.lastErr = refused
+	unreachable := &target{name: "unreachable", lastErr: refused}
+
+	tests := []struct {
+		ups    *target
+		status string
+		class  string
+	}{
+		{ups: newTestTarget("ok", nil, &upsInfo{status: "online"}), status: "ONLINE", class: "ok"},
+		{ups: newTestTarget("low", nil, &upsInfo{status: "onbatt lowbatt"}), status: "ONBATT LOWBATT", class: "crit"},
+		{ups: stale, status: "ONBATT (STALE)", class: "unknown"},
+		{ups: unreachable, status: "UNREACHABLE", class: "crit"},
+		{ups: &target{name: "pending"}, status: "UNKNOWN", class: "unknown"},
+	}
+
+	for _, test := range tests {
+		v := newStatusPageTarget(test.ups)
+		if v.Status != test.status || v.Class != test.class {
+			t.Errorf("%s: status %q with class %q, want %q and %q", test.ups.name, v.Status, v.Class, test.status, test.class)
+		}
+	}
+}
+
+func TestStatusPageHandler(t *testing.T) {
+
+	rack1 := newTestTarget("ups-host:3551", nil, &upsInfo{status: "onbatt", upsName: "rack1", model: "Smart-UPS <1500>", batteryChargePercent: 87.5})
+	rack1.last.Raw = map[string]string{"STATUS": "ONBATT", "BCHARGE": "87.5 Percent"}
+	down := &target{name: "down:3551", lastErr: errors.New("connection refused")}
+
+	h := &statusPageHandler{targets: func() []*target { return []*target{rack1, down} }}
+
+	tests := []struct {
+		path string
+		code int
+		want []string
+	}{
+		{
+			path: "/",
+			code: http.StatusOK,
+			want: []string{
+				`<td>rack1<br><small>Smart-UPS &lt;1500&gt; on </small></td>`,
+				`<span class="status warn">ONBATT</span>`,
+				`<td>87.5%</td>`,
+				`<td>down:3551</td>`,
+				`<span class="status crit">UNREACHABLE</span><br><small>connection refused</small>`,
+				`<a href="/ups/ups-host_3551">raw fields</a>`,
+			},
+		},
+		{
+			path: "/ups/rack1",
+			code: http.StatusOK,
+			want: []string{"<h1>ups-host:3551</h1>", "<tr><th>BCHARGE</th><td>87.5 Percent</td></tr>\n<tr><th>STATUS</th><td>ONBATT</td></tr>"},
+		},
+		{path: "/ups/rack2", code: http.StatusNotFound},
+		{path: "/favicon.ico", code: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", test.path, nil))
+
+		if rec.Code != test.code {
+			t.Errorf("GET %s = %d, want %d", test.path, rec.Code, test.code)
+			continue
+		}
+		for _, want := range test.want {
+			if !strings.Contains(rec.Body.String(), want) {
+				t.Errorf("GET %s lacks %q:\n%s", test.path, want, rec.Body)
+			}
+		}
+	}
+}
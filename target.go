@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var unsafeSlugChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// target is a single configured UPS along with the result of its most recent
+// poll.
+type target struct {
+	name   string
+	source Source
+
+	// labels are added to every metric of the target.
+	labels   map[string]string
+	interval time.Duration
+	timeout  time.Duration
+
+	mtx          sync.RWMutex
+	last         *Snapshot
+	lastErr      error
+	lastPoll     time.Time
+	lastDuration time.Duration
+
+	// pollingSince is when a poller started polling the target.
+	pollingSince time.Time
+}
+
+func newTarget(name, defaultScheme string) (*target, error) {
+
+	source, err := newSource(name, defaultScheme)
+	if err != nil {
+		return nil, err
+	}
+	if ns, ok := source.(namedSource); ok {
+		ns.setTargetName(name)
+	}
+
+	return &target{
+		name:     name,
+		source:   source,
+		interval: 10 * time.Second,
+		timeout:  10 * time.Second,
+	}, nil
+}
+
+// newConfiguredTarget creates the target for an entry of the configuration
+// file.
+func newConfiguredTarget(tc targetConfig) (*target, error) {
+
+	source, err := newSource(tc.sourceURL(), tc.Backend)
+	if err != nil {
+		return nil, err
+	}
+	if ns, ok := source.(namedSource); ok {
+		ns.setTargetName(tc.Name)
+	}
+
+	return &target{
+		name:     tc.Name,
+		source:   source,
+		labels:   tc.Labels,
+		interval: tc.Interval,
+		timeout:  tc.Timeout,
+	}, nil
+}
+
+// fetch polls the target's source once and records the outcome.
+func (t *target) fetch(ctx context.Context) (*Snapshot, error) {
+
+	start := time.Now()
+	snapshot, err := t.source.Fetch(ctx)
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.lastPoll = time.Now()
+	t.lastDuration = t.lastPoll.Sub(start)
+	t.lastErr = err
+	if err == nil {
+		t.last = snapshot
+	}
+
+	return snapshot, err
+}
+
+// state returns the last successful snapshot, the time of the last poll
+// attempt and the error it produced, if any.
+func (t *target) state() (*Snapshot, time.Time, error) {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+
+	return t.last, t.lastPoll, t.lastErr
+}
+
+// startPolling records that a poller has started polling the target.
+func (t *target) startPolling(at time.Time) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.pollingSince = at
+}
+
+// pollingStarted returns when a poller started polling the target, or the
+// zero time if none has yet.
+func (t *target) pollingStarted() time.Time {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+
+	return t.pollingSince
+}
+
+// lastPollDuration returns how long the last poll attempt took.
+func (t *target) lastPollDuration() time.Duration {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+
+	return t.lastDuration
+}
+
+// slug returns the target name reduced to characters safe in file names and
+// URL paths, e.g. nis_ups-host_3551 for nis://ups-host:3551.
+func (t *target) slug() string {
+	return targetSlug(t.name)
+}
+
+func targetSlug(name string) string {
+	return strings.Trim(unsafeSlugChars.ReplaceAllString(name, "_"), "_")
+}
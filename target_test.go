@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// fakeSource returns the snapshots and errors it is given, one per Fetch.
+type fakeSource struct {
+	results []fakeResult
+}
+
+type fakeResult struct {
+	snapshot *Snapshot
+	err      error
+}
+
+func (s *fakeSource) Fetch(ctx context.Context) (*Snapshot, error) {
+	r := s.results[0]
+	s.results = s.results[1:]
+	return r.snapshot, r.err
+}
+
+func TestTargetFetchKeepsLastSnapshot(t *testing.T) {
+
+	first := &Snapshot{Info: &upsInfo{status: "online"}}
+	second := &Snapshot{Info: &upsInfo{status: "onbatt"}}
+	refused := errors.New("connection refused")
+
+	ups := &target{name: "ups", source: &fakeSource{results: []fakeResult{{first, nil}, {nil, refused}, {second, nil}}}}
+
+	tests := []struct {
+		last *Snapshot
+		err  error
+	}{
+		{last: first},
+		{last: first, err: refused},
+		{last: second},
+	}
+
+	for i, test := range tests {
+		ups.fetch(context.Background())
+
+		last, lastPoll, lastErr := ups.state()
+		if last != test.last || lastErr != test.err || lastPoll.IsZero() {
+			t.Errorf("Poll %d: state() = %v, %v, %v, want %v and %v", i+1, last, lastPoll, lastErr, test.last, test.err)
+		}
+	}
+}
+
+func TestTargetSlug(t *testing.T) {
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"ups-host:3551", "ups-host_3551"},
+		{"nis://ups-host:3551", "nis_ups-host_3551"},
+		{"file:///var/log/apcupsd.status", "file_var_log_apcupsd.status"},
+		{"rack 1 (UPS)", "rack_1_UPS"},
+	}
+
+	for _, test := range tests {
+		if got := targetSlug(test.name); got != test.want {
+			t.Errorf("targetSlug(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+// textfileSink writes all metrics in the text format to a file for the
+// node_exporter textfile collector after every poll.
+type textfileSink struct {
+	path string
+
+	mtx sync.Mutex
+}
+
+func (s *textfileSink) polled(ctx context.Context, t *target) {
+	if err := s.write(); err != nil {
+		log.Printf("Error writing textfile %s: %+v", s.path, err)
+	}
+}
+
+// write replaces the file in one rename so node_exporter never reads a
+// partially written file.
+func (s *textfileSink) write() error {
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	families, err := gatherMetricFamilies()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), "."+filepath.Base(s.path))
+	if err != nil {
+		return err
+	}
+
+	for _, mf := range families {
+		if _, err = expfmt.MetricFamilyToText(tmp, mf); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestTextfileSinkWrite(t *testing.T) {
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name string
+		path string
+		err  bool
+	}{
+		{name: "new file", path: filepath.Join(dir, "apcupsd.prom")},
+		{name: "replaced file", path: filepath.Join(dir, "apcupsd.prom")},
+		{name: "missing directory", path: filepath.Join(dir, "missing", "apcupsd.prom"), err: true},
+	}
+
+	setTestTargets(newTestTarget("ups-host:3551", map[string]string{"site": "syd"}, &upsInfo{status: "online", upsName: "rack1", batteryChargePercent: 97}))
+	defer setTestTargets()
+
+	for _, test := range tests {
+		s := &textfileSink{path: test.path}
+		s.polled(context.Background(), nil)
+
+		err := s.write()
+		if (err != nil) != test.err {
+			t.Errorf("%s: write() = %v, want error %v", test.name, err, test.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		content, err := ioutil.ReadFile(test.path)
+		if err != nil {
+			t.Fatalf("%s: error reading textfile: %+v", test.name, err)
+		}
+		families, err := new(expfmt.TextParser).TextToMetricFamilies(bytes.NewReader(content))
+		if err != nil {
+			t.Fatalf("%s: textfile does not parse: %+v", test.name, err)
+		}
+		if _, ok := families["apcups_battery_charge_percent"]; !ok {
+			t.Errorf("%s: textfile lacks apcups_battery_charge_percent:\n%s", test.name, content)
+		}
+		if info, err := os.Stat(test.path); err != nil || info.Mode().Perm() != 0644 {
+			t.Errorf("%s: textfile mode %v, %v, want 0644", test.name, info.Mode(), err)
+		}
+	}
+
+	// Temporary files are renamed or removed, never left for node_exporter
+	// to find.
+	entries, _ := ioutil.ReadDir(dir)
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") {
+			t.Errorf("Temporary file %s left behind", e.Name())
+		}
+	}
+}
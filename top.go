@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	ansiReset  = "\033[0m"
+	ansiBold   = "\033[1m"
+	ansiRed    = "\033[41;97m"
+	ansiYellow = "\033[43;30m"
+	ansiGreen  = "\033[42;30m"
+	ansiGrey   = "\033[100;97m"
+	ansiClear  = "\033[H\033[2J"
+
+	topBarWidth = 30
+)
+
+func init() {
+	subcommands["top"] = runTop
+}
+
+// topView is what the dashboard shows for one target.
+type topView struct {
+	name     string
+	snapshot *Snapshot
+	err      error
+	events   []string
+}
+
+// runTop polls one or more targets and shows a refreshing terminal view of
+// their state, for a quick look during an outage without Grafana.
+func runTop(args []string) int {
+
+	flags := flag.NewFlagSet("top", flag.ExitOnError)
+	upsAddr := flags.String("ups", "localhost:3551", "Comma separated list of UPS targets, as for -ups-address")
+	interval := flags.Duration("interval", 2*time.Second, "How often to refresh")
+	numEvents := flags.Int("events", 5, "How many of the latest events to show per target")
+	flags.Parse(args)
+
+	var targets []*target
+	for _, name := range strings.Split(*upsAddr, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		t, err := newTarget(name, "nis")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "top: %+v\n", err)
+			return 2
+		}
+		targets = append(targets, t)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	tick := time.NewTicker(*interval)
+	defer tick.Stop()
+
+	for {
+		views := pollTop(targets, *interval, *numEvents)
+
+		var buf bytes.Buffer
+		buf.WriteString(ansiClear)
+		renderTop(&buf, views, time.Now())
+		os.Stdout.Write(buf.Bytes())
+
+		select {
+		case <-tick.C:
+		case <-signals:
+			fmt.Print(ansiReset)
+			return 0
+		}
+	}
+}
+
+// pollTop fetches all targets concurrently.
+func pollTop(targets []*target, timeout time.Duration, numEvents int) []topView {
+
+	views := make([]topView, len(targets))
+
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		go func(i int, t *target) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+
+			v := topView{name: t.name}
+			v.snapshot, v.err = t.fetch(ctx)
+
+			if es, ok := t.source.(eventSource); ok && v.err == nil {
+				if events, err := es.Events(ctx); err == nil {
+					if len(events) > numEvents {
+						events = events[len(events)-numEvents:]
+					}
+					v.events = events
+				}
+			}
+
+			views[i] = v
+		}(i, t)
+	}
+	wg.Wait()
+
+	return views
+}
+
+func renderTop(w io.Writer, views []topView, now time.Time) {
+
+	fmt.Fprintf(w, "%sapcupsd-exporter top%s  %s\n\n", ansiBold, ansiReset, now.Format("2006-01-02 15:04:05"))
+
+	for _, v := range views {
+		if v.err != nil {
+			fmt.Fprintf(w, "%s UNREACHABLE %s %s\n", ansiRed, ansiReset, v.name)
+			fmt.Fprintf(w, "  %v\n\n", v.err)
+			continue
+		}
+
+		info := v.snapshot.Info
+
+		fmt.Fprintf(w, "%s %s%s%s  (%s on %s)\n", statusBadge(info.status), ansiBold, info.upsName, ansiReset, info.model, info.hostname)
+		fmt.Fprintf(w, "  Charge    %s\n", bar(info.batteryChargePercent, 100, fmt.Sprintf("%.1f%%", info.batteryChargePercent)))
+		fmt.Fprintf(w, "  Load      %s\n", bar(info.loadPercent, 100, fmt.Sprintf("%.1f%%", info.loadPercent)))
+		fmt.Fprintf(w, "  Time left %s\n", formatDuration(info.timeLeft))
+		fmt.Fprintf(w, "  Line      %s\n", voltageBand(info.lineVoltage, info.lowTransfer, info.highTransfer))
+
+		if len(v.events) > 0 {
+			fmt.Fprintln(w, "  Events")
+			for _, e := range v.events {
+				fmt.Fprintf(w, "    %s\n", e)
+			}
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// statusBadge renders the apcupsd status words on a background colour
+// reflecting how worried to be.
+func statusBadge(status string) string {
+
+	colour := ansiGreen
+	switch {
+	case strings.Contains(status, "lowbatt"), strings.Contains(status, "commlost"),
+		strings.Contains(status, "shutting down"), strings.Contains(status, "nobatt"),
+		strings.Contains(status, "off"):
+		colour = ansiRed
+	case strings.Contains(status, "onbatt"), strings.Contains(status, "replacebatt"),
+		strings.Contains(status, "overload"), strings.Contains(status, "bypass"):
+		colour = ansiYellow
+	case status == "":
+		colour = ansiGrey
+		status = "unknown"
+	}
+
+	return fmt.Sprintf("%s %s %s", colour, strings.ToUpper(status), ansiReset)
+}
+
+func bar(value, max float64, label string) string {
+
+	filled := int(value/max*topBarWidth + 0.5)
+	if filled < 0 {
+		filled = 0
+	}
+	if filled > topBarWidth {
+		filled = topBarWidth
+	}
+
+	return fmt.Sprintf("[%s%s] %s", strings.Repeat("#", filled), strings.Repeat(".", topBarWidth-filled), label)
+}
+
+// voltageBand shows the line voltage within the LOTRANS..HITRANS band outside
+// of which the UPS transfers to battery.
+func voltageBand(volts, low, high float64) string {
+
+	if low <= 0 || high <= low {
+		return fmt.Sprintf("%.1f V", volts)
+	}
+
+	// Show some room either side of the band so out of band voltages
+	// remain visible.
+	margin := (high - low) / 4
+	min, max := low-margin, high+margin
+
+	pos := func(v float64) int {
+		p := int((v-min)/(max-min)*(topBarWidth-1) + 0.5)
+		if p < 0 {
+			return 0
+		}
+		if p > topBarWidth-1 {
+			return topBarWidth - 1
+		}
+		return p
+	}
+
+	line := []byte(strings.Repeat("-", topBarWidth))
+	line[pos(low)] = '|'
+	line[pos(high)] = '|'
+	line[pos(volts)] = '*'
+
+	marker := ""
+	if volts < low || volts > high {
+		marker = fmt.Sprintf(" %sOUT OF BAND%s", ansiRed, ansiReset)
+	}
+
+	return fmt.Sprintf("%.0f V [%s] %.0f V  %.1f V%s", low, string(line), high, volts, marker)
+}
+
+func formatDuration(d time.Duration) string {
+	d = (d + time.Second/2) / time.Second * time.Second
+	h := d / time.Hour
+	m := (d % time.Hour) / time.Minute
+	s := (d % time.Minute) / time.Second
+	if h > 0 {
+		return fmt.Sprintf("%dh%02dm%02ds", h, m, s)
+	}
+	return fmt.Sprintf("%dm%02ds", m, s)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/damomurf/apcupsd-exporter/apcupsdtest"
+)
+
+func TestFormatDuration(t *testing.T) {
+
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "0m00s"},
+		{1499 * time.Millisecond, "0m01s"},
+		{1500 * time.Millisecond, "0m02s"},
+		{104*time.Minute + 36*time.Second, "1h44m36s"},
+		{59*time.Minute + 59*time.Second + 600*time.Millisecond, "1h00m00s"},
+	}
+
+	for _, test := range tests {
+		if got := formatDuration(test.d); got != test.want {
+			t.Errorf("formatDuration(%s) = %q, want %q", test.d, got, test.want)
+		}
+	}
+}
+
+func TestBar(t *testing.T) {
+
+	tests := []struct {
+		value float64
+		want  string
+	}{
+		{0, "[" + strings.Repeat(".", 30) + "] x"},
+		{50, "[" + strings.Repeat("#", 15) + strings.Repeat(".", 15) + "] x"},
+		{100, "[" + strings.Repeat("#", 30) + "] x"},
+		{130, "[" + strings.Repeat("#", 30) + "] x"},
+		{-5, "[" + strings.Repeat(".", 30) + "] x"},
+	}
+
+	for _, test := range tests {
+		if got := bar(test.value, 100, "x"); got != test.want {
+			t.Errorf("bar(%v) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestStatusBadge(t *testing.T) {
+
+	tests := []struct {
+		status string
+		want   string
+	}{
+		{"online", ansiGreen + " ONLINE " + ansiReset},
+		{"online trim", ansiGreen + " ONLINE TRIM " + ansiReset},
+		{"onbatt", ansiYellow + " ONBATT " + ansiReset},
+		{"online replacebatt", ansiYellow + " ONLINE REPLACEBATT " + ansiReset},
+		{"onbatt lowbatt", ansiRed + " ONBATT LOWBATT " + ansiReset},
+		{"commlost", ansiRed + " COMMLOST " + ansiReset},
+		{"bypass", ansiYellow + " BYPASS " + ansiReset},
+		{"online off", ansiRed + " ONLINE OFF " + ansiReset},
+		{"", ansiGrey + " UNKNOWN " + ansiReset},
+	}
+
+	for _, test := range tests {
+		if got := statusBadge(test.status); got != test.want {
+			t.Errorf("statusBadge(%q) = %q, want %q", test.status, got, test.want)
+		}
+	}
+}
+
+func TestVoltageBand(t *testing.T) {
+
+	tests := []struct {
+		volts, low, high float64
+		want             string
+	}{
+		{volts: 230, want: "230.0 V"},
+		{volts: 230, low: 180, high: 180, want: "230.0 V"},
+		{volts: 230, low: 180, high: 280, want: "180 V [-----|---------*--------|-----] 280 V  230.0 V"},
+		{volts: 170, low: 180, high: 280, want: "180 V [---*-|------------------|-----] 280 V  170.0 V " + ansiRed + "OUT OF BAND" + ansiReset},
+		{volts: 0, low: 180, high: 280, want: "180 V [*----|------------------|-----] 280 V  0.0 V " + ansiRed + "OUT OF BAND" + ansiReset},
+	}
+
+	for _, test := range tests {
+		if got := voltageBand(test.volts, test.low, test.high); got != test.want {
+			t.Errorf("voltageBand(%v, %v, %v) = %q, want %q", test.volts, test.low, test.high, got, test.want)
+		}
+	}
+}
+
+func TestPollAndRenderTop(t *testing.T) {
+
+	srv := apcupsdtest.NewServer(apcupsdtest.DefaultStatus()...)
+	defer srv.Close()
+	srv.SetEvents("first\n", "second\n", "third\n")
+
+	down := apcupsdtest.NewServer()
+	down.Close()
+
+	var targets []*target
+	for _, addr := range []string{srv.Addr, down.Addr} {
+		ups, err := newTarget(addr, "nis")
+		if err != nil {
+			t.Fatalf("Error creating target: %+v", err)
+		}
+		targets = append(targets, ups)
+	}
+
+	views := pollTop(targets, 5*time.Second, 2)
+	if len(views) != 2 || views[0].err != nil || views[1].err == nil {
+		t.Fatalf("pollTop() = %+v, want the first target up and the second down", views)
+	}
+	if strings.Join(views[0].events, ",") != "second,third" {
+		t.Errorf("Events %q, want the last two", views[0].events)
+	}
+
+	var out bytes.Buffer
+	renderTop(&out, views, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))
+
+	for _, want := range []string{
+		"2024-01-02 03:04:05",
+		ansiBold + "backups-950" + ansiReset + "  (Back-UPS XS 950U on beaker.murf.org)",
+		"Time left 1h44m36s",
+		"    second\n    third\n",
+		ansiRed + " UNREACHABLE " + ansiReset + " " + down.Addr,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Dashboard lacks %q:\n%s", want, out.String())
+		}
+	}
+}
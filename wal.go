@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Every WAL record starts with a header of the payload length, the CRC32-C
+// of the payload and the number of samples it holds, all big endian uint32.
+const walHeaderSize = 12
+
+const walCheckpointFile = "checkpoint"
+
+var walCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// walPosition is the position of a record: a segment and an offset into it.
+type walPosition struct {
+	segment int
+	offset  int64
+}
+
+// wal is an append only queue of records on disk, kept in numbered segment
+// files so that consumed data can be deleted a segment at a time. The
+// position of the first record not yet consumed is kept in a checkpoint
+// file, so records survive restarts until they have been committed.
+type wal struct {
+	dir         string
+	segmentSize int64
+	maxSize     int64
+
+	// dropped is called with the number of samples lost when old
+	// segments are deleted to stay below maxSize.
+	dropped func(samples int)
+
+	mtx      sync.Mutex
+	head     *os.File
+	headSeg  int
+	headSize int64
+	read     walPosition
+	sizes    map[int]int64
+	queued   int
+}
+
+// openWAL opens or creates the WAL in dir. Appends always go to a new
+// segment so that a record torn by a crash stays at the end of an older one.
+func openWAL(dir string, segmentSize, maxSize int64, dropped func(int)) (*wal, error) {
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("Unable to create WAL directory: %+v", err)
+	}
+
+	w := &wal{
+		dir:         dir,
+		segmentSize: segmentSize,
+		maxSize:     maxSize,
+		dropped:     dropped,
+		sizes:       map[int]int64{},
+	}
+
+	segments, err := w.segments()
+	if err != nil {
+		return nil, err
+	}
+	for _, seg := range segments {
+		info, err := os.Stat(w.segmentPath(seg))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read WAL segment: %+v", err)
+		}
+		w.sizes[seg] = info.Size()
+	}
+
+	if err := w.loadCheckpoint(segments); err != nil {
+		return nil, err
+	}
+
+	next := 0
+	if len(segments) > 0 {
+		next = segments[len(segments)-1] + 1
+	}
+	if err := w.cut(next); err != nil {
+		return nil, err
+	}
+
+	// Count what is left to send from an earlier run.
+	for pos := w.read; ; {
+		records, samples, end, err := w.readLocked(pos, 1<<30)
+		if err != nil {
+			return nil, err
+		}
+		if len(records) == 0 {
+			break
+		}
+		w.queued += samples
+		pos = end
+	}
+
+	return w, nil
+}
+
+func (w *wal) segmentPath(seg int) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%08d", seg))
+}
+
+// segments lists the segment numbers in the WAL directory in order.
+func (w *wal) segments() ([]int, error) {
+
+	files, err := ioutil.ReadDir(w.dir)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read WAL directory: %+v", err)
+	}
+
+	var segments []int
+	for _, f := range files {
+		if seg, err := strconv.Atoi(f.Name()); err == nil && !f.IsDir() {
+			segments = append(segments, seg)
+		}
+	}
+	sort.Ints(segments)
+
+	return segments, nil
+}
+
+func (w *wal) loadCheckpoint(segments []int) error {
+
+	content, err := ioutil.ReadFile(filepath.Join(w.dir, walCheckpointFile))
+	if os.IsNotExist(err) {
+		if len(segments) > 0 {
+			w.read = walPosition{segment: segments[0]}
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to read WAL checkpoint: %+v", err)
+	}
+
+	fields := strings.Fields(string(content))
+	if len(fields) == 2 {
+		seg, segErr := strconv.Atoi(fields[0])
+		off, offErr := strconv.ParseInt(fields[1], 10, 64)
+		if segErr == nil && offErr == nil {
+			w.read = walPosition{segment: seg, offset: off}
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Invalid WAL checkpoint %q", strings.TrimSpace(string(content)))
+}
+
+// saveCheckpoint persists the read position, replacing the file in one
+// rename.
+func (w *wal) saveCheckpoint() error {
+
+	tmp, err := ioutil.TempFile(w.dir, "."+walCheckpointFile)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(tmp, "%d %d\n", w.read.segment, w.read.offset)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(w.dir, walCheckpointFile))
+}
+
+// cut starts appending to a new segment.
+func (w *wal) cut(seg int) error {
+
+	if w.head != nil {
+		if err := w.head.Close(); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(w.segmentPath(seg), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("Unable to create WAL segment: %+v", err)
+	}
+
+	w.head, w.headSeg, w.headSize = f, seg, 0
+	w.sizes[seg] = 0
+
+	return nil
+}
+
+// append adds a record holding samples samples and syncs it to disk.
+func (w *wal) append(payload []byte, samples int) error {
+
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if w.headSize >= w.segmentSize {
+		if err := w.cut(w.headSeg + 1); err != nil {
+			return err
+		}
+	}
+
+	record := make([]byte, walHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:], crc32.Checksum(payload, walCRCTable))
+	binary.BigEndian.PutUint32(record[8:], uint32(samples))
+	copy(record[walHeaderSize:], payload)
+
+	if _, err := w.head.Write(record); err != nil {
+		return fmt.Errorf("Error writing WAL record: %+v", err)
+	}
+	if err := w.head.Sync(); err != nil {
+		return fmt.Errorf("Error syncing WAL segment: %+v", err)
+	}
+
+	w.headSize += int64(len(record))
+	w.sizes[w.headSeg] = w.headSize
+	w.queued += samples
+
+	w.enforceMaxSize()
+
+	return nil
+}
+
+// enforceMaxSize deletes the oldest segments, sent or not, until the WAL
+// fits in maxSize again. The head segment is never deleted.
+func (w *wal) enforceMaxSize() {
+
+	for {
+		var total int64
+		oldest := w.headSeg
+		for seg, size := range w.sizes {
+			total += size
+			if seg < oldest {
+				oldest = seg
+			}
+		}
+		if total <= w.maxSize || oldest == w.headSeg {
+			return
+		}
+
+		if oldest >= w.read.segment {
+			from := walPosition{segment: oldest}
+			if oldest == w.read.segment {
+				from = w.read
+			}
+			_, samples, _, err := w.readSegment(from, 1<<30)
+			if err != nil {
+				log.Printf("Error reading WAL segment %d before dropping it: %+v", oldest, err)
+			}
+			w.queued -= samples
+			if w.dropped != nil {
+				w.dropped(samples)
+			}
+			w.read = walPosition{segment: oldest + 1}
+			if err := w.saveCheckpoint(); err != nil {
+				log.Printf("Error saving WAL checkpoint: %+v", err)
+			}
+		}
+
+		os.Remove(w.segmentPath(oldest))
+		delete(w.sizes, oldest)
+	}
+}
+
+// next returns the records after the read position, as many as fit in
+// maxSamples but at least one, and the position following them. Nothing is
+// consumed until commit is called with that position.
+func (w *wal) next(maxSamples int) ([][]byte, int, walPosition, error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	return w.readLocked(w.read, maxSamples)
+}
+
+func (w *wal) readLocked(pos walPosition, maxSamples int) ([][]byte, int, walPosition, error) {
+
+	for {
+		records, samples, end, err := w.readSegment(pos, maxSamples)
+		if err != nil || len(records) > 0 || pos.segment >= w.headSeg {
+			return records, samples, end, err
+		}
+
+		// Nothing more in an older segment, move on to the next one.
+		pos = walPosition{segment: pos.segment + 1}
+		for pos.segment < w.headSeg {
+			if _, ok := w.sizes[pos.segment]; ok {
+				break
+			}
+			pos.segment++
+		}
+	}
+}
+
+// readSegment reads records from a single segment. A record that is torn,
+// claims a length beyond the end of the segment or fails its checksum is
+// truncated off with the rest of the segment.
+func (w *wal) readSegment(pos walPosition, maxSamples int) ([][]byte, int, walPosition, error) {
+
+	size, ok := w.sizes[pos.segment]
+	if !ok || pos.offset >= size {
+		return nil, 0, pos, nil
+	}
+
+	f, err := os.Open(w.segmentPath(pos.segment))
+	if err != nil {
+		return nil, 0, pos, fmt.Errorf("Unable to open WAL segment: %+v", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(pos.offset, io.SeekStart); err != nil {
+		return nil, 0, pos, fmt.Errorf("Unable to seek in WAL segment: %+v", err)
+	}
+	r := bufio.NewReader(io.LimitReader(f, size-pos.offset))
+
+	var (
+		records [][]byte
+		samples int
+		header  = make([]byte, walHeaderSize)
+	)
+	for samples < maxSamples || len(records) == 0 {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err != io.EOF {
+				w.truncateCorrupt(pos, "torn record header")
+			}
+			break
+		}
+
+		// A length beyond the end of the segment is a corrupt header, not
+		// a reason to allocate up to 4GiB.
+		length := int64(binary.BigEndian.Uint32(header[0:]))
+		if length > size-pos.offset-walHeaderSize {
+			w.truncateCorrupt(pos, fmt.Sprintf("record length %d beyond the end of the segment", length))
+			break
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			w.truncateCorrupt(pos, "torn record")
+			break
+		}
+		if crc32.Checksum(payload, walCRCTable) != binary.BigEndian.Uint32(header[4:]) {
+			w.truncateCorrupt(pos, "checksum mismatch")
+			break
+		}
+
+		records = append(records, payload)
+		samples += int(binary.BigEndian.Uint32(header[8:]))
+		pos.offset += int64(walHeaderSize + len(payload))
+	}
+
+	return records, samples, pos, nil
+}
+
+// truncateCorrupt cuts a segment off at the corrupt record at pos, so that
+// reads continue with the next segment. The head segment is only ever
+// written whole and is left alone.
+func (w *wal) truncateCorrupt(pos walPosition, reason string) {
+
+	if pos.segment == w.headSeg {
+		return
+	}
+
+	log.Printf("Truncating WAL segment %d at offset %d: %s", pos.segment, pos.offset, reason)
+	if err := os.Truncate(w.segmentPath(pos.segment), pos.offset); err != nil {
+		log.Printf("Error truncating WAL segment %d: %+v", pos.segment, err)
+	}
+	w.sizes[pos.segment] = pos.offset
+}
+
+// commit marks everything before pos as consumed and deletes segments that
+// have been consumed completely.
+func (w *wal) commit(pos walPosition, samples int) error {
+
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	// The segment was dropped to make room while its records were being
+	// sent, its samples are already accounted for.
+	if pos.segment < w.read.segment {
+		return nil
+	}
+
+	w.read = pos
+	w.queued -= samples
+
+	for seg := range w.sizes {
+		if seg < pos.segment {
+			os.Remove(w.segmentPath(seg))
+			delete(w.sizes, seg)
+		}
+	}
+
+	return w.saveCheckpoint()
+}
+
+// stats returns the number of samples not yet consumed and the size of the
+// WAL on disk.
+func (w *wal) stats() (int, int64) {
+
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	var total int64
+	for _, size := range w.sizes {
+		total += size
+	}
+
+	return w.queued, total
+}
+
+func (w *wal) Close() error {
+
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	return w.head.Close()
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// walRecord encodes a record the way wal.append does, with the given CRC.
+func walRecord(payload []byte, samples int, crc uint32) []byte {
+	record := make([]byte, walHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:], crc)
+	binary.BigEndian.PutUint32(record[8:], uint32(samples))
+	copy(record[walHeaderSize:], payload)
+	return record
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "apcupsd-exporter")
+	if err != nil {
+		t.Fatalf("Error creating directory: %+v", err)
+	}
+	return dir
+}
+
+// drainWAL reads and commits every record left in w.
+func drainWAL(t *testing.T, w *wal) []string {
+
+	var records []string
+	for {
+		batch, samples, end, err := w.next(1)
+		if err != nil {
+			t.Fatalf("Error reading: %+v", err)
+		}
+		if len(batch) == 0 {
+			return records
+		}
+		for _, r := range batch {
+			records = append(records, string(r))
+		}
+		if err := w.commit(end, samples); err != nil {
+			t.Fatalf("Error committing: %+v", err)
+		}
+	}
+}
+
+func TestWALPersistsUncommittedRecords(t *testing.T) {
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	w, err := openWAL(dir, 1<<20, 1<<30, nil)
+	if err != nil {
+		t.Fatalf("Error opening WAL: %+v", err)
+	}
+	for i, payload := range []string{"one", "two", "three"} {
+		if err := w.append([]byte(payload), i+1); err != nil {
+			t.Fatalf("Error appending: %+v", err)
+		}
+	}
+
+	records, samples, end, err := w.next(2)
+	if err != nil {
+		t.Fatalf("Error reading: %+v", err)
+	}
+	if len(records) != 2 || samples != 3 {
+		t.Fatalf("next(2) = %d records with %d samples, want 2 with 3", len(records), samples)
+	}
+	if err := w.commit(end, samples); err != nil {
+		t.Fatalf("Error committing: %+v", err)
+	}
+	w.Close()
+
+	w, err = openWAL(dir, 1<<20, 1<<30, nil)
+	if err != nil {
+		t.Fatalf("Error reopening WAL: %+v", err)
+	}
+	defer w.Close()
+
+	if queued, _ := w.stats(); queued != 3 {
+		t.Errorf("%d samples queued after reopening, want 3", queued)
+	}
+	records, _, _, err = w.next(100)
+	if err != nil || len(records) != 1 || string(records[0]) != "three" {
+		t.Errorf("next() after reopening = %q, %v, want the uncommitted record", records, err)
+	}
+}
+
+func TestWALTruncatesCorruptTail(t *testing.T) {
+
+	good := walRecord([]byte("good"), 5, crc32.Checksum([]byte("good"), walCRCTable))
+
+	// A length field of 4GiB must not be allocated.
+	hugeLength := walRecord(nil, 1, 0)
+	binary.BigEndian.PutUint32(hugeLength, 0xffffffff)
+
+	tests := []struct {
+		name string
+		tail []byte
+	}{
+		{"torn header", []byte{0, 0, 0}},
+		{"length beyond segment", hugeLength},
+		{"torn record", walRecord([]byte("payload"), 1, crc32.Checksum([]byte("payload"), walCRCTable))[:walHeaderSize+3]},
+		{"checksum mismatch", walRecord([]byte("payload"), 1, 42)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			dir := tempDir(t)
+			defer os.RemoveAll(dir)
+
+			segment := filepath.Join(dir, "00000000")
+			if err := ioutil.WriteFile(segment, append(append([]byte{}, good...), test.tail...), 0644); err != nil {
+				t.Fatalf("Error writing segment: %+v", err)
+			}
+
+			w, err := openWAL(dir, 1<<20, 1<<30, nil)
+			if err != nil {
+				t.Fatalf("Error opening WAL: %+v", err)
+			}
+			defer w.Close()
+
+			if queued, _ := w.stats(); queued != 5 {
+				t.Errorf("%d samples queued, want the 5 of the good record", queued)
+			}
+			if info, err := os.Stat(segment); err != nil || info.Size() != int64(len(good)) {
+				t.Errorf("Segment not truncated to the good record: %v, %v", info.Size(), err)
+			}
+
+			if err := w.append([]byte("new"), 1); err != nil {
+				t.Fatalf("Error appending: %+v", err)
+			}
+
+			got := drainWAL(t, w)
+			if len(got) != 2 || got[0] != "good" || got[1] != "new" {
+				t.Errorf("Read %q, want the good record and the new one", got)
+			}
+		})
+	}
+}
+
+func TestWALEnforcesMaxSize(t *testing.T) {
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	dropped := 0
+	w, err := openWAL(dir, 30, 100, func(samples int) { dropped += samples })
+	if err != nil {
+		t.Fatalf("Error opening WAL: %+v", err)
+	}
+	defer w.Close()
+
+	payload := make([]byte, 20)
+	for i := 0; i < 10; i++ {
+		if err := w.append(payload, 1); err != nil {
+			t.Fatalf("Error appending: %+v", err)
+		}
+	}
+
+	queued, size := w.stats()
+	if size > 100 {
+		t.Errorf("WAL is %d bytes, want at most 100", size)
+	}
+	if dropped == 0 || queued+dropped != 10 {
+		t.Errorf("%d samples queued and %d dropped, want 10 in total with some dropped", queued, dropped)
+	}
+
+	if records := drainWAL(t, w); len(records) != queued {
+		t.Errorf("Read %d records, want the %d queued", len(records), queued)
+	}
+}
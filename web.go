@@ -0,0 +1,343 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+// webConfig is the contents of the file given with --web.config.file. It
+// follows the layout of the Prometheus exporter-toolkit web configuration,
+// with an additional IP allowlist:
+//
+//	tls_server_config:
+//	  cert_file: /etc/ups-exporter/tls.crt
+//	  key_file: /etc/ups-exporter/tls.key
+//	  client_ca_file: /etc/ups-exporter/clients.crt
+//	  client_auth_type: RequireAndVerifyClientCert
+//	  min_version: TLS12
+//	basic_auth_users:
+//	  prometheus: $2y$10$...
+//	ip_allowlist:
+//	  - 10.0.0.0/8
+//	  - 192.0.2.10
+type webConfig struct {
+	TLSConfig      *tlsServerConfig  `yaml:"tls_server_config"`
+	BasicAuthUsers map[string]string `yaml:"basic_auth_users"`
+	IPAllowlist    []string          `yaml:"ip_allowlist"`
+}
+
+type tlsServerConfig struct {
+	CertFile                 string   `yaml:"cert_file"`
+	KeyFile                  string   `yaml:"key_file"`
+	ClientCAFile             string   `yaml:"client_ca_file"`
+	ClientAuthType           string   `yaml:"client_auth_type"`
+	MinVersion               string   `yaml:"min_version"`
+	CipherSuites             []string `yaml:"cipher_suites"`
+	PreferServerCipherSuites bool     `yaml:"prefer_server_cipher_suites"`
+}
+
+// tlsVersion13 is tls.VersionTLS13, which is not defined before Go 1.12.
+const tlsVersion13 = 0x0304
+
+var tlsVersions = map[string]uint16{
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tlsVersion13,
+}
+
+var tlsClientAuthTypes = map[string]tls.ClientAuthType{
+	"NoClientCert":               tls.NoClientCert,
+	"RequestClientCert":          tls.RequestClientCert,
+	"RequireAnyClientCert":       tls.RequireAnyClientCert,
+	"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+	"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+}
+
+// tlsCipherSuites lists the cipher suites that may be configured, leaving out
+// RC4 and 3DES. They only apply up to TLS 1.2; TLS 1.3 suites are not
+// configurable.
+var tlsCipherSuites = map[string]uint16{
+	"TLS_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":   tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384": tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305":    tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305":  tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+}
+
+// loadWebConfig reads and validates a web configuration file.
+func loadWebConfig(path string) (*webConfig, error) {
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read web configuration file: %+v", err)
+	}
+
+	cfg := &webConfig{}
+	if err := yaml.UnmarshalStrict(content, cfg); err != nil {
+		return nil, fmt.Errorf("Unable to parse web configuration file %s: %+v", path, err)
+	}
+
+	for user, hash := range cfg.BasicAuthUsers {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("Invalid bcrypt hash for user %q in %s: %+v", user, path, err)
+		}
+	}
+
+	if _, err := parseAllowlist(cfg.IPAllowlist); err != nil {
+		return nil, fmt.Errorf("Invalid ip_allowlist in %s: %+v", path, err)
+	}
+
+	return cfg, nil
+}
+
+// newTLSConfig builds the server TLS configuration. The certificate and key
+// are reloaded whenever either file changes.
+func (c *tlsServerConfig) newTLSConfig() (*tls.Config, error) {
+
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, fmt.Errorf("Both cert_file and key_file are required in tls_server_config")
+	}
+
+	certs := &certReloader{certFile: c.CertFile, keyFile: c.KeyFile}
+	if _, err := certs.GetCertificate(nil); err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		GetCertificate:           certs.GetCertificate,
+		MinVersion:               tls.VersionTLS12,
+		PreferServerCipherSuites: c.PreferServerCipherSuites,
+	}
+
+	if c.MinVersion != "" {
+		version, ok := tlsVersions[c.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("Unknown min_version %q, expected TLS10, TLS11, TLS12 or TLS13", c.MinVersion)
+		}
+		cfg.MinVersion = version
+	}
+
+	for _, name := range c.CipherSuites {
+		id, ok := tlsCipherSuites[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown or insecure cipher suite %q", name)
+		}
+		cfg.CipherSuites = append(cfg.CipherSuites, id)
+	}
+
+	if c.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read client_ca_file: %+v", err)
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in client_ca_file %s", c.ClientCAFile)
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	if c.ClientAuthType != "" {
+		authType, ok := tlsClientAuthTypes[c.ClientAuthType]
+		if !ok {
+			return nil, fmt.Errorf("Unknown client_auth_type %q", c.ClientAuthType)
+		}
+		if (authType == tls.VerifyClientCertIfGiven || authType == tls.RequireAndVerifyClientCert) && cfg.ClientCAs == nil {
+			return nil, fmt.Errorf("client_auth_type %s requires client_ca_file", c.ClientAuthType)
+		}
+		cfg.ClientAuth = authType
+	}
+
+	return cfg, nil
+}
+
+// certReloader serves a certificate and key pair from disk, loading them
+// again when either file's modification time changes. If a changed pair
+// cannot be loaded, e.g. while only one of the files has been replaced, the
+// previous pair is kept.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mtx       sync.Mutex
+	cert      *tls.Certificate
+	certMtime time.Time
+	keyMtime  time.Time
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	certInfo, certErr := os.Stat(r.certFile)
+	keyInfo, keyErr := os.Stat(r.keyFile)
+
+	if certErr == nil && keyErr == nil && r.cert != nil &&
+		certInfo.ModTime().Equal(r.certMtime) && keyInfo.ModTime().Equal(r.keyMtime) {
+		return r.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		if r.cert != nil {
+			log.Printf("Error reloading TLS certificate, keeping the previous one: %+v", err)
+			return r.cert, nil
+		}
+		return nil, fmt.Errorf("Unable to load TLS certificate: %+v", err)
+	}
+
+	if r.cert != nil {
+		log.Printf("Reloaded TLS certificate %s", r.certFile)
+	}
+
+	r.cert = &cert
+	if certErr == nil && keyErr == nil {
+		r.certMtime, r.keyMtime = certInfo.ModTime(), keyInfo.ModTime()
+	}
+
+	return r.cert, nil
+}
+
+// parseAllowlist parses networks in CIDR notation or single addresses.
+func parseAllowlist(entries []string) ([]*net.IPNet, error) {
+
+	var networks []*net.IPNet
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", entry)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			entry = fmt.Sprintf("%s/%d", entry, bits)
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", entry)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// webHandler applies the IP allowlist and basic authentication to every
+// request before passing it on.
+type webHandler struct {
+	handler  http.Handler
+	allowed  []*net.IPNet
+	users    map[string]string
+	cacheMtx sync.Mutex
+	verified map[[sha256.Size]byte]bool
+}
+
+// newWebHandler wraps h with the access controls of cfg.
+func newWebHandler(h http.Handler, cfg *webConfig) http.Handler {
+
+	allowed, _ := parseAllowlist(cfg.IPAllowlist)
+
+	return &webHandler{
+		handler:  h,
+		allowed:  allowed,
+		users:    cfg.BasicAuthUsers,
+		verified: map[[sha256.Size]byte]bool{},
+	}
+}
+
+func (h *webHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if len(h.allowed) > 0 && !h.allowedAddr(r.RemoteAddr) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if len(h.users) > 0 {
+		user, password, ok := r.BasicAuth()
+		if !ok || !h.authenticate(user, password) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="apcupsd-exporter"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	h.handler.ServeHTTP(w, r)
+}
+
+func (h *webHandler) allowedAddr(remoteAddr string) bool {
+
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range h.allowed {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate checks a user's password against its bcrypt hash. Successful
+// checks are remembered so that every scrape does not pay for bcrypt.
+func (h *webHandler) authenticate(user, password string) bool {
+
+	hash, ok := h.users[user]
+	if !ok {
+		// Compare anyway so that unknown users take as long as known ones.
+		bcrypt.CompareHashAndPassword([]byte("$2y$10$QOauhQNbBCuQDKes6eFzPeMqBSjb7Mr5DUmpZ/VcEd00UAV/LDeSi"), []byte(password))
+		return false
+	}
+
+	key := sha256.Sum256([]byte(user + "\x00" + hash + "\x00" + password))
+
+	h.cacheMtx.Lock()
+	verified := h.verified[key]
+	h.cacheMtx.Unlock()
+	if verified {
+		return true
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false
+	}
+
+	h.cacheMtx.Lock()
+	h.verified[key] = true
+	h.cacheMtx.Unlock()
+
+	return true
+}
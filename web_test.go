@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// writeTestCert writes a self-signed certificate and its key to
+// dir/name.crt and dir/name.key.
+func writeTestCert(t *testing.T, dir, name string) (string, string) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %+v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Error creating certificate: %+v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Error encoding key: %+v", err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+
+	return certFile, keyFile
+}
+
+func TestParseAllowlist(t *testing.T) {
+
+	tests := []struct {
+		entries []string
+		want    []string
+		err     bool
+	}{
+		{entries: nil},
+		{entries: []string{"10.0.0.0/8", "192.0.2.10", "2001:db8::1", "2001:db8:1::/48"}, want: []string{"10.0.0.0/8", "192.0.2.10/32", "2001:db8::1/128", "2001:db8:1::/48"}},
+		{entries: []string{"192.0.2.300"}, err: true},
+		{entries: []string{"10.0.0.0/33"}, err: true},
+	}
+
+	for _, test := range tests {
+		networks, err := parseAllowlist(test.entries)
+		if (err != nil) != test.err {
+			t.Errorf("parseAllowlist(%q) = %v, want error %v", test.entries, err, test.err)
+			continue
+		}
+		var got []string
+		for _, n := range networks {
+			got = append(got, n.String())
+		}
+		if strings.Join(got, " ") != strings.Join(test.want, " ") {
+			t.Errorf("parseAllowlist(%q) = %q, want %q", test.entries, got, test.want)
+		}
+	}
+}
+
+func TestWebHandler(t *testing.T) {
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Error hashing password: %+v", err)
+	}
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := newWebHandler(ok, &webConfig{
+		BasicAuthUsers: map[string]string{"prometheus": string(hash)},
+		IPAllowlist:    []string{"10.0.0.0/8", "2001:db8::1"},
+	})
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		user       string
+		password   string
+		code       int
+	}{
+		{name: "allowed", remoteAddr: "10.1.2.3:4567", user: "prometheus", password: "secret", code: http.StatusOK},
+		{name: "allowed again from the cache", remoteAddr: "10.1.2.3:4567", user: "prometheus", password: "secret", code: http.StatusOK},
+		{name: "allowed over IPv6", remoteAddr: "[2001:db8::1]:4567", user: "prometheus", password: "secret", code: http.StatusOK},
+		{name: "address not allowed", remoteAddr: "192.0.2.1:4567", user: "prometheus", password: "secret", code: http.StatusForbidden},
+		{name: "wrong password", remoteAddr: "10.1.2.3:4567", user: "prometheus", password: "guess", code: http.StatusUnauthorized},
+		{name: "unknown user", remoteAddr: "10.1.2.3:4567", user: "grafana", password: "secret", code: http.StatusUnauthorized},
+		{name: "no credentials", remoteAddr: "10.1.2.3:4567", code: http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		req.RemoteAddr = test.remoteAddr
+		if test.user != "" {
+			req.SetBasicAuth(test.user, test.password)
+		}
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if rec.Code != test.code {
+			t.Errorf("%s: status %d, want %d", test.name, rec.Code, test.code)
+		}
+		if (test.code == http.StatusUnauthorized) != (rec.Header().Get("WWW-Authenticate") != "") {
+			t.Errorf("%s: WWW-Authenticate %q", test.name, rec.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
+
+func TestLoadWebConfig(t *testing.T) {
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{name: "valid", content: "basic_auth_users:\n  prometheus: $2y$10$QOauhQNbBCuQDKes6eFzPeMqBSjb7Mr5DUmpZ/VcEd00UAV/LDeSi\nip_allowlist: [10.0.0.0/8]\n"},
+		{name: "plain password", content: "basic_auth_users:\n  prometheus: secret\n", err: `Invalid bcrypt hash for user "prometheus"`},
+		{name: "invalid allowlist", content: "ip_allowlist: [localhost]\n", err: "Invalid ip_allowlist"},
+		{name: "unknown field", content: "tls_config: {}\n", err: "Unable to parse"},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join(dir, "web.yml")
+		ioutil.WriteFile(path, []byte(test.content), 0644)
+
+		_, err := loadWebConfig(path)
+		if test.err == "" && err != nil {
+			t.Errorf("%s: unexpected error: %+v", test.name, err)
+		}
+		if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: error = %v, want one containing %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestCert(t, dir, "server")
+	caFile, _ := writeTestCert(t, dir, "ca")
+
+	tests := []struct {
+		name       string
+		config     tlsServerConfig
+		minVersion uint16
+		clientAuth tls.ClientAuthType
+		err        string
+	}{
+		{name: "defaults", config: tlsServerConfig{CertFile: certFile, KeyFile: keyFile}, minVersion: tls.VersionTLS12},
+		{name: "min version", config: tlsServerConfig{CertFile: certFile, KeyFile: keyFile, MinVersion: "TLS13"}, minVersion: tlsVersion13},
+		{name: "client CA", config: tlsServerConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile}, minVersion: tls.VersionTLS12, clientAuth: tls.RequireAndVerifyClientCert},
+		{name: "optional client certificate", config: tlsServerConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile, ClientAuthType: "VerifyClientCertIfGiven"}, minVersion: tls.VersionTLS12, clientAuth: tls.VerifyClientCertIfGiven},
+		{name: "missing key", config: tlsServerConfig{CertFile: certFile}, err: "Both cert_file and key_file"},
+		{name: "unreadable certificate", config: tlsServerConfig{CertFile: keyFile, KeyFile: keyFile}, err: "Unable to load TLS certificate"},
+		{name: "unknown version", config: tlsServerConfig{CertFile: certFile, KeyFile: keyFile, MinVersion: "SSL3"}, err: "Unknown min_version"},
+		{name: "insecure cipher", config: tlsServerConfig{CertFile: certFile, KeyFile: keyFile, CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}}, err: "insecure cipher suite"},
+		{name: "verification without CA", config: tlsServerConfig{CertFile: certFile, KeyFile: keyFile, ClientAuthType: "RequireAndVerifyClientCert"}, err: "requires client_ca_file"},
+		{name: "CA without certificates", config: tlsServerConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: keyFile}, err: "No certificates found"},
+	}
+
+	for _, test := range tests {
+		cfg, err := test.config.newTLSConfig()
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: newTLSConfig() = %v, want an error containing %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %+v", test.name, err)
+			continue
+		}
+		if cfg.MinVersion != test.minVersion || cfg.ClientAuth != test.clientAuth {
+			t.Errorf("%s: min version %x and client auth %v, want %x and %v", test.name, cfg.MinVersion, cfg.ClientAuth, test.minVersion, test.clientAuth)
+		}
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestCert(t, dir, "server")
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+
+	subject := func() string {
+		cert, err := r.GetCertificate(nil)
+		if err != nil {
+			t.Fatalf("Error getting certificate: %+v", err)
+		}
+		parsed, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatalf("Error parsing certificate: %+v", err)
+		}
+		return parsed.Subject.CommonName
+	}
+
+	// Modification times are compared, so make every change visible.
+	touch := func(path string, n int) {
+		at := time.Now().Add(time.Duration(n) * time.Minute)
+		os.Chtimes(path, at, at)
+	}
+
+	tests := []struct {
+		name   string
+		change func()
+		want   string
+	}{
+		{name: "initial", change: func() {}, want: "server"},
+		{name: "replaced pair", change: func() {
+			newCert, newKey := writeTestCert(t, dir, "renewed")
+			os.Rename(newCert, certFile)
+			os.Rename(newKey, keyFile)
+			touch(certFile, 1)
+			touch(keyFile, 1)
+		}, want: "renewed"},
+		{name: "only the certificate replaced", change: func() {
+			newCert, _ := writeTestCert(t, dir, "half")
+			os.Rename(newCert, certFile)
+			touch(certFile, 2)
+		}, want: "renewed"},
+		{name: "files removed", change: func() {
+			os.Remove(certFile)
+			os.Remove(keyFile)
+		}, want: "renewed"},
+	}
+
+	for _, test := range tests {
+		test.change()
+		if got := subject(); got != test.want {
+			t.Errorf("%s: serving %s, want %s", test.name, got, test.want)
+		}
+	}
+}
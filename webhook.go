@@ -0,0 +1,622 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	webhookQueueSize    = 100
+	webhookMinBackoff   = time.Second
+	webhookMaxBackoff   = time.Minute
+	webhookFlushTimeout = 5 * time.Second
+)
+
+// The transitions a webhook can be notified of.
+const (
+	webhookOnBattery   = "onbatt"
+	webhookRestored    = "restored"
+	webhookLowBattery  = "lowbatt"
+	webhookReplaceBatt = "replacebatt"
+	webhookCommLost    = "commlost"
+	webhookUnreachable = "unreachable"
+	webhookReachable   = "reachable"
+)
+
+var webhookEvents = []string{
+	webhookOnBattery, webhookRestored, webhookLowBattery, webhookReplaceBatt,
+	webhookCommLost, webhookUnreachable, webhookReachable,
+}
+
+var (
+	webhookEventsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "apcups_webhook_events_total",
+		Help: "Status transitions detected for webhook notifications",
+	},
+		[]string{"event"},
+	)
+
+	webhookDeliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "apcups_webhook_deliveries_total",
+		Help: "Webhook notifications by outcome: delivered, or dead_lettered once retries ran out",
+	},
+		[]string{"webhook", "result"},
+	)
+
+	webhookRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "apcups_webhook_retries_total",
+		Help: "Webhook requests retried after a failure",
+	},
+		[]string{"webhook"},
+	)
+)
+
+// defaultWebhookTemplate posts the event itself as JSON.
+const defaultWebhookTemplate = `{{json .}}`
+
+// webhookFileConfig is the contents of the file given with
+// --webhook.config.file, e.g.
+//
+//	dead_letter_file: /var/lib/ups-exporter/webhooks.dead
+//	webhooks:
+//	  - name: slack
+//	    url: https://hooks.slack.com/services/T000/B000/XXXX
+//	    template: '{"text": {{json .Summary}}}'
+//	  - name: ntfy
+//	    url: https://ntfy.sh/ups-alerts
+//	    events: [onbatt, lowbatt, restored]
+//	    content_type: text/plain
+//	    template: '{{.Summary}}'
+type webhookFileConfig struct {
+	DeadLetterFile string          `yaml:"dead_letter_file"`
+	Webhooks       []webhookConfig `yaml:"webhooks"`
+}
+
+// webhookConfig is a single endpoint to notify.
+type webhookConfig struct {
+	Name         string            `yaml:"name"`
+	URL          string            `yaml:"url"`
+	Events       []string          `yaml:"events"`
+	Headers      map[string]string `yaml:"headers"`
+	ContentType  string            `yaml:"content_type"`
+	Template     string            `yaml:"template"`
+	TemplateFile string            `yaml:"template_file"`
+	MaxRetries   *int              `yaml:"max_retries"`
+	Timeout      time.Duration     `yaml:"timeout"`
+}
+
+// webhookEvent is a status transition of a target. It is the data the body
+// templates are executed with, and the default body.
+type webhookEvent struct {
+	Event   string            `json:"event"`
+	Summary string            `json:"summary"`
+	ID      string            `json:"id"`
+	Target  string            `json:"target"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Time    time.Time         `json:"time"`
+
+	// OutageSeconds is how long the UPS has been on battery for onbatt,
+	// lowbatt and restored, or the target unreachable for reachable.
+	OutageSeconds *float64 `json:"outage_seconds,omitempty"`
+	Error         string   `json:"error,omitempty"`
+
+	Before *upsJSON `json:"before"`
+	After  *upsJSON `json:"after"`
+}
+
+// webhookTargetState is what the sink remembers of a target between polls.
+// downSince is only set once unreachable has been notified, so that
+// reachable is never sent on its own.
+type webhookTargetState struct {
+	up          bool
+	info        *upsInfo
+	onBattSince time.Time
+	downSince   time.Time
+}
+
+// webhook delivers the events it subscribed to, one at a time and in order,
+// from its own queue.
+type webhook struct {
+	name        string
+	url         string
+	events      map[string]bool
+	headers     map[string]string
+	contentType string
+	template    *template.Template
+	maxRetries  int
+	client      *http.Client
+
+	queue chan *webhookEvent
+	done  chan struct{}
+}
+
+// webhookSink watches the status of every target and notifies webhooks of
+// transitions as soon as a poll shows them, without waiting for Prometheus
+// to scrape and evaluate rules. Notifications that cannot be delivered are
+// appended to a dead-letter file.
+type webhookSink struct {
+	webhooks       []*webhook
+	deadLetterFile string
+
+	mtx     sync.Mutex
+	states  map[*target]*webhookTargetState
+	closed  bool
+	dlqLock sync.Mutex
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func init() {
+	prometheus.MustRegister(webhookEventsTotal)
+	prometheus.MustRegister(webhookDeliveries)
+	prometheus.MustRegister(webhookRetries)
+}
+
+// loadWebhookConfig reads and validates a webhook configuration file.
+func loadWebhookConfig(path string) (*webhookFileConfig, error) {
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read webhook configuration file: %+v", err)
+	}
+
+	cfg := &webhookFileConfig{}
+	if err := yaml.UnmarshalStrict(content, cfg); err != nil {
+		return nil, fmt.Errorf("Unable to parse webhook configuration file %s: %+v", path, err)
+	}
+
+	if len(cfg.Webhooks) == 0 {
+		return nil, fmt.Errorf("No webhooks configured in %s", path)
+	}
+
+	return cfg, nil
+}
+
+func newWebhookSink(cfg *webhookFileConfig) (*webhookSink, error) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &webhookSink{
+		deadLetterFile: cfg.DeadLetterFile,
+		states:         map[*target]*webhookTargetState{},
+		ctx:            ctx,
+		cancel:         cancel,
+	}
+
+	names := map[string]bool{}
+	for i, wc := range cfg.Webhooks {
+		if wc.Name == "" {
+			wc.Name = fmt.Sprintf("webhook%d", i+1)
+		}
+		if names[wc.Name] {
+			cancel()
+			return nil, fmt.Errorf("Webhook %q configured twice", wc.Name)
+		}
+		names[wc.Name] = true
+
+		w, err := newWebhook(wc)
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("Invalid webhook %q: %+v", wc.Name, err)
+		}
+		s.webhooks = append(s.webhooks, w)
+	}
+
+	for _, w := range s.webhooks {
+		go s.run(w)
+	}
+
+	return s, nil
+}
+
+func newWebhook(wc webhookConfig) (*webhook, error) {
+
+	if wc.URL == "" {
+		return nil, fmt.Errorf("missing url")
+	}
+	if !strings.Contains(wc.URL, "://") {
+		wc.URL = "http://" + wc.URL
+	}
+
+	w := &webhook{
+		name:        wc.Name,
+		url:         wc.URL,
+		events:      map[string]bool{},
+		headers:     wc.Headers,
+		contentType: wc.ContentType,
+		maxRetries:  5,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		queue:       make(chan *webhookEvent, webhookQueueSize),
+		done:        make(chan struct{}),
+	}
+
+	if wc.MaxRetries != nil {
+		if *wc.MaxRetries < 0 {
+			return nil, fmt.Errorf("max_retries must not be negative")
+		}
+		w.maxRetries = *wc.MaxRetries
+	}
+	if wc.Timeout > 0 {
+		w.client.Timeout = wc.Timeout
+	}
+
+	events := wc.Events
+	if len(events) == 0 {
+		events = webhookEvents
+	}
+	for _, event := range events {
+		known := false
+		for _, e := range webhookEvents {
+			known = known || e == event
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown event %q, expected one of %s", event, strings.Join(webhookEvents, ", "))
+		}
+		w.events[event] = true
+	}
+
+	text := wc.Template
+	switch {
+	case wc.Template != "" && wc.TemplateFile != "":
+		return nil, fmt.Errorf("only one of template and template_file may be given")
+	case wc.TemplateFile != "":
+		content, err := ioutil.ReadFile(wc.TemplateFile)
+		if err != nil {
+			return nil, err
+		}
+		text = string(content)
+	case text == "":
+		text = defaultWebhookTemplate
+	}
+
+	tmpl, err := template.New(wc.Name).Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+		"duration": func(seconds float64) string {
+			return formatDuration(time.Duration(seconds * float64(time.Second)))
+		},
+	}).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	w.template = tmpl
+
+	if w.contentType == "" {
+		w.contentType = "application/json"
+	}
+
+	return w, nil
+}
+
+func (s *webhookSink) polled(ctx context.Context, t *target) {
+
+	snapshot, lastPoll, lastErr := t.state()
+	if lastPoll.IsZero() {
+		return
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	prev, seen := s.states[t]
+	cur := &webhookTargetState{up: lastErr == nil}
+	if snapshot != nil {
+		cur.info = snapshot.Info
+	}
+	s.states[t] = cur
+
+	// The first poll only establishes what is normal for the target, so
+	// that restarting the exporter does not repeat notifications. A target
+	// that cannot be reached yet is not notified as reachable later either.
+	if !seen {
+		if cur.up && hasStatusFlag(cur.info, "onbatt") {
+			cur.onBattSince = onBatterySince(cur.info, lastPoll)
+		}
+		return
+	}
+
+	cur.onBattSince = prev.onBattSince
+	cur.downSince = prev.downSince
+
+	event := func(name, summary string, since time.Time) {
+		e := &webhookEvent{
+			Event:   name,
+			Summary: summary,
+			ID:      t.slug(),
+			Target:  t.name,
+			Labels:  t.labels,
+			Time:    lastPoll,
+		}
+		if !since.IsZero() {
+			outage := lastPoll.Sub(since).Seconds()
+			e.OutageSeconds = &outage
+		}
+		if lastErr != nil {
+			e.Error = lastErr.Error()
+		}
+		if prev.info != nil {
+			e.Before = newUPSJSON(prev.info)
+		}
+		if cur.info != nil {
+			e.After = newUPSJSON(cur.info)
+		}
+		s.notify(e)
+	}
+
+	name := webhookTargetName(t, cur.info)
+
+	if !cur.up {
+		if prev.up {
+			cur.downSince = lastPoll
+			event(webhookUnreachable, fmt.Sprintf("%s is unreachable: %+v", name, lastErr), time.Time{})
+		}
+		// Keep the last known status to compare the next successful poll
+		// against.
+		cur.info = prev.info
+		return
+	}
+
+	if !prev.up && !cur.downSince.IsZero() {
+		event(webhookReachable, fmt.Sprintf("%s is reachable again", name), cur.downSince)
+		cur.downSince = time.Time{}
+	}
+
+	raised := func(flag string) bool {
+		return hasStatusFlag(cur.info, flag) && !hasStatusFlag(prev.info, flag)
+	}
+
+	if raised("commlost") {
+		event(webhookCommLost, fmt.Sprintf("%s: apcupsd lost communication with the UPS", name), time.Time{})
+	}
+	// Whether the UPS is on battery is tracked by onBattSince rather than
+	// the previous status, which lacks ONBATT while communication is lost.
+	if hasStatusFlag(cur.info, "onbatt") && cur.onBattSince.IsZero() {
+		cur.onBattSince = onBatterySince(cur.info, lastPoll)
+		event(webhookOnBattery, fmt.Sprintf("%s is on battery, %.0f%% charge, %s left",
+			name, cur.info.batteryChargePercent, formatDuration(cur.info.timeLeft)), cur.onBattSince)
+	}
+	if raised("lowbatt") {
+		event(webhookLowBattery, fmt.Sprintf("%s battery is low, %.0f%% charge, %s left",
+			name, cur.info.batteryChargePercent, formatDuration(cur.info.timeLeft)), cur.onBattSince)
+	}
+	if raised("replacebatt") {
+		event(webhookReplaceBatt, fmt.Sprintf("%s battery needs replacing", name), time.Time{})
+	}
+	if !cur.onBattSince.IsZero() && !hasStatusFlag(cur.info, "onbatt") && !hasStatusFlag(cur.info, "commlost") {
+		event(webhookRestored, fmt.Sprintf("%s: power restored after %s",
+			name, formatDuration(lastPoll.Sub(cur.onBattSince))), cur.onBattSince)
+		cur.onBattSince = time.Time{}
+	}
+}
+
+// forget drops the state of a target that is no longer polled.
+func (s *webhookSink) forget(t *target) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	delete(s.states, t)
+}
+
+// notify queues an event for every webhook subscribed to it. A webhook whose
+// queue is full has the event dead-lettered rather than holding up polling.
+func (s *webhookSink) notify(e *webhookEvent) {
+
+	webhookEventsTotal.WithLabelValues(e.Event).Inc()
+	log.Printf("Webhook event %s: %s", e.Event, e.Summary)
+
+	for _, w := range s.webhooks {
+		if !w.events[e.Event] {
+			continue
+		}
+		select {
+		case w.queue <- e:
+		default:
+			s.deadLetter(w, e, nil, 0, fmt.Errorf("queue full"))
+		}
+	}
+}
+
+// run delivers the events queued for w until the queue is closed.
+func (s *webhookSink) run(w *webhook) {
+
+	defer close(w.done)
+
+	for e := range w.queue {
+		body, err := w.render(e)
+		if err != nil {
+			s.deadLetter(w, e, nil, 0, err)
+			continue
+		}
+
+		attempts, err := s.deliver(w, body)
+		if err != nil {
+			s.deadLetter(w, e, body, attempts, err)
+			continue
+		}
+		webhookDeliveries.WithLabelValues(w.name, "delivered").Inc()
+	}
+}
+
+func (w *webhook) render(e *webhookEvent) ([]byte, error) {
+
+	var body bytes.Buffer
+	if err := w.template.Execute(&body, e); err != nil {
+		return nil, fmt.Errorf("Error executing template: %+v", err)
+	}
+
+	return body.Bytes(), nil
+}
+
+// deliver posts body to w, retrying with exponential backoff on network
+// errors, 429 and 5xx responses. It returns the number of attempts made.
+func (s *webhookSink) deliver(w *webhook, body []byte) (int, error) {
+
+	backoff := webhookMinBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := w.post(s.ctx, body)
+		if err == nil {
+			return attempt, nil
+		}
+		if !retry || attempt > w.maxRetries {
+			return attempt, err
+		}
+
+		log.Printf("Error sending webhook %s, retrying in %s: %+v", w.name, backoff, err)
+		webhookRetries.WithLabelValues(w.name).Inc()
+
+		select {
+		case <-s.ctx.Done():
+			return attempt, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > webhookMaxBackoff {
+			backoff = webhookMaxBackoff
+		}
+	}
+}
+
+// post sends a single request and reports whether a failure is worth
+// retrying.
+func (w *webhook) post(ctx context.Context, body []byte) (bool, error) {
+
+	req, err := http.NewRequest("POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", w.contentType)
+	req.Header.Set("User-Agent", "apcupsd-exporter")
+	for name, value := range w.headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return false, nil
+	}
+
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+	err = fmt.Errorf("Server returned HTTP status %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode/100 == 5, err
+}
+
+// deadLetter records a notification that could not be delivered as a JSON
+// line in the dead-letter file, so that it can be inspected or replayed.
+func (s *webhookSink) deadLetter(w *webhook, e *webhookEvent, body []byte, attempts int, cause error) {
+
+	webhookDeliveries.WithLabelValues(w.name, "dead_lettered").Inc()
+	log.Printf("Giving up on webhook %s for %s event of %s after %d attempts: %+v", w.name, e.Event, e.Target, attempts, cause)
+
+	if s.deadLetterFile == "" {
+		return
+	}
+
+	line, err := json.Marshal(struct {
+		Time     time.Time     `json:"time"`
+		Webhook  string        `json:"webhook"`
+		URL      string        `json:"url"`
+		Attempts int           `json:"attempts"`
+		Error    string        `json:"error"`
+		Event    *webhookEvent `json:"event"`
+		Body     string        `json:"body,omitempty"`
+	}{time.Now(), w.name, w.url, attempts, cause.Error(), e, string(body)})
+	if err != nil {
+		log.Printf("Error encoding dead letter: %+v", err)
+		return
+	}
+
+	s.dlqLock.Lock()
+	defer s.dlqLock.Unlock()
+
+	f, err := os.OpenFile(s.deadLetterFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		log.Printf("Error opening dead-letter file: %+v", err)
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		log.Printf("Error writing dead-letter file: %+v", err)
+	}
+}
+
+// Close gives queued notifications a few seconds to be delivered; what is
+// left after that is dead-lettered.
+func (s *webhookSink) Close() error {
+
+	s.mtx.Lock()
+	s.closed = true
+	s.mtx.Unlock()
+
+	for _, w := range s.webhooks {
+		close(w.queue)
+	}
+
+	timeout := time.After(webhookFlushTimeout)
+	for _, w := range s.webhooks {
+		select {
+		case <-w.done:
+		case <-timeout:
+			s.cancel()
+			<-w.done
+		}
+	}
+	s.cancel()
+
+	return nil
+}
+
+func hasStatusFlag(info *upsInfo, flag string) bool {
+	if info == nil {
+		return false
+	}
+	for _, f := range statusFlags(info.status) {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// onBatterySince returns when a UPS on battery at a poll switched to it,
+// from TONBATT when apcupsd reports it.
+func onBatterySince(info *upsInfo, at time.Time) time.Time {
+	return at.Add(-info.timeOnBattery)
+}
+
+// webhookTargetName names a target in summaries by its UPS name, falling
+// back to the target name.
+func webhookTargetName(t *target, info *upsInfo) string {
+	if info != nil && info.upsName != "" {
+		return info.upsName
+	}
+	return t.name
+}
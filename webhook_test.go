@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookPoll is the outcome of one poll of a target: its status, or an
+// error when it could not be reached.
+type webhookPoll struct {
+	at   time.Duration
+	info *upsInfo
+	err  error
+}
+
+func TestWebhookSinkTransitions(t *testing.T) {
+
+	online := &upsInfo{status: "online"}
+	onbatt := func(tonbatt time.Duration) *upsInfo {
+		return &upsInfo{status: "onbatt", timeOnBattery: tonbatt}
+	}
+	unreachable := errors.New("connection refused")
+
+	tests := []struct {
+		name  string
+		polls []webhookPoll
+		want  []string
+	}{
+		{
+			name:  "steady",
+			polls: []webhookPoll{{0, online, nil}, {10 * time.Second, online, nil}},
+		},
+		{
+			name:  "outage",
+			polls: []webhookPoll{{0, online, nil}, {10 * time.Second, onbatt(4 * time.Second), nil}, {70 * time.Second, online, nil}},
+			want:  []string{"onbatt 4", "restored 64"},
+		},
+		{
+			name:  "on battery at start",
+			polls: []webhookPoll{{0, onbatt(30 * time.Second), nil}, {10 * time.Second, onbatt(40 * time.Second), nil}, {20 * time.Second, online, nil}},
+			want:  []string{"restored 50"},
+		},
+		{
+			name: "low battery",
+			polls: []webhookPoll{{0, online, nil}, {10 * time.Second, onbatt(0), nil},
+				{20 * time.Second, &upsInfo{status: "onbatt lowbatt", timeOnBattery: 10 * time.Second}, nil}},
+			want: []string{"onbatt 0", "lowbatt 10"},
+		},
+		{
+			name: "commlost keeps the outage",
+			polls: []webhookPoll{{0, onbatt(0), nil}, {10 * time.Second, &upsInfo{status: "commlost"}, nil},
+				{20 * time.Second, onbatt(20 * time.Second), nil}, {30 * time.Second, online, nil}},
+			want: []string{"commlost", "restored 30"},
+		},
+		{
+			name:  "replace battery",
+			polls: []webhookPoll{{0, online, nil}, {10 * time.Second, &upsInfo{status: "online replacebatt"}, nil}},
+			want:  []string{"replacebatt"},
+		},
+		{
+			name:  "unreachable",
+			polls: []webhookPoll{{0, online, nil}, {10 * time.Second, nil, unreachable}, {20 * time.Second, nil, unreachable}, {45 * time.Second, online, nil}},
+			want:  []string{"unreachable", "reachable 35"},
+		},
+		{
+			name:  "unreachable at start",
+			polls: []webhookPoll{{0, nil, unreachable}, {10 * time.Second, online, nil}, {20 * time.Second, nil, unreachable}, {30 * time.Second, online, nil}},
+			want:  []string{"unreachable", "reachable 10"},
+		},
+		{
+			name:  "outage while unreachable",
+			polls: []webhookPoll{{0, online, nil}, {10 * time.Second, nil, unreachable}, {20 * time.Second, onbatt(5 * time.Second), nil}},
+			want:  []string{"unreachable", "reachable 10", "onbatt 5"},
+		},
+	}
+
+	start := time.Unix(1700000000, 0)
+	for _, test := range tests {
+		w := &webhook{name: "test", events: map[string]bool{}, queue: make(chan *webhookEvent, webhookQueueSize)}
+		for _, e := range webhookEvents {
+			w.events[e] = true
+		}
+		s := &webhookSink{webhooks: []*webhook{w}, states: map[*target]*webhookTargetState{}}
+
+		ups := newTestTarget("ups", nil, nil)
+		for _, poll := range test.polls {
+			ups.lastPoll, ups.lastErr = start.Add(poll.at), poll.err
+			if poll.info != nil {
+				ups.last = &Snapshot{Info: poll.info, Time: ups.lastPoll}
+			}
+			s.polled(context.Background(), ups)
+		}
+		close(w.queue)
+
+		var got []string
+		for e := range w.queue {
+			event := e.Event
+			if e.OutageSeconds != nil {
+				event += " " + formatFloat(*e.OutageSeconds)
+			}
+			got = append(got, event)
+		}
+		if strings.Join(got, ", ") != strings.Join(test.want, ", ") {
+			t.Errorf("%s: notified %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestNewWebhook(t *testing.T) {
+
+	negative := -1
+
+	tests := []struct {
+		name   string
+		config webhookConfig
+		err    string
+	}{
+		{name: "defaults", config: webhookConfig{URL: "hooks.example.com/ups"}},
+		{name: "no url", config: webhookConfig{}, err: "missing url"},
+		{name: "unknown event", config: webhookConfig{URL: "http://x", Events: []string{"onbatt", "offline"}}, err: `unknown event "offline"`},
+		{name: "negative retries", config: webhookConfig{URL: "http://x", MaxRetries: &negative}, err: "max_retries"},
+		{name: "two templates", config: webhookConfig{URL: "http://x", Template: "{{.Summary}}", TemplateFile: "body.tmpl"}, err: "only one of"},
+		{name: "bad template", config: webhookConfig{URL: "http://x", Template: "{{.Summary"}, err: "unclosed action"},
+	}
+
+	for _, test := range tests {
+		w, err := newWebhook(test.config)
+		if test.err == "" && err != nil {
+			t.Errorf("%s: unexpected error: %+v", test.name, err)
+		}
+		if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: error = %v, want one containing %q", test.name, err, test.err)
+		}
+		if err == nil && (w.url != "http://hooks.example.com/ups" || w.contentType != "application/json" || len(w.events) != len(webhookEvents) || w.maxRetries != 5) {
+			t.Errorf("%s: unexpected defaults %+v", test.name, w)
+		}
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		statuses   []int
+		requests   int
+		deadLetter bool
+	}{
+		{name: "delivered", statuses: []int{http.StatusOK}, requests: 1},
+		{name: "retried", statuses: []int{http.StatusServiceUnavailable, http.StatusNoContent}, requests: 2},
+		{name: "rejected", statuses: []int{http.StatusBadRequest}, requests: 1, deadLetter: true},
+		{name: "retries exhausted", statuses: []int{http.StatusTooManyRequests, http.StatusTooManyRequests}, requests: 2, deadLetter: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			var mtx sync.Mutex
+			var bodies []string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				if r.Header.Get("Content-Type") != "text/plain" || r.Header.Get("X-Token") != "secret" {
+					t.Errorf("Unexpected headers %v", r.Header)
+				}
+
+				mtx.Lock()
+				defer mtx.Unlock()
+				bodies = append(bodies, string(body))
+				w.WriteHeader(test.statuses[len(bodies)-1])
+			}))
+			defer srv.Close()
+
+			dir := tempDir(t)
+			defer os.RemoveAll(dir)
+
+			retries := 1
+			s, err := newWebhookSink(&webhookFileConfig{
+				DeadLetterFile: filepath.Join(dir, "webhooks.dead"),
+				Webhooks: []webhookConfig{{
+					Name:        "ntfy",
+					URL:         srv.URL,
+					Events:      []string{webhookOnBattery},
+					Headers:     map[string]string{"X-Token": "secret"},
+					ContentType: "text/plain",
+					Template:    "{{.Summary}} ({{duration .OutageSeconds}})",
+					MaxRetries:  &retries,
+				}},
+			})
+			if err != nil {
+				t.Fatalf("Error creating sink: %+v", err)
+			}
+
+			outage := 90.0
+			s.notify(&webhookEvent{Event: webhookRestored, Summary: "not subscribed"})
+			s.notify(&webhookEvent{Event: webhookOnBattery, Summary: "rack1 is on battery", Target: "ups", OutageSeconds: &outage})
+			s.Close()
+
+			if len(bodies) != test.requests {
+				t.Fatalf("Webhook received %d requests, want %d", len(bodies), test.requests)
+			}
+			for _, body := range bodies {
+				if body != "rack1 is on battery (1m30s)" {
+					t.Errorf("Webhook received %q", body)
+				}
+			}
+
+			content, err := ioutil.ReadFile(filepath.Join(dir, "webhooks.dead"))
+			if (err == nil) != test.deadLetter {
+				t.Fatalf("Dead-letter file read with %v, want it written %v", err, test.deadLetter)
+			}
+			if !test.deadLetter {
+				return
+			}
+			var letter struct {
+				Webhook  string        `json:"webhook"`
+				Attempts int           `json:"attempts"`
+				Event    *webhookEvent `json:"event"`
+				Body     string        `json:"body"`
+			}
+			if err := json.Unmarshal(content, &letter); err != nil {
+				t.Fatalf("Invalid dead letter %q: %+v", content, err)
+			}
+			if letter.Webhook != "ntfy" || letter.Attempts != test.requests || letter.Event.Event != webhookOnBattery || letter.Body != bodies[0] {
+				t.Errorf("Unexpected dead letter %q", content)
+			}
+		})
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	zabbixTimeout = 10 * time.Second
+
+	// zabbixMaxResponse bounds the response read from the server.
+	zabbixMaxResponse = 1 << 20
+)
+
+// Every Zabbix protocol packet starts with "ZBXD", a flags byte, the data
+// length and a reserved length, both little endian uint32.
+var zabbixHeader = []byte{'Z', 'B', 'X', 'D', 0x01}
+
+var zabbixProcessed = regexp.MustCompile(`processed: (\d+); failed: (\d+)`)
+
+// zabbixValue is an item value in a sender data request.
+type zabbixValue struct {
+	Host  string `json:"host"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Clock int64  `json:"clock"`
+	NS    int    `json:"ns"`
+}
+
+type zabbixRequest struct {
+	Request string        `json:"request"`
+	Data    []zabbixValue `json:"data"`
+	Clock   int64         `json:"clock"`
+	NS      int           `json:"ns"`
+}
+
+type zabbixResponse struct {
+	Response string `json:"response"`
+	Info     string `json:"info"`
+}
+
+// zabbixSink sends the values of every poll to a Zabbix server or proxy as
+// a trapper client, as zabbix_sender does. The UPSes are announced through
+// low-level discovery, so that item prototypes on the Zabbix host create
+// the items of each UPS.
+type zabbixSink struct {
+	address           string
+	host              string
+	prefix            string
+	discoveryInterval time.Duration
+
+	mtx           sync.Mutex
+	discovered    map[*target]map[string]string
+	lastDiscovery time.Time
+	announced     []map[string]string
+}
+
+func newZabbixSink(address, host, prefix string, discoveryInterval time.Duration) (*zabbixSink, error) {
+
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "10051")
+	}
+	if host == "" {
+		return nil, fmt.Errorf("A Zabbix host name is required")
+	}
+
+	return &zabbixSink{
+		address:           address,
+		host:              host,
+		prefix:            prefix,
+		discoveryInterval: discoveryInterval,
+		discovered:        map[*target]map[string]string{},
+	}, nil
+}
+
+func (s *zabbixSink) polled(ctx context.Context, t *target) {
+
+	snapshot, lastPoll, lastErr := t.state()
+	if snapshot == nil {
+		return
+	}
+
+	if err := s.discover(t, snapshot.Info); err != nil {
+		log.Printf("Error sending Zabbix discovery to %s: %+v", s.address, err)
+		return
+	}
+
+	id := t.slug()
+	var values []zabbixValue
+	add := func(name, value string) {
+		values = append(values, zabbixValue{
+			Host:  s.host,
+			Key:   fmt.Sprintf("%s.%s[%s]", s.prefix, name, id),
+			Value: value,
+			Clock: lastPoll.Unix(),
+			NS:    lastPoll.Nanosecond(),
+		})
+	}
+
+	if lastErr != nil {
+		add("up", "0")
+	} else {
+		add("up", "1")
+		add("status", snapshot.Info.status)
+		for _, f := range numericFields(snapshot.Info) {
+			add(f.name, strconv.FormatFloat(f.value, 'f', -1, 64))
+		}
+	}
+
+	processed, failed, err := s.send(values)
+	if err != nil {
+		log.Printf("Error sending %s to Zabbix at %s: %+v", t.name, s.address, err)
+		return
+	}
+	if failed > 0 {
+		log.Printf("Zabbix at %s processed %d and rejected %d values of %s; check the items exist on host %s", s.address, processed, failed, t.name, s.host)
+	}
+}
+
+// discover sends the discovery data of all targets seen so far when it
+// changed, or when discoveryInterval has passed so that Zabbix does not
+// consider the UPSes lost.
+func (s *zabbixSink) discover(t *target, info *upsInfo) error {
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.discovered[t] = map[string]string{
+		"{#UPSID}":    t.slug(),
+		"{#TARGET}":   t.name,
+		"{#HOSTNAME}": info.hostname,
+		"{#UPSNAME}":  info.upsName,
+		"{#MODEL}":    info.model,
+		"{#SERIAL}":   info.serialNumber,
+	}
+	for name, value := range t.labels {
+		s.discovered[t]["{#"+strings.ToUpper(name)+"}"] = value
+	}
+
+	entries := make([]map[string]string, 0, len(s.discovered))
+	for _, entry := range s.discovered {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i]["{#UPSID}"] < entries[j]["{#UPSID}"] })
+
+	if reflect.DeepEqual(entries, s.announced) && time.Since(s.lastDiscovery) < s.discoveryInterval {
+		return nil
+	}
+
+	discovery, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	_, failed, err := s.send([]zabbixValue{{
+		Host:  s.host,
+		Key:   s.prefix + ".discovery",
+		Value: string(discovery),
+		Clock: now.Unix(),
+		NS:    now.Nanosecond(),
+	}})
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("Discovery rule %s.discovery rejected, check it exists as a trapper rule on host %s", s.prefix, s.host)
+	}
+
+	s.announced = entries
+	s.lastDiscovery = now
+
+	return nil
+}
+
+// forget drops a target that is no longer polled from the discovery data,
+// from the next discovery on. Nothing is sent straight away so that
+// shutting down does not make Zabbix lose every UPS.
+func (s *zabbixSink) forget(t *target) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	delete(s.discovered, t)
+}
+
+// send sends a sender data request and returns the number of values the
+// server processed and rejected.
+func (s *zabbixSink) send(values []zabbixValue) (int, int, error) {
+
+	now := time.Now()
+	data, err := json.Marshal(zabbixRequest{
+		Request: "sender data",
+		Data:    values,
+		Clock:   now.Unix(),
+		NS:      now.Nanosecond(),
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	conn, err := net.DialTimeout("tcp", s.address, zabbixTimeout)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(zabbixTimeout))
+
+	packet := make([]byte, len(zabbixHeader)+8, len(zabbixHeader)+8+len(data))
+	copy(packet, zabbixHeader)
+	binary.LittleEndian.PutUint32(packet[len(zabbixHeader):], uint32(len(data)))
+	packet = append(packet, data...)
+
+	if _, err := conn.Write(packet); err != nil {
+		return 0, 0, fmt.Errorf("Error writing to Zabbix: %+v", err)
+	}
+
+	header := make([]byte, len(zabbixHeader)+8)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return 0, 0, fmt.Errorf("Error reading Zabbix response: %+v", err)
+	}
+	if string(header[:4]) != "ZBXD" {
+		return 0, 0, fmt.Errorf("Invalid Zabbix response header %q", header[:4])
+	}
+	length := binary.LittleEndian.Uint32(header[len(zabbixHeader):])
+	if length > zabbixMaxResponse {
+		return 0, 0, fmt.Errorf("Zabbix response of %d bytes is too large", length)
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return 0, 0, fmt.Errorf("Error reading Zabbix response: %+v", err)
+	}
+
+	var resp zabbixResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return 0, 0, fmt.Errorf("Invalid Zabbix response: %+v", err)
+	}
+	if resp.Response != "success" {
+		return 0, 0, fmt.Errorf("Zabbix responded %q: %s", resp.Response, resp.Info)
+	}
+
+	m := zabbixProcessed.FindStringSubmatch(resp.Info)
+	if m == nil {
+		return len(values), 0, nil
+	}
+	processed, _ := strconv.Atoi(m[1])
+	failed, _ := strconv.Atoi(m[2])
+
+	return processed, failed, nil
+}
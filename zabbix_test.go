@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// zabbixTestTrapper is a Zabbix trapper keeping the sender data requests
+// it receives and answering each with respond.
+type zabbixTestTrapper struct {
+	listener net.Listener
+	respond  func(req zabbixRequest) []byte
+
+	mtx      sync.Mutex
+	requests []zabbixRequest
+}
+
+func newZabbixTestTrapper(t *testing.T, respond func(req zabbixRequest) []byte) *zabbixTestTrapper {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %+v", err)
+	}
+
+	z := &zabbixTestTrapper{listener: l, respond: respond}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go z.handle(t, conn)
+		}
+	}()
+
+	return z
+}
+
+func (z *zabbixTestTrapper) handle(t *testing.T, conn net.Conn) {
+
+	defer conn.Close()
+
+	header := make([]byte, len(zabbixHeader)+8)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Errorf("Error reading header: %+v", err)
+		return
+	}
+	if string(header[:len(zabbixHeader)]) != string(zabbixHeader) || binary.LittleEndian.Uint32(header[len(zabbixHeader)+4:]) != 0 {
+		t.Errorf("Invalid header % x", header)
+		return
+	}
+
+	data := make([]byte, binary.LittleEndian.Uint32(header[len(zabbixHeader):]))
+	if _, err := io.ReadFull(conn, data); err != nil {
+		t.Errorf("Error reading data: %+v", err)
+		return
+	}
+	var req zabbixRequest
+	if err := json.Unmarshal(data, &req); err != nil || req.Request != "sender data" {
+		t.Errorf("Invalid request %q: %v", data, err)
+		return
+	}
+
+	z.mtx.Lock()
+	z.requests = append(z.requests, req)
+	z.mtx.Unlock()
+
+	conn.Write(z.respond(req))
+}
+
+func (z *zabbixTestTrapper) received() []zabbixRequest {
+	z.mtx.Lock()
+	defer z.mtx.Unlock()
+
+	return append([]zabbixRequest{}, z.requests...)
+}
+
+// zabbixPacket frames data as the Zabbix protocol does.
+func zabbixPacket(data string) []byte {
+	packet := make([]byte, len(zabbixHeader)+8)
+	copy(packet, zabbixHeader)
+	binary.LittleEndian.PutUint32(packet[len(zabbixHeader):], uint32(len(data)))
+	return append(packet, data...)
+}
+
+// zabbixProcessedAll answers as a server that accepted every value.
+func zabbixProcessedAll(req zabbixRequest) []byte {
+	n := strconv.Itoa(len(req.Data))
+	info := "processed: " + n + "; failed: 0; total: " + n + "; seconds spent: 0.000055"
+	return zabbixPacket(`{"response":"success","info":"` + info + `"}`)
+}
+
+func TestNewZabbixSink(t *testing.T) {
+
+	tests := []struct {
+		address, host string
+		want          string
+		err           bool
+	}{
+		{address: "zabbix", host: "ups-exporter", want: "zabbix:10051"},
+		{address: "zabbix-proxy:10052", host: "ups-exporter", want: "zabbix-proxy:10052"},
+		{address: "zabbix", err: true},
+	}
+
+	for _, test := range tests {
+		s, err := newZabbixSink(test.address, test.host, "apcupsd", time.Hour)
+		if (err != nil) != test.err {
+			t.Errorf("newZabbixSink(%q, %q) = %v, want error %v", test.address, test.host, err, test.err)
+			continue
+		}
+		if err == nil && s.address != test.want {
+			t.Errorf("newZabbixSink(%q, %q) sends to %s, want %s", test.address, test.host, s.address, test.want)
+		}
+	}
+}
+
+func TestZabbixSinkSend(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		response  []byte
+		processed int
+		failed    int
+		err       string
+	}{
+		{name: "processed", response: zabbixPacket(`{"response":"success","info":"processed: 1; failed: 1; total: 2; seconds spent: 0.000055"}`), processed: 1, failed: 1},
+		{name: "no counts", response: zabbixPacket(`{"response":"success"}`), processed: 2},
+		{name: "failed", response: zabbixPacket(`{"response":"failed","info":"invalid data"}`), err: `responded "failed": invalid data`},
+		{name: "not json", response: zabbixPacket(`OK`), err: "Invalid Zabbix response"},
+		{name: "bad header", response: []byte("HTTP/1.1 400 Bad Request\r\n\r\n"), err: "Invalid Zabbix response header"},
+		{name: "too large", response: []byte{'Z', 'B', 'X', 'D', 0x01, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0}, err: "too large"},
+		{name: "truncated", response: zabbixPacket(`{"response":"success"}`)[:20], err: "Error reading Zabbix response"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			z := newZabbixTestTrapper(t, func(zabbixRequest) []byte { return test.response })
+			defer z.listener.Close()
+
+			s, err := newZabbixSink(z.listener.Addr().String(), "ups-exporter", "apcupsd", time.Hour)
+			if err != nil {
+				t.Fatalf("Error creating sink: %+v", err)
+			}
+
+			processed, failed, err := s.send([]zabbixValue{{Host: "ups-exporter", Key: "apcupsd.up[a]", Value: "1"}, {Host: "ups-exporter", Key: "apcupsd.up[b]", Value: "1"}})
+			if test.err == "" && err != nil {
+				t.Fatalf("Unexpected error: %+v", err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Errorf("Error = %v, want one containing %q", err, test.err)
+			}
+			if processed != test.processed || failed != test.failed {
+				t.Errorf("send() = %d processed and %d failed, want %d and %d", processed, failed, test.processed, test.failed)
+			}
+			if got := z.received(); len(got) != 1 || len(got[0].Data) != 2 {
+				t.Errorf("Trapper received %v, want one request with both values", got)
+			}
+		})
+	}
+}
+
+func TestZabbixSinkDiscovery(t *testing.T) {
+
+	z := newZabbixTestTrapper(t, zabbixProcessedAll)
+	defer z.listener.Close()
+
+	s, err := newZabbixSink(z.listener.Addr().String(), "ups-exporter", "apcupsd", time.Hour)
+	if err != nil {
+		t.Fatalf("Error creating sink: %+v", err)
+	}
+
+	rack1 := newTestTarget("rack1:3551", map[string]string{"site": "syd"}, &upsInfo{status: "online", upsName: "rack1", serialNumber: "AS1"})
+	rack2 := newTestTarget("rack2:3551", nil, &upsInfo{status: "onbatt", upsName: "rack2"})
+
+	// discovered lists the {#UPSID} of every discovery sent since the last
+	// call, or nil for a poll that only sent values.
+	var seen int
+	discovered := func() []string {
+		requests := z.received()
+		var ids []string
+		for _, req := range requests[seen:] {
+			for _, v := range req.Data {
+				if v.Key != "apcupsd.discovery" {
+					continue
+				}
+				var entries []map[string]string
+				if err := json.Unmarshal([]byte(v.Value), &entries); err != nil {
+					t.Fatalf("Invalid discovery %q: %+v", v.Value, err)
+				}
+				ids = []string{}
+				for _, entry := range entries {
+					ids = append(ids, entry["{#UPSID}"])
+				}
+			}
+		}
+		seen = len(requests)
+		return ids
+	}
+
+	tests := []struct {
+		name string
+		poll func()
+		want []string
+	}{
+		{name: "first target", poll: func() { s.polled(context.Background(), rack1) }, want: []string{"rack1_3551"}},
+		{name: "same target again", poll: func() { s.polled(context.Background(), rack1) }, want: nil},
+		{name: "second target", poll: func() { s.polled(context.Background(), rack2) }, want: []string{"rack1_3551", "rack2_3551"}},
+		{name: "forgotten target", poll: func() { s.forget(rack1); s.polled(context.Background(), rack2) }, want: []string{"rack2_3551"}},
+	}
+
+	for _, test := range tests {
+		test.poll()
+		got := discovered()
+		if strings.Join(got, ",") != strings.Join(test.want, ",") || (got == nil) != (test.want == nil) {
+			t.Errorf("%s: discovered %q, want %q", test.name, got, test.want)
+		}
+	}
+
+	requests := z.received()
+	values := requests[len(requests)-1].Data
+	keys := map[string]string{}
+	for _, v := range values {
+		keys[v.Key] = v.Value
+	}
+	if keys["apcupsd.up[rack2_3551]"] != "1" || keys["apcupsd.status[rack2_3551]"] != "onbatt" || len(values) != 2+len(numericFields(rack2.last.Info)) {
+		t.Errorf("Unexpected values %v", keys)
+	}
+}